@@ -0,0 +1,203 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// announcement targets other than session tags
+	targetAll     = ""
+	targetIOStart = "iostart"
+	targetIOExt   = "ioext"
+)
+
+// announcement is an arbitrary message composed by admins
+// and pushed to all subscribers or a segment of them.
+type announcement struct {
+	ID    string `json:"id" datastore:"-"`
+	Title string `json:"title" datastore:"t,noindex"`
+	Body  string `json:"body" datastore:"b,noindex"`
+	Link  string `json:"link,omitempty" datastore:"l,noindex"`
+	// Target is one of targetAll, targetIOStart, targetIOExt
+	// or a session tag, e.g. "TOPIC_ANDROID", in which case only users
+	// who bookmarked sessions with that tag are notified.
+	Target string    `json:"target,omitempty" datastore:"tgt,noindex"`
+	SendAt time.Time `json:"sendAt" datastore:"at"`
+	Sent   bool      `json:"sent" datastore:"sent"`
+}
+
+// valid returns true if a has all required fields set.
+func (a *announcement) valid() bool {
+	return strings.TrimSpace(a.Title) != "" && strings.TrimSpace(a.Body) != ""
+}
+
+// isTagTarget returns true if a targets users by a session tag.
+func (a *announcement) isTagTarget() bool {
+	return a.Target != targetAll && a.Target != targetIOStart && a.Target != targetIOExt
+}
+
+// targetsUser returns true if a is aimed at a user with push config pi.
+// bks are user bookmarks and sessions are all event sessions,
+// both used only if a.isTagTarget() is true.
+func (a *announcement) targetsUser(pi *userPush, bks []string, sessions map[string]*eventSession) bool {
+	switch a.Target {
+	case targetAll:
+		return true
+	case targetIOStart:
+		return pi.IOStart
+	case targetIOExt:
+		return pi.Pext != nil
+	}
+	for _, id := range bks {
+		s, ok := sessions[id]
+		if !ok {
+			continue
+		}
+		for _, t := range s.Tags {
+			if t == a.Target {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// userAnnouncements returns a subset of items aimed at a user with push config pi
+// and bookmarked sessions bks.
+// Event data is fetched only if some of the items target a session tag.
+func userAnnouncements(c context.Context, items []*announcement, pi *userPush, bks []string) ([]*announcement, error) {
+	var sessions map[string]*eventSession
+	res := make([]*announcement, 0, len(items))
+	for _, a := range items {
+		if a.isTagTarget() && sessions == nil {
+			d, err := getLatestEventData(c, nil)
+			if err != nil {
+				return nil, err
+			}
+			sessions = d.Sessions
+		}
+		if a.targetsUser(pi, bks, sessions) {
+			res = append(res, a)
+		}
+	}
+	return res, nil
+}
+
+// filterUserAnnouncements reduces dc.Announcements to a subset
+// aimed at a user with push config pi and bookmarks bks.
+func filterUserAnnouncements(c context.Context, dc *dataChanges, pi *userPush, bks []string) error {
+	if len(dc.Announcements) == 0 {
+		return nil
+	}
+	list, err := userAnnouncements(c, dc.Announcements, pi, bks)
+	if err != nil {
+		return err
+	}
+	dc.Announcements = list
+	return nil
+}
+
+// announcementRecipients returns the number of users with push notifications
+// enabled that target would reach.
+// Session tag targets depend on user bookmarks stored in Google Drive,
+// which are not checked here, so the returned number is an upper bound
+// and exact is false.
+func announcementRecipients(c context.Context, target string) (n int, exact bool, err error) {
+	var prop string
+	switch target {
+	case targetIOStart:
+		prop = "io"
+	case targetIOExt:
+		prop = "ext.on"
+	}
+	if n, err = countUsersWithPush(c, prop); err != nil {
+		return 0, false, err
+	}
+	a := &announcement{Target: target}
+	return n, !a.isTagTarget(), nil
+}
+
+// validateTarget returns an error if a.Target is neither one of the predefined
+// targets nor a tag of the latest event data.
+func validateTarget(c context.Context, a *announcement) error {
+	if !a.isTagTarget() {
+		return nil
+	}
+	d, err := getLatestEventData(c, nil)
+	if err != nil {
+		return err
+	}
+	if _, ok := d.Tags[a.Target]; !ok {
+		return &apiError{code: http.StatusBadRequest, msg: fmt.Sprintf("unknown target %q", a.Target)}
+	}
+	return nil
+}
+
+// sendAnnouncement stores announcement id as dataChanges and notifies targeted subscribers.
+// It marks the announcement as sent in the same transaction, so that it is never sent twice.
+func sendAnnouncement(c context.Context, id string) error {
+	return runInTransaction(c, func(c context.Context) error {
+		a, err := getAnnouncement(c, id)
+		if err != nil {
+			return err
+		}
+		if a.Sent {
+			return nil
+		}
+		now := time.Now()
+		a.Sent = true
+		if a.SendAt.After(now) {
+			a.SendAt = now
+		}
+		if err := storeAnnouncement(c, a); err != nil {
+			return err
+		}
+		dc := &dataChanges{Updated: now, Announcements: []*announcement{a}}
+		if err := storeChanges(c, dc); err != nil {
+			return err
+		}
+		return notifySubscribersAsync(c, dc, a.Target == targetAll)
+	})
+}
+
+// sendDueAnnouncements sends all unsent announcements scheduled at or before now.
+func sendDueAnnouncements(c context.Context, now time.Time) error {
+	items, err := dueAnnouncements(c, now)
+	if err != nil {
+		return err
+	}
+	// a failed announcement must not block the others
+	var errs []string
+	for _, a := range items {
+		if err := sendAnnouncement(c, a.ID); err != nil {
+			errorf(c, "sendAnnouncement(%s): %v", a.ID, err)
+			errs = append(errs, fmt.Sprintf("%s: %v", a.ID, err))
+			continue
+		}
+		logf(c, "sent announcement %s to %q", a.ID, a.Target)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("sendDueAnnouncements: %d of %d failed: %s",
+			len(errs), len(items), strings.Join(errs, "; "))
+	}
+	return nil
+}
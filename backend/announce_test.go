@@ -0,0 +1,120 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAnnouncementTargetsUser(t *testing.T) {
+	sessions := map[string]*eventSession{
+		"android": {Id: "android", Tags: []string{"TYPE_SESSIONS", "TOPIC_ANDROID"}},
+		"web":     {Id: "web", Tags: []string{"TYPE_SESSIONS", "TOPIC_WEB"}},
+	}
+	table := []struct {
+		target string
+		pi     *userPush
+		bks    []string
+		want   bool
+	}{
+		{targetAll, &userPush{}, nil, true},
+		{targetIOStart, &userPush{IOStart: true}, nil, true},
+		{targetIOStart, &userPush{}, nil, false},
+		{targetIOExt, &userPush{Pext: &ioExtPush{Enabled: true}}, nil, true},
+		{targetIOExt, &userPush{}, nil, false},
+		{"TOPIC_ANDROID", &userPush{}, []string{"web", "android"}, true},
+		{"TOPIC_ANDROID", &userPush{}, []string{"web"}, false},
+		{"TOPIC_ANDROID", &userPush{}, []string{"unknown"}, false},
+	}
+	for i, test := range table {
+		a := &announcement{Target: test.target}
+		if v := a.targetsUser(test.pi, test.bks, sessions); v != test.want {
+			t.Errorf("%d: targetsUser(%q) = %v; want %v", i, test.target, v, test.want)
+		}
+	}
+}
+
+func TestValidateTarget(t *testing.T) {
+	if !isGAEtest {
+		t.Skipf("not implemented yet; isGAEtest = %v", isGAEtest)
+	}
+	defer resetTestState(t)
+	c := newContext(newTestRequest(t, "GET", "/dummy", nil))
+	if err := storeEventData(c, &eventData{
+		modified: time.Now(),
+		Tags: map[string]*eventTag{
+			"TOPIC_ANDROID": {Tag: "TOPIC_ANDROID", Cat: "TOPIC"},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	table := []struct {
+		target string
+		ok     bool
+	}{
+		{targetAll, true},
+		{targetIOStart, true},
+		{targetIOExt, true},
+		{"TOPIC_ANDROID", true},
+		{"TOPIC_UNKNOWN", false},
+	}
+	for i, test := range table {
+		err := validateTarget(c, &announcement{Target: test.target})
+		if (err == nil) != test.ok {
+			t.Errorf("%d: validateTarget(%q) = %v; want ok = %v", i, test.target, err, test.ok)
+		}
+		if err != nil && errStatus(err) != http.StatusBadRequest {
+			t.Errorf("%d: errStatus(%v) = %d; want 400", i, err, errStatus(err))
+		}
+	}
+}
+
+func TestMergeChangesAnnouncements(t *testing.T) {
+	dst := &dataChanges{Announcements: []*announcement{{ID: "1"}}}
+	src := &dataChanges{Announcements: []*announcement{{ID: "1"}, {ID: "2"}}}
+	mergeChanges(dst, src)
+	if len(dst.Announcements) != 2 {
+		t.Fatalf("len(dst.Announcements) = %d; want 2", len(dst.Announcements))
+	}
+	if id := dst.Announcements[1].ID; id != "2" {
+		t.Errorf("dst.Announcements[1].ID = %q; want '2'", id)
+	}
+}
+
+func TestCreateAnnouncementContentType(t *testing.T) {
+	table := []struct {
+		ctype string
+		code  int
+	}{
+		{"", http.StatusUnsupportedMediaType},
+		{"text/plain", http.StatusUnsupportedMediaType},
+		{"application/x-www-form-urlencoded", http.StatusUnsupportedMediaType},
+		{"application/json; charset=utf-8", http.StatusBadRequest},
+	}
+	for i, test := range table {
+		// invalid payload so that nothing is stored
+		r := newTestRequest(t, "POST", "/admin/announce", strings.NewReader(`{"title": ""}`))
+		r.Header.Set("content-type", test.ctype)
+		w := httptest.NewRecorder()
+		createAnnouncement(w, r)
+		if w.Code != test.code {
+			t.Errorf("%d: w.Code = %d; want %d", i, w.Code, test.code)
+		}
+	}
+}
@@ -18,23 +18,33 @@ package main
 
 import (
 	"errors"
+	"net/url"
 	"time"
 
 	"golang.org/x/net/context"
 )
 
 // notifySubscriberAsync creates an async job to begin notify subscribers.
+// There are no task queues in the standalone server yet, so it only logs d
+// and lets the callers carry on; stream subscribers still receive the changes.
 func notifySubscribersAsync(c context.Context, d *dataChanges, all bool) error {
-	return errors.New("not implemented")
+	logf(c, "notifySubscribersAsync: push is not supported; skipping changes at %s", d.Updated)
+	return nil
 }
 
-// pingUserAsync creates an async job to send a push notification to user uid.
-// skeys are session IDs used to compare against user bookmarks.
-// TODO: add ioext support
-func pingUserAsync(c context.Context, uid string, skeys []string, all bool) error {
+// notifySubscribersNextAsync schedules the next batch of notify-subscribers job with params.
+func notifySubscribersNextAsync(c context.Context, params url.Values) error {
 	return errors.New("not implemented")
 }
 
+// pingUsersAsync schedules a ping-user job for each of uids in one batch,
+// named after broadcast bid.
+// If scheduling fails for some users, those will be in the returned values
+// along with a non-nil error.
+func pingUsersAsync(c context.Context, bid string, uids []string, params url.Values) ([]string, error) {
+	return nil, errors.New("not implemented")
+}
+
 // pingDevicesAsync schedules len(endpoints) tasks of /ping-device.
 // d specifies the duration the tasker must wait before executing the task.
 // If scheduling fails for some endpoints, those will be in the returned values
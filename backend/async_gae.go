@@ -17,6 +17,7 @@
 package main
 
 import (
+	"crypto/md5"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -30,36 +31,111 @@ import (
 	"google.golang.org/appengine/taskqueue"
 )
 
+// newPOSTTask creates a task like taskqueue.NewPOSTTask does,
+// with headers of taskHeader.
+func newPOSTTask(c context.Context, p string, params url.Values) *taskqueue.Task {
+	t := taskqueue.NewPOSTTask(p, params)
+	for k, v := range taskHeader(c) {
+		t.Header[k] = v
+	}
+	return t
+}
+
+// taskHeader returns headers of a task scheduled within context c.
+// The task request inherits request ID of c in X-Request-Id header,
+// so that its logs can be correlated with those of the request which scheduled it.
+func taskHeader(c context.Context) http.Header {
+	h := make(http.Header)
+	if id := requestID(c); id != "" {
+		h.Set("X-Request-Id", id)
+	}
+	return h
+}
+
 // notifySubscriberAsync creates an async job to begin notify subscribers.
 func notifySubscribersAsync(c context.Context, d *dataChanges, all bool) error {
 	skeys := make([]string, 0, len(d.Sessions))
 	for id, _ := range d.Sessions {
 		skeys = append(skeys, id)
 	}
+	ioext, err := json.Marshal(d.IoExt)
+	if err != nil {
+		return err
+	}
+	announce, err := json.Marshal(d.Announcements)
+	if err != nil {
+		return err
+	}
 	p := path.Join(config.Prefix, "/task/notify-subscribers")
-	// TODO: add ioext to the payload
-	t := taskqueue.NewPOSTTask(p, url.Values{
+	t := newPOSTTask(c, p, url.Values{
+		"id":       {newBroadcastID()},
 		"sessions": {strings.Join(skeys, " ")},
+		"ioext":    {string(ioext)},
+		"announce": {string(announce)},
 		"all":      {fmt.Sprintf("%v", all)},
 	})
-	_, err := taskqueue.Add(c, t, "")
+	_, err = taskqueue.Add(c, t, "")
 	return err
 }
 
-// pingUserAsync creates an async job to send a push notification to user devices.
-// sessions are session IDs used to compare against user bookmarks.
-// TODO: add ioext support
-func pingUserAsync(c context.Context, uid string, sessions []string, all bool) error {
-	p := path.Join(config.Prefix, "/task/ping-user")
-	t := taskqueue.NewPOSTTask(p, url.Values{
-		"uid":      {uid},
-		"sessions": {strings.Join(sessions, " ")},
-		"all":      {fmt.Sprintf("%v", all)},
-	})
+// notifySubscribersNextAsync schedules a /task/notify-subscribers with params,
+// which normally contain the next batch cursor.
+// The task is named after params "id" and "batch" values, so that
+// the same batch is never scheduled twice.
+func notifySubscribersNextAsync(c context.Context, params url.Values) error {
+	p := path.Join(config.Prefix, "/task/notify-subscribers")
+	t := newPOSTTask(c, p, params)
+	t.Name = fmt.Sprintf("notify-%s-%s", params.Get("id"), params.Get("batch"))
 	_, err := taskqueue.Add(c, t, "")
+	if err == taskqueue.ErrTaskAlreadyAdded {
+		err = nil
+	}
 	return err
 }
 
+// pingUsersAsync schedules a /task/ping-user for each of uids in one batch.
+// params are passed to each task along with the user ID.
+// The tasks are named after broadcast bid and the user ID,
+// so that a user is never pinged twice within the same broadcast.
+// If scheduling fails for some users, those will be in the returned values
+// along with a non-nil error.
+func pingUsersAsync(c context.Context, bid string, uids []string, params url.Values) ([]string, error) {
+	if len(uids) == 0 {
+		return nil, nil
+	}
+	p := path.Join(config.Prefix, "/task/ping-user")
+	jobs := make([]*taskqueue.Task, 0, len(uids))
+	for _, uid := range uids {
+		v := url.Values{"uid": {uid}}
+		for k, pv := range params {
+			if k != "uid" {
+				v[k] = pv
+			}
+		}
+		t := newPOSTTask(c, p, v)
+		t.Name = fmt.Sprintf("ping-%s-%x", bid, md5.Sum([]byte(uid)))
+		jobs = append(jobs, t)
+	}
+
+	_, err := taskqueue.AddMulti(c, jobs, "")
+	merr, mok := err.(appengine.MultiError)
+	if !mok {
+		return nil, err
+	}
+
+	errUsers := make([]string, 0)
+	for i, e := range merr {
+		if e == nil || e == taskqueue.ErrTaskAlreadyAdded {
+			continue
+		}
+		errUsers = append(errUsers, uids[i])
+	}
+	if len(errUsers) == 0 {
+		return nil, nil
+	}
+	return errUsers, fmt.Errorf("pingUsersAsync: %v", err)
+}
+
 // pingDevicesAsync schedules len(endpoints) tasks of /ping-device.
 // d specifies the duration the tasker must wait before executing the task.
 // If scheduling fails for some endpoints, those will be in the returned values
@@ -71,7 +147,7 @@ func pingDevicesAsync(c context.Context, uid string, endpoints []string, d time.
 	p := path.Join(config.Prefix, "/task/ping-device")
 	jobs := make([]*taskqueue.Task, 0, len(endpoints))
 	for _, endpoint := range endpoints {
-		t := taskqueue.NewPOSTTask(p, url.Values{
+		t := newPOSTTask(c, p, url.Values{
 			"uid":      {uid},
 			"endpoint": {endpoint},
 		})
@@ -104,7 +180,7 @@ func pingExtPartyAsync(c context.Context, key string) error {
 		return nil
 	}
 	p := path.Join(config.Prefix, "/task/ping-ext")
-	t := taskqueue.NewPOSTTask(p, url.Values{
+	t := newPOSTTask(c, p, url.Values{
 		"key": {key},
 	})
 	_, err := taskqueue.Add(c, t, "")
@@ -117,7 +193,7 @@ func submitSessionSurveyAsync(c context.Context, sid string, s *sessionSurvey) e
 	if err != nil {
 		return err
 	}
-	h := make(http.Header)
+	h := taskHeader(c)
 	h.Set("Content-Type", "application/json")
 	t := &taskqueue.Task{
 		Path:    path.Join(config.Prefix, "/task/survey", sid),
@@ -15,7 +15,9 @@
 package main
 
 import (
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -130,6 +132,7 @@ func (tr *tokenRefresher) Token() (*oauth2.Token, error) {
 // bearer must be formatted as "bearer <token>",
 // where <token> is either a Bearer or ID (JWT) token. The latter is preferred.
 // The func returns context c in case of an error, otherwise a new one minted with the user ID.
+// ID tokens also provide the user verified email and hosted domain, see contextEmail.
 func authUser(c context.Context, bearer string) (context.Context, error) {
 	if bearer == "" {
 		return c, errAuthInvalid
@@ -138,46 +141,104 @@ func authUser(c context.Context, bearer string) (context.Context, error) {
 		return c, errAuthMissing
 	}
 	bearer = bearer[bearerHeaderLen:]
-	userID, err := verifyIDToken(c, bearer)
-	if err != nil {
-		userID, err = verifyBearerToken(c, bearer)
+	if claims, err := verifyIDTokenClaims(c, bearer); err == nil {
+		c = context.WithValue(c, ctxKeyUser, claims.sub)
+		c = context.WithValue(c, ctxKeyEmail, claims.email)
+		return context.WithValue(c, ctxKeyHostedDomain, claims.hd), nil
 	}
+	userID, err := verifyBearerToken(c, bearer)
 	if err != nil {
 		return c, errAuthInvalid
 	}
 	return context.WithValue(c, ctxKeyUser, userID), nil
 }
 
+const (
+	// bearerRejectedTTL is how long a rejected Bearer token is cached.
+	bearerRejectedTTL = 30 * time.Second
+	// bearerRejected is the cached value of rejected Bearer tokens.
+	bearerRejected = "-"
+)
+
+// bearerFlight dedupes concurrent verifications of the same Bearer token.
+var bearerFlight = &flightGroup{}
+
 // verifyBearerToken verifies the standard OAuth 2.0 Bearer token.
 // It returns user ID of the principal who granted an authorization.
+//
+// Results are cached under a hash of t: valid tokens until they expire,
+// and rejected ones for bearerRejectedTTL. Concurrent calls with the same t
+// share a single request to config.Google.VerifyURL.
 func verifyBearerToken(c context.Context, t string) (string, error) {
+	h := sha256.Sum256([]byte(t))
+	key := "tokeninfo:" + hex.EncodeToString(h[:])
+	if b, err := cache.get(c, key); err == nil {
+		if string(b) == bearerRejected {
+			return "", errors.New("verifyBearerToken: rejected token (cached)")
+		}
+		return string(b), nil
+	}
+
+	uid, err := bearerFlight.do(key, func() (interface{}, error) {
+		uid, ttl, err := fetchTokenInfo(c, t)
+		v := uid
+		if err != nil {
+			v = bearerRejected
+		}
+		if ttl > 0 {
+			if err := cache.set(c, key, []byte(v), ttl); err != nil {
+				errorf(c, "verifyBearerToken: cache.set: %v", err)
+			}
+		}
+		return uid, err
+	})
+	if err != nil {
+		return "", err
+	}
+	return uid.(string), nil
+}
+
+// fetchTokenInfo verifies Bearer token t with config.Google.VerifyURL.
+// It returns user ID of the principal who granted an authorization
+// and how long the result can be cached.
+// Errors of rejected tokens have non-zero duration too, unlike transient ones.
+func fetchTokenInfo(c context.Context, t string) (string, time.Duration, error) {
 	p := url.Values{"access_token": {t}}
 	hc := httpClient(c)
-	// TODO: figure out the rate limit to tokeninfo and bump it up if needed.
 	res, err := hc.PostForm(config.Google.VerifyURL, p)
 	if err != nil {
-		return "", err
-	}
-	if res.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("verifyBearerToken (%q): remote says: %s", t, res.Status)
+		return "", 0, err
 	}
 	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		// verify the token info below
+	case http.StatusBadRequest, http.StatusUnauthorized:
+		// invalid or expired token
+		return "", bearerRejectedTTL, fmt.Errorf("verifyBearerToken: remote says: %s", res.Status)
+	default:
+		// e.g. 429 Too Many Requests or 5xx, the token may still be valid
+		return "", 0, fmt.Errorf("verifyBearerToken: remote says: %s", res.Status)
+	}
 	var body struct {
 		ClientID string `json:"issued_to"`
 		UserID   string `json:"user_id"`
 		Expiry   int    `json:"expires_in"`
 	}
 	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
-		return "", err
+		return "", 0, err
 	}
 	if body.ClientID != config.Google.Auth.Client {
-		return "", fmt.Errorf("verifyBearerToken: issued_to %q; want %q",
+		return "", bearerRejectedTTL, fmt.Errorf("verifyBearerToken: issued_to %q; want %q",
 			body.ClientID, config.Google.Auth.Client)
 	}
 	if body.Expiry <= 0 {
-		return "", errors.New("verifyBearerToken: expired token")
+		return "", bearerRejectedTTL, errors.New("verifyBearerToken: expired token")
+	}
+	if body.UserID == "" {
+		return "", bearerRejectedTTL, errors.New("verifyBearerToken: no user_id")
 	}
-	return body.UserID, nil
+	return body.UserID, time.Duration(body.Expiry) * time.Second, nil
 }
 
 // fetchCredentials exchanges one-time authorization code for access and refresh tokens.
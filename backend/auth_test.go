@@ -19,6 +19,8 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -61,7 +63,9 @@ func TestVerifyBearerToken(t *testing.T) {
 		config.Google.VerifyURL = ts.URL
 
 		r := newTestRequest(t, "GET", "/", nil)
-		uid, err := verifyBearerToken(newContext(r), token)
+		c := newContext(r)
+		cache.flush(c)
+		uid, err := verifyBearerToken(c, token)
 
 		switch {
 		case test.success && err != nil:
@@ -74,8 +78,75 @@ func TestVerifyBearerToken(t *testing.T) {
 	}
 }
 
+func TestVerifyBearerTokenCache(t *testing.T) {
+	defer resetTestState(t)
+	defer preserveConfig()()
+
+	var (
+		mu    sync.Mutex
+		calls = make(map[string]int)
+	)
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tok := r.FormValue("access_token")
+		mu.Lock()
+		calls[tok]++
+		mu.Unlock()
+		<-release
+		switch tok {
+		case "valid":
+			fmt.Fprintf(w, `{"issued_to": %q, "user_id": "uid-1", "expires_in": 3600}`, testClientID)
+		case "flaky":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "throttled":
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer ts.Close()
+	config.Google.VerifyURL = ts.URL
+
+	c := newContext(newTestRequest(t, "GET", "/", nil))
+	cache.flush(c)
+	var wg sync.WaitGroup
+	for _, tok := range []string{"valid", "valid", "valid", "invalid", "invalid", "flaky", "throttled"} {
+		wg.Add(1)
+		go func(tok string) {
+			defer wg.Done()
+			verifyBearerToken(c, tok)
+		}(tok)
+	}
+	// let all concurrent calls join the in-flight ones
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	table := []struct {
+		token   string
+		success bool
+		calls   int
+	}{
+		{"valid", true, 1},
+		{"invalid", false, 1},
+		{"flaky", false, 2},
+		{"throttled", false, 2},
+	}
+	for _, test := range table {
+		uid, err := verifyBearerToken(c, test.token)
+		if (err == nil) != test.success {
+			t.Errorf("verifyBearerToken(%q) = %q, %v; want success = %v", test.token, uid, err, test.success)
+		}
+		mu.Lock()
+		n := calls[test.token]
+		mu.Unlock()
+		if n != test.calls {
+			t.Errorf("%s: %d upstream calls; want %d", test.token, n, test.calls)
+		}
+	}
+}
+
 func TestVerifyIDToken(t *testing.T) {
-	// TODO: test for invalid claims, e.g. iss, aud, azp, exp.
 	defer resetTestState(t)
 	defer preserveConfig()()
 	const certID = "test-cert"
@@ -86,6 +157,7 @@ func TestVerifyIDToken(t *testing.T) {
 	token.Claims = map[string]interface{}{
 		"iss": "accounts.google.com",
 		"exp": time.Now().Add(2 * time.Hour).Unix(),
+		"iat": time.Now().Unix(),
 		"aud": testClientID,
 		"azp": testClientID,
 		"sub": testUserID,
@@ -124,6 +196,125 @@ func TestVerifyIDToken(t *testing.T) {
 	}
 }
 
+func TestVerifyIDTokenClaims(t *testing.T) {
+	defer preserveConfig()()
+	const androidClientID = "android-client"
+	config.Google.Auth.Audiences = []string{androidClientID}
+	config.Google.Auth.clockSkew = 5 * time.Minute
+
+	now := time.Now()
+	table := []struct {
+		claims map[string]interface{}
+		ok     bool
+	}{
+		{nil, true},
+		{map[string]interface{}{"iss": "https://accounts.google.com"}, true},
+		{map[string]interface{}{"iss": "example.org"}, false},
+		{map[string]interface{}{"iss": nil}, false},
+		{map[string]interface{}{"aud": androidClientID, "azp": testClientID}, true},
+		{map[string]interface{}{"aud": "other-client"}, false},
+		{map[string]interface{}{"aud": nil}, false},
+		{map[string]interface{}{"azp": "other-client"}, false},
+		{map[string]interface{}{"aud": []string{testClientID, androidClientID}, "azp": testClientID}, true},
+		{map[string]interface{}{"aud": []string{testClientID, "other-client"}, "azp": testClientID}, false},
+		{map[string]interface{}{"aud": []string{testClientID}}, false},
+		{map[string]interface{}{"exp": now.Add(-time.Minute).Unix()}, true},
+		{map[string]interface{}{"exp": now.Add(-time.Hour).Unix()}, false},
+		{map[string]interface{}{"exp": nil}, false},
+		{map[string]interface{}{"iat": now.Add(time.Minute).Unix()}, true},
+		{map[string]interface{}{"iat": now.Add(time.Hour).Unix()}, false},
+		{map[string]interface{}{"iat": nil}, false},
+		{map[string]interface{}{"nbf": now.Add(time.Minute).Unix()}, true},
+		{map[string]interface{}{"nbf": now.Add(time.Hour).Unix()}, false},
+		{map[string]interface{}{"sub": ""}, false},
+	}
+	for i, test := range table {
+		token := signTestIDToken(t, test.claims)
+		r := newTestRequest(t, "GET", "/", nil)
+		res, err := verifyIDTokenClaims(newContext(r), token)
+		if (err == nil) != test.ok {
+			t.Errorf("%d: err = %v; want ok = %v", i, err, test.ok)
+		}
+		if err == nil && res.sub != testUserID {
+			t.Errorf("%d: sub = %q; want %q", i, res.sub, testUserID)
+		}
+	}
+}
+
+func TestVerifyIDTokenEmail(t *testing.T) {
+	table := []struct {
+		claims    map[string]interface{}
+		email, hd string
+	}{
+		{nil, "", ""},
+		{map[string]interface{}{"email": "dude@example.org", "email_verified": true, "hd": "example.org"}, "dude@example.org", "example.org"},
+		{map[string]interface{}{"email": "dude@example.org", "email_verified": "true"}, "dude@example.org", ""},
+		{map[string]interface{}{"email": "dude@example.org", "email_verified": false}, "", ""},
+		{map[string]interface{}{"email": "dude@example.org"}, "", ""},
+	}
+	for i, test := range table {
+		token := signTestIDToken(t, test.claims)
+		r := newTestRequest(t, "GET", "/", nil)
+		c, err := authUser(newContext(r), bearerHeader+token)
+		if err != nil {
+			t.Errorf("%d: authUser: %v", i, err)
+			continue
+		}
+		if v := contextUser(c); v != testUserID {
+			t.Errorf("%d: contextUser = %q; want %q", i, v, testUserID)
+		}
+		if v := contextEmail(c); v != test.email {
+			t.Errorf("%d: contextEmail = %q; want %q", i, v, test.email)
+		}
+		if v := contextHostedDomain(c); v != test.hd {
+			t.Errorf("%d: contextHostedDomain = %q; want %q", i, v, test.hd)
+		}
+	}
+}
+
+func TestIDTokenKeyCache(t *testing.T) {
+	defer preserveConfig()()
+	var hits int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"%s": %q}`, testJWSCertID, testJWSCert)
+	}))
+	defer ts.Close()
+	config.Google.CertURL = ts.URL
+
+	r := newTestRequest(t, "GET", "/", nil)
+	c := newContext(r)
+	cache.flush(c)
+	for i := 0; i < 3; i++ {
+		if _, err := verifyIDToken(c, testIDToken); err != nil {
+			t.Fatalf("%d: verifyIDToken: %v", i, err)
+		}
+	}
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Errorf("hits = %d; want 1", n)
+	}
+
+	// unknown keys result in a refetch, at most once per idTokenRefetchDelay
+	if _, err := idTokenKey(c, "unknown"); err == nil {
+		t.Errorf("idTokenKey(unknown): want error")
+	}
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Errorf("hits = %d; want 1", n)
+	}
+	idTokenKeys.Lock()
+	idTokenKeys.fetched = time.Now().Add(-idTokenRefetchDelay - time.Second)
+	idTokenKeys.Unlock()
+	for i := 0; i < 2; i++ {
+		if _, err := idTokenKey(c, "unknown"); err == nil {
+			t.Errorf("%d: idTokenKey(unknown): want error", i)
+		}
+	}
+	if n := atomic.LoadInt32(&hits); n != 2 {
+		t.Errorf("hits = %d; want 2", n)
+	}
+}
+
 func TestAuthUser(t *testing.T) {
 	defer preserveConfig()()
 	table := []struct {
@@ -15,6 +15,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -32,6 +33,9 @@ var (
 
 	// TODO: rename this to errNotFound and move to errors.go
 	errCacheMiss = errors.New("cache: miss")
+	// errNotStored is returned by cacheInterface.add if the key is already present,
+	// and by cacheInterface.cas if the data has changed.
+	errNotStored = errors.New("cache: not stored")
 )
 
 // cacheIterface unifies different types of caches,
@@ -39,10 +43,18 @@ var (
 type cacheInterface interface {
 	// set puts data bytes into the cache under key for the duration of the exp.
 	set(c context.Context, key string, data []byte, exp time.Duration) error
+	// add is the same as set but only if key is not already in the cache.
+	// It returns errNotStored otherwise.
+	add(c context.Context, key string, data []byte, exp time.Duration) error
+	// cas atomically replaces data under key, only if it still is old.
+	// A nil old means the key must not be in the cache.
+	// It returns errNotStored if the data has changed since it was read as old.
+	cas(c context.Context, key string, old, data []byte, exp time.Duration) error
 	// inc atomically increments the decimal value in the given key by delta
 	// and returns the new value. The value must fit in a uint64. Overflow wraps around,
-	// and underflow is capped to zero
-	inc(c context.Context, key string, delta int64, initialValue uint64) (uint64, error)
+	// and underflow is capped to zero.
+	// A missing key is created with initialValue, expiring after exp, or never if exp is zero.
+	inc(c context.Context, key string, delta int64, initialValue uint64, exp time.Duration) (uint64, error)
 	// get gets data from the cache put under key.
 	// it returns errCacheMiss if item is not in the cache or expired.
 	get(c context.Context, key string) ([]byte, error)
@@ -52,10 +64,15 @@ type cacheInterface interface {
 	flush(c context.Context) error
 }
 
+// memoryCacheSweep is the min interval between removals of expired memoryCache items.
+const memoryCacheSweep = time.Minute
+
 // memoryCache is a very simple in-memory cache.
 type memoryCache struct {
 	sync.Mutex
 	items map[string]*cacheItem
+	// next time expired items are removed
+	sweepAt time.Time
 }
 
 // newMemoryCache creates a new memoryCache instance.
@@ -72,16 +89,55 @@ type cacheItem struct {
 func (mc *memoryCache) set(c context.Context, key string, data []byte, exp time.Duration) error {
 	mc.Lock()
 	defer mc.Unlock()
-	mc.items[key] = &cacheItem{data, time.Now().Add(exp)}
+	now := time.Now()
+	mc.sweep(now)
+	mc.items[key] = &cacheItem{data, now.Add(exp)}
+	return nil
+}
+
+func (mc *memoryCache) add(c context.Context, key string, data []byte, exp time.Duration) error {
+	mc.Lock()
+	defer mc.Unlock()
+	now := time.Now()
+	mc.sweep(now)
+	if item, ok := mc.items[key]; ok && (item.exp.IsZero() || !now.After(item.exp)) {
+		return errNotStored
+	}
+	mc.items[key] = &cacheItem{data, now.Add(exp)}
+	return nil
+}
+
+func (mc *memoryCache) cas(c context.Context, key string, old, data []byte, exp time.Duration) error {
+	mc.Lock()
+	defer mc.Unlock()
+	now := time.Now()
+	mc.sweep(now)
+	item, ok := mc.items[key]
+	if ok && !item.exp.IsZero() && now.After(item.exp) {
+		ok = false
+	}
+	if ok != (old != nil) || (ok && !bytes.Equal(item.data, old)) {
+		return errNotStored
+	}
+	mc.items[key] = &cacheItem{data, now.Add(exp)}
 	return nil
 }
 
-func (mc *memoryCache) inc(c context.Context, key string, delta int64, initialValue uint64) (uint64, error) {
+func (mc *memoryCache) inc(c context.Context, key string, delta int64, initialValue uint64, exp time.Duration) (uint64, error) {
 	mc.Lock()
 	defer mc.Unlock()
+	now := time.Now()
+	mc.sweep(now)
 	item, ok := mc.items[key]
+	if ok && !item.exp.IsZero() && now.After(item.exp) {
+		ok = false
+	}
 	if !ok {
+		// zero time means the item never expires
 		var z time.Time
+		if exp > 0 {
+			z = now.Add(exp)
+		}
 		b := make([]byte, binary.Size(initialValue))
 		binary.PutUvarint(b, initialValue)
 		item = &cacheItem{b, z}
@@ -92,10 +148,10 @@ func (mc *memoryCache) inc(c context.Context, key string, delta int64, initialVa
 		return 0, fmt.Errorf("inc: binary.Uvarint error: %d", n)
 	}
 	switch {
-	case delta < 0 && v < uint64(delta):
+	case delta < 0 && v < uint64(-delta):
 		v = 0
 	case delta < 0:
-		v -= uint64(delta)
+		v -= uint64(-delta)
 	case delta > 0:
 		v += uint64(delta)
 	}
@@ -103,14 +159,30 @@ func (mc *memoryCache) inc(c context.Context, key string, delta int64, initialVa
 	return v, nil
 }
 
+// sweep removes expired items, no more often than memoryCacheSweep.
+// Items which never expire are kept. The caller must hold the lock.
+func (mc *memoryCache) sweep(now time.Time) {
+	if now.Before(mc.sweepAt) {
+		return
+	}
+	for k, item := range mc.items {
+		if !item.exp.IsZero() && now.After(item.exp) {
+			delete(mc.items, k)
+		}
+	}
+	mc.sweepAt = now.Add(memoryCacheSweep)
+}
+
 func (mc *memoryCache) get(c context.Context, key string) ([]byte, error) {
 	mc.Lock()
 	defer mc.Unlock()
 	item, ok := mc.items[key]
 	if !ok || time.Now().After(item.exp) {
 		delete(mc.items, key)
+		cacheGets.inc("miss")
 		return nil, errCacheMiss
 	}
+	cacheGets.inc("hit")
 	return item.data, nil
 }
 
@@ -133,3 +205,45 @@ func (mc *memoryCache) flush(c context.Context) error {
 	mc.items = make(map[string]*cacheItem)
 	return nil
 }
+
+// flightGroup dedupes concurrent calls of a function with the same key,
+// so that only one of them is in flight at a time.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+// flightCall is an in-flight or completed flightGroup.do call.
+type flightCall struct {
+	wg  sync.WaitGroup
+	val interface{}
+	err error
+}
+
+// do calls fn and returns its results, unless there's a call with the same key
+// already in flight. In the latter case, it waits for that call
+// and returns the same results.
+func (g *flightGroup) do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if fc, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		fc.wg.Wait()
+		return fc.val, fc.err
+	}
+	fc := &flightCall{}
+	fc.wg.Add(1)
+	g.calls[key] = fc
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		fc.wg.Done()
+	}()
+	fc.val, fc.err = fn()
+	return fc.val, fc.err
+}
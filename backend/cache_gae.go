@@ -17,6 +17,8 @@
 package main
 
 import (
+	"bytes"
+	"strconv"
 	"time"
 
 	"golang.org/x/net/context"
@@ -35,17 +37,69 @@ func (mc *gaeMemcache) set(c context.Context, key string, data []byte, exp time.
 	return memcache.Set(c, item)
 }
 
-func (mc *gaeMemcache) inc(c context.Context, key string, delta int64, initial uint64) (uint64, error) {
-	return memcache.Increment(c, key, delta, initial)
+func (mc *gaeMemcache) add(c context.Context, key string, data []byte, exp time.Duration) error {
+	item := &memcache.Item{
+		Key:        key,
+		Value:      data,
+		Expiration: exp,
+	}
+	if err := memcache.Add(c, item); err == memcache.ErrNotStored {
+		return errNotStored
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (mc *gaeMemcache) cas(c context.Context, key string, old, data []byte, exp time.Duration) error {
+	if old == nil {
+		return mc.add(c, key, data, exp)
+	}
+	item, err := memcache.Get(c, key)
+	if err == memcache.ErrCacheMiss {
+		return errNotStored
+	}
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(item.Value, old) {
+		return errNotStored
+	}
+	item.Value = data
+	item.Expiration = exp
+	err = memcache.CompareAndSwap(c, item)
+	if err == memcache.ErrCASConflict || err == memcache.ErrNotStored {
+		return errNotStored
+	}
+	return err
+}
+
+func (mc *gaeMemcache) inc(c context.Context, key string, delta int64, initial uint64, exp time.Duration) (uint64, error) {
+	if exp == 0 {
+		return memcache.Increment(c, key, delta, initial)
+	}
+	// memcache.Increment can't set expiration of new items
+	item := &memcache.Item{
+		Key:        key,
+		Value:      []byte(strconv.FormatUint(initial, 10)),
+		Expiration: exp,
+	}
+	if err := memcache.Add(c, item); err != nil && err != memcache.ErrNotStored {
+		return 0, err
+	}
+	return memcache.IncrementExisting(c, key, delta)
 }
 
 func (mc *gaeMemcache) get(c context.Context, key string) ([]byte, error) {
 	item, err := memcache.Get(c, key)
 	if err == memcache.ErrCacheMiss {
+		cacheGets.inc("miss")
 		return nil, errCacheMiss
 	} else if err != nil {
+		cacheGets.inc("error")
 		return nil, err
 	}
+	cacheGets.inc("hit")
 	return item.Value, nil
 }
 
@@ -15,6 +15,7 @@
 package main
 
 import (
+	"sync"
 	"testing"
 	"time"
 
@@ -72,11 +73,11 @@ func TestMemoryCacheInc(t *testing.T) {
 		initVal uint64
 		res     uint64
 	}{
-		{3, 1, 4}, {1, 0, 5}, {-5, 0, 0}, {10, 0, 10}, {-100, 0, 0},
+		{3, 1, 4}, {1, 0, 5}, {-5, 0, 0}, {10, 0, 10}, {-1, 0, 9}, {-100, 0, 0},
 	}
 
 	for i, test := range table {
-		v, err := mc.inc(c, "test", test.delta, test.initVal)
+		v, err := mc.inc(c, "test", test.delta, test.initVal, 0)
 		if err != nil {
 			t.Fatalf("%d: inc(%d, %d)", i, test.delta, test.initVal)
 		}
@@ -86,6 +87,77 @@ func TestMemoryCacheInc(t *testing.T) {
 	}
 }
 
+func TestMemoryCacheIncExpiration(t *testing.T) {
+	mc := newMemoryCache().(*memoryCache)
+	c := context.Background()
+	if _, err := mc.inc(c, "exp", 5, 0, time.Millisecond); err != nil {
+		t.Fatalf("mc.inc(exp): %v", err)
+	}
+	if _, err := mc.inc(c, "noexp", 5, 0, 0); err != nil {
+		t.Fatalf("mc.inc(noexp): %v", err)
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	// expired items start over
+	v, err := mc.inc(c, "exp", 1, 0, time.Millisecond)
+	if err != nil || v != 1 {
+		t.Errorf("mc.inc(exp) = %d, %v; want 1", v, err)
+	}
+	time.Sleep(2 * time.Millisecond)
+
+	// and are removed by sweep
+	mc.sweepAt = time.Time{}
+	mc.set(c, "other", []byte("data"), time.Hour)
+	if _, ok := mc.items["exp"]; ok {
+		t.Errorf("mc.items[exp] is not removed")
+	}
+	if _, ok := mc.items["noexp"]; !ok {
+		t.Errorf("mc.items[noexp] is removed")
+	}
+}
+
+func TestMemoryCacheAdd(t *testing.T) {
+	mc := newMemoryCache()
+	c := context.Background()
+	if err := mc.add(c, "key", []byte("one"), time.Millisecond); err != nil {
+		t.Fatalf("mc.add(one): %v", err)
+	}
+	if err := mc.add(c, "key", []byte("two"), time.Hour); err != errNotStored {
+		t.Errorf("mc.add(two): %v; want errNotStored", err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	// expired items can be replaced
+	if err := mc.add(c, "key", []byte("three"), time.Hour); err != nil {
+		t.Fatalf("mc.add(three): %v", err)
+	}
+	if b, err := mc.get(c, "key"); err != nil || string(b) != "three" {
+		t.Errorf("mc.get = %q, %v; want three", b, err)
+	}
+}
+
+func TestMemoryCacheCAS(t *testing.T) {
+	mc := newMemoryCache()
+	c := context.Background()
+	if err := mc.cas(c, "key", []byte("none"), []byte("one"), time.Hour); err != errNotStored {
+		t.Errorf("mc.cas(missing): %v; want errNotStored", err)
+	}
+	if err := mc.cas(c, "key", nil, []byte("one"), time.Hour); err != nil {
+		t.Fatalf("mc.cas(nil, one): %v", err)
+	}
+	if err := mc.cas(c, "key", nil, []byte("two"), time.Hour); err != errNotStored {
+		t.Errorf("mc.cas(nil, two): %v; want errNotStored", err)
+	}
+	if err := mc.cas(c, "key", []byte("other"), []byte("two"), time.Hour); err != errNotStored {
+		t.Errorf("mc.cas(other, two): %v; want errNotStored", err)
+	}
+	if err := mc.cas(c, "key", []byte("one"), []byte("two"), time.Hour); err != nil {
+		t.Fatalf("mc.cas(one, two): %v", err)
+	}
+	if b, err := mc.get(c, "key"); err != nil || string(b) != "two" {
+		t.Errorf("mc.get = %q, %v; want two", b, err)
+	}
+}
+
 func TestMemoryCacheFlush(t *testing.T) {
 	mc := newMemoryCache()
 	c := context.Background()
@@ -99,3 +171,46 @@ func TestMemoryCacheFlush(t *testing.T) {
 		t.Errorf("mc.get: %v; want errCacheMiss", err)
 	}
 }
+
+func TestFlightGroup(t *testing.T) {
+	g := &flightGroup{}
+	var (
+		mu    sync.Mutex
+		calls int
+	)
+	release := make(chan struct{})
+	fn := func() (interface{}, error) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		<-release
+		return "result", nil
+	}
+
+	const n = 5
+	results := make(chan interface{}, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			v, _ := g.do("key", fn)
+			results <- v
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	for i := 0; i < n; i++ {
+		if v := <-results; v != "result" {
+			t.Errorf("%d: v = %v; want result", i, v)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("calls = %d; want 1", calls)
+	}
+
+	// completed calls are not reused
+	if _, err := g.do("key", fn); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("calls = %d; want 2", calls)
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var (
+	// encoders are the supported response content encodings.
+	// Only gzip is supported: brotli is out of scope, since there's no encoder
+	// in the standard library and the repo vendors no third-party one.
+	encoders = map[string]func(io.Writer) io.WriteCloser{
+		"gzip": func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+	}
+	// encodingPrefs is the server preference order of encodings
+	// when a client accepts more than one with the same quality.
+	encodingPrefs = []string{"gzip"}
+
+	// compressTypes are content type prefixes of responses worth compressing.
+	compressTypes = []string{
+		"application/json",
+		"application/javascript",
+		"application/xml",
+		"text/html",
+		"text/css",
+		"text/plain",
+		"text/xml",
+	}
+)
+
+// acceptedEncoding returns the best of the supported content encodings
+// accepted by the client of request r, or an empty string if none.
+func acceptedEncoding(r *http.Request) string {
+	h := r.Header.Get("accept-encoding")
+	if h == "" {
+		return ""
+	}
+	q := make(map[string]float64)
+	for _, part := range strings.Split(h, ",") {
+		f := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(f[0]))
+		v := 1.0
+		for _, p := range f[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if n, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					v = n
+				}
+			}
+		}
+		q[name] = v
+	}
+	best, bestq := "", 0.0
+	for _, enc := range encodingPrefs {
+		if _, ok := encoders[enc]; !ok {
+			continue
+		}
+		v, ok := q[enc]
+		if !ok {
+			v, ok = q["*"]
+		}
+		if ok && v > bestq {
+			best, bestq = enc, v
+		}
+	}
+	return best
+}
+
+// compress returns b encoded with enc, which must be one of the encoders.
+func compress(enc string, b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := encoders[enc](&buf)
+	if _, err := zw.Write(b); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// compressHandler compresses responses of h with an encoding accepted by the client.
+// Only text-like content types are compressed. Responses with Content-Encoding
+// already set, e.g. precompressed, are written as is.
+func compressHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		enc := acceptedEncoding(r)
+		if enc == "" || r.Method == "HEAD" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressResponseWriter{ResponseWriter: w, enc: enc}
+		defer cw.close()
+		h.ServeHTTP(cw, r)
+	})
+}
+
+// compressResponseWriter encodes the response body if it is worth compressing,
+// which is decided when the response header is written.
+type compressResponseWriter struct {
+	http.ResponseWriter
+	enc         string
+	zw          io.WriteCloser
+	wroteHeader bool
+}
+
+func (w *compressResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	h := w.Header()
+	h.Add("Vary", "Accept-Encoding")
+	if w.shouldCompress(code) {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", w.enc)
+		w.zw = encoders[w.enc](w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *compressResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.zw == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.zw.Write(b)
+}
+
+// Flush flushes compressed data written so far to the client.
+func (w *compressResponseWriter) Flush() {
+	if f, ok := w.zw.(interface {
+		Flush() error
+	}); ok {
+		f.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// CloseNotify implements http.CloseNotifier if the underlying writer does,
+// otherwise the returned channel never receives a value.
+func (w *compressResponseWriter) CloseNotify() <-chan bool {
+	if cn, ok := w.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(chan bool)
+}
+
+// close finishes the compressed stream, if any.
+func (w *compressResponseWriter) close() error {
+	if w.zw == nil {
+		return nil
+	}
+	return w.zw.Close()
+}
+
+// shouldCompress reports whether a response with status code
+// and the current header is worth compressing.
+func (w *compressResponseWriter) shouldCompress(code int) bool {
+	if code < 200 || code == http.StatusNoContent || code == http.StatusNotModified ||
+		code == http.StatusPartialContent {
+		return false
+	}
+	h := w.Header()
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" {
+		return false
+	}
+	ctype := h.Get("Content-Type")
+	for _, t := range compressTypes {
+		if strings.HasPrefix(ctype, t) {
+			return true
+		}
+	}
+	return false
+}
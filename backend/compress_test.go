@@ -0,0 +1,102 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAcceptedEncoding(t *testing.T) {
+	table := []struct{ header, enc string }{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate", "gzip"},
+		{"deflate, GZIP;q=0.5", "gzip"},
+		{"gzip;q=0", ""},
+		{"*", "gzip"},
+		{"*;q=0.1, gzip;q=0", ""},
+		{"identity", ""},
+		{"br", ""},
+		{"br, gzip", "gzip"},
+	}
+	for i, test := range table {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Header.Set("accept-encoding", test.header)
+		if enc := acceptedEncoding(r); enc != test.enc {
+			t.Errorf("%d: acceptedEncoding(%q) = %q; want %q", i, test.header, enc, test.enc)
+		}
+	}
+}
+
+func TestCompressHandler(t *testing.T) {
+	const body = `{"hello": "world"}`
+	table := []struct {
+		ctype, cenc string
+		code        int
+		compressed  bool
+	}{
+		{"application/json;charset=utf-8", "", http.StatusOK, true},
+		{"text/html;charset=utf-8", "", http.StatusNotFound, true},
+		{"image/png", "", http.StatusOK, false},
+		{"text/event-stream", "", http.StatusOK, false},
+		{"application/json", "gzip", http.StatusOK, false},
+	}
+	for i, test := range table {
+		h := compressHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", test.ctype)
+			if test.cenc != "" {
+				w.Header().Set("Content-Encoding", test.cenc)
+			}
+			w.WriteHeader(test.code)
+			w.Write([]byte(body))
+		}))
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Header.Set("accept-encoding", "gzip")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != test.code {
+			t.Errorf("%d: w.Code = %d; want %d", i, w.Code, test.code)
+		}
+		if v := w.Header().Get("vary"); v != "Accept-Encoding" {
+			t.Errorf("%d: vary = %q; want Accept-Encoding", i, v)
+		}
+		if !test.compressed {
+			if w.Body.String() != body {
+				t.Errorf("%d: w.Body = %q; want %q", i, w.Body.String(), body)
+			}
+			continue
+		}
+		if v := w.Header().Get("content-encoding"); v != "gzip" {
+			t.Errorf("%d: content-encoding = %q; want gzip", i, v)
+		}
+		zr, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Errorf("%d: %v", i, err)
+			continue
+		}
+		b, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Errorf("%d: %v", i, err)
+		}
+		if string(b) != body {
+			t.Errorf("%d: body = %q; want %q", i, b, body)
+		}
+	}
+}
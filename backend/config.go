@@ -16,6 +16,9 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
 	"os"
 	"sort"
 	"strings"
@@ -59,6 +62,18 @@ type appConfig struct {
 	Addr string `json:"addr"`
 	// HTTP prefix
 	Prefix string `json:"prefix"`
+	// Canonical site URL with scheme and host only, e.g. "https://events.google.com".
+	// If set, it is used in canonical links and sitemap instead of request values.
+	BaseURL string `json:"baseUrl"`
+	baseURL *url.URL
+	// IP addresses or CIDR ranges of reverse proxies whose Forwarded
+	// and X-Forwarded-* headers are trusted, see forwardedClient.
+	TrustedProxies []string `json:"trustedProxies"`
+	trustedProxies []*net.IPNet
+	// Min level of logged messages: debug, info or error.
+	// Defaults to info.
+	LogLevel string `json:"logLevel"`
+	logLevel logLevel
 
 	// User emails allowed in staging
 	Whitelist []string
@@ -69,10 +84,48 @@ type appConfig struct {
 	// Endpoint to ping external/extra parties about certain updates
 	// Currently it is only user schedule
 	ExtPingURL string `json:"extPingUrl"`
-	// used for SW tokens
+	// used for SW tokens, unless SWToken.Secrets are set
 	Secret string `json:"secret"`
+	// SW tokens settings
+	SWToken struct {
+		// HMAC secrets by key ID. The one under Kid is used to sign
+		// new tokens while all of them are accepted, which allows for
+		// a key rotation. Key IDs must not contain spaces.
+		Secrets map[string]string `json:"secrets"`
+		Kid     string            `json:"kid"`
+		// Max age of a token since it was first issued, e.g. "720h".
+		// Zero means tokens never expire.
+		MaxAge string `json:"maxAge"`
+
+		// parsed MaxAge
+		maxAge time.Duration
+	} `json:"swtoken"`
+	// Browser session cookies, see handleAuth
+	Session struct {
+		// HMAC secrets by key ID, as in SWToken.
+		// Sessions are disabled if there are none.
+		Secrets map[string]string `json:"secrets"`
+		Kid     string            `json:"kid"`
+		// Max age of a session, e.g. "168h". Defaults to 24h.
+		// Sessions used after half of it are renewed.
+		MaxAge string `json:"maxAge"`
+		// Max time since sign-in, after which sessions expire regardless
+		// of renewals, e.g. "720h". Defaults to 7 days.
+		Lifetime string `json:"lifetime"`
+
+		// parsed MaxAge
+		maxAge time.Duration
+		// parsed Lifetime
+		lifetime time.Duration
+	} `json:"session"`
+	// Cross-origin access policies by route family, i.e. a route pattern
+	// prefix such as "/api/v1/". The policy with the longest matching prefix
+	// applies. Routes without a policy are not accessible from other origins.
+	CORS map[string]*corsPolicy `json:"cors"`
 	// A shared secret to identify requests from GCS and gdrive
 	SyncToken string `json:"synct"`
+	// A shared secret of metrics scrapers in prod, see serveMetrics.
+	MetricsToken string `json:"metricst"`
 
 	// Twitter credentials
 	Twitter struct {
@@ -96,6 +149,12 @@ type appConfig struct {
 		Auth struct {
 			Client string `json:"client"`
 			Secret string `json:"secret"`
+			// Audiences are additional client IDs of ID tokens, e.g. of Android apps
+			Audiences []string `json:"audiences"`
+			// ClockSkew is the allowed clock skew of ID tokens exp, iat and nbf claims
+			ClockSkew string `json:"clockSkew"`
+			// parsed ClockSkew
+			clockSkew time.Duration
 		} `json:"auth"`
 		GCM struct {
 			Sender   string `json:"sender"`
@@ -117,6 +176,69 @@ type appConfig struct {
 		ManifestURL string `json:"manifest"`
 	} `json:"schedule"`
 
+	// Push notifications throttling
+	Push struct {
+		// Default quiet hours in "15:04" format and Schedule.Location,
+		// unless a user has their own, see userPush.Quiet.
+		QuietStart string `json:"quietStart"`
+		QuietEnd   string `json:"quietEnd"`
+		// Max number of pings a user receives within a window,
+		// e.g. "1h". Zero MaxPings means no limit.
+		MaxPings int    `json:"maxPings"`
+		Window   string `json:"window"`
+		// Pings closer to each other than coalesce duration
+		// are combined into one, e.g. "1m".
+		Coalesce string `json:"coalesce"`
+
+		// parsed Window and Coalesce
+		window, coalesce time.Duration
+	} `json:"push"`
+
+	// Readiness checks settings, see serveReadiness
+	Health struct {
+		// Max age of the latest event data, e.g. "24h", after which
+		// readiness checks report a warning, without failing.
+		// Zero means any age is fine.
+		MaxDataAge string `json:"maxDataAge"`
+
+		// parsed MaxDataAge
+		maxDataAge time.Duration
+	} `json:"health"`
+
+	// Standalone server settings
+	Server struct {
+		// Max duration of reading a request, including body,
+		// writing a response and waiting for the next request
+		// on a keep-alive connection, e.g. "30s". Zero means no timeout.
+		// Schedule streams are cut after WriteTimeout too; clients
+		// reconnect and resume from the last received event.
+		ReadTimeout  string `json:"readTimeout"`
+		WriteTimeout string `json:"writeTimeout"`
+		IdleTimeout  string `json:"idleTimeout"`
+		// Max duration of waiting for in-flight requests to finish
+		// on SIGTERM or SIGINT, e.g. "25s". Zero means no deadline.
+		ShutdownTimeout string `json:"shutdownTimeout"`
+
+		// TLS certificate chain and private key PEM file paths.
+		// The server listens for HTTPS on Addr if both are set.
+		TLSCert string `json:"tlsCert"`
+		TLSKey  string `json:"tlsKey"`
+		// Enable HTTP/2 over TLS.
+		HTTP2 bool `json:"http2"`
+		// Address of a plain HTTP listener which redirects all requests
+		// to HTTPS, e.g. ":80". Used only along with TLS.
+		RedirectAddr string `json:"redirectAddr"`
+		// Redirect plain HTTP requests to HTTPS, for when TLS is terminated
+		// by a proxy which sets X-Forwarded-Proto.
+		ForceHTTPS bool `json:"forceHttps"`
+		// Strict-Transport-Security max-age of HTTPS responses, e.g. "8760h".
+		// Zero means no HSTS header.
+		HSTS string `json:"hsts"`
+
+		// parsed durations
+		readTimeout, writeTimeout, idleTimeout, shutdownTimeout, hsts time.Duration
+	} `json:"server"`
+
 	// Feedback survey settings
 	Survey struct {
 		ID       string `json:"id"`
@@ -167,6 +289,108 @@ func initConfig(configPath, addr string) error {
 	if config.Schedule.Location, err = time.LoadLocation(config.Schedule.Timezone); err != nil {
 		return err
 	}
+	if config.Push.Window != "" {
+		if config.Push.window, err = time.ParseDuration(config.Push.Window); err != nil {
+			return err
+		}
+	}
+	if config.Push.Coalesce != "" {
+		if config.Push.coalesce, err = time.ParseDuration(config.Push.Coalesce); err != nil {
+			return err
+		}
+	}
+	if config.SWToken.MaxAge != "" {
+		if config.SWToken.maxAge, err = time.ParseDuration(config.SWToken.MaxAge); err != nil {
+			return err
+		}
+	}
+	if len(config.SWToken.Secrets) > 0 && config.SWToken.Secrets[config.SWToken.Kid] == "" {
+		return fmt.Errorf("initConfig: no SW token secret for key %q", config.SWToken.Kid)
+	}
+	config.Session.maxAge = 24 * time.Hour
+	if config.Session.MaxAge != "" {
+		if config.Session.maxAge, err = time.ParseDuration(config.Session.MaxAge); err != nil {
+			return err
+		}
+	}
+	config.Session.lifetime = 7 * 24 * time.Hour
+	if config.Session.Lifetime != "" {
+		if config.Session.lifetime, err = time.ParseDuration(config.Session.Lifetime); err != nil {
+			return err
+		}
+	}
+	if len(config.Session.Secrets) > 0 && config.Session.Secrets[config.Session.Kid] == "" {
+		return fmt.Errorf("initConfig: no session secret for key %q", config.Session.Kid)
+	}
+	config.Google.Auth.clockSkew = 5 * time.Minute
+	if config.Google.Auth.ClockSkew != "" {
+		if config.Google.Auth.clockSkew, err = time.ParseDuration(config.Google.Auth.ClockSkew); err != nil {
+			return err
+		}
+	}
+	if config.Health.MaxDataAge != "" {
+		if config.Health.maxDataAge, err = time.ParseDuration(config.Health.MaxDataAge); err != nil {
+			return err
+		}
+	}
+	for _, d := range []struct {
+		s string
+		v *time.Duration
+	}{
+		{config.Server.ReadTimeout, &config.Server.readTimeout},
+		{config.Server.WriteTimeout, &config.Server.writeTimeout},
+		{config.Server.IdleTimeout, &config.Server.idleTimeout},
+		{config.Server.ShutdownTimeout, &config.Server.shutdownTimeout},
+		{config.Server.HSTS, &config.Server.hsts},
+	} {
+		if d.s == "" {
+			continue
+		}
+		if *d.v, err = time.ParseDuration(d.s); err != nil {
+			return err
+		}
+	}
+	if config.BaseURL != "" {
+		u, err := url.Parse(config.BaseURL)
+		if err != nil {
+			return err
+		}
+		if u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+			return fmt.Errorf("initConfig: base URL %q must have only scheme and host", config.BaseURL)
+		}
+		config.baseURL = &url.URL{Scheme: u.Scheme, Host: u.Host}
+	}
+	config.trustedProxies = nil
+	for _, p := range config.TrustedProxies {
+		n, err := parseIPNet(p)
+		if err != nil {
+			return fmt.Errorf("initConfig: trusted proxy: %v", err)
+		}
+		config.trustedProxies = append(config.trustedProxies, n)
+	}
+	if (config.Server.TLSCert == "") != (config.Server.TLSKey == "") {
+		return fmt.Errorf("initConfig: server.tlsCert and server.tlsKey must be set together")
+	}
+	for prefix, p := range config.CORS {
+		for _, o := range p.Origins {
+			if o == "*" && p.Credentials {
+				return fmt.Errorf("initConfig: CORS %s: credentials with \"*\" origin", prefix)
+			}
+		}
+		if p.MaxAge == "" {
+			continue
+		}
+		if p.maxAge, err = time.ParseDuration(p.MaxAge); err != nil {
+			return err
+		}
+	}
+	if config.LogLevel != "" {
+		l, ok := logLevels[config.LogLevel]
+		if !ok {
+			return fmt.Errorf("initConfig: unknown log level %q", config.LogLevel)
+		}
+		config.logLevel = l
+	}
 	if addr != "" {
 		config.Addr = addr
 	}
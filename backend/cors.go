@@ -0,0 +1,110 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// corsPolicy defines cross-origin access to a family of routes.
+// See appConfig.CORS.
+type corsPolicy struct {
+	// Origins allowed to access the routes, e.g. "https://example.org",
+	// or "*" for any origin.
+	Origins []string `json:"origins"`
+	// Credentials allows requests with cookies and Authorization header.
+	// It can't be combined with "*" origin.
+	Credentials bool `json:"credentials"`
+	// How long preflight results can be cached, e.g. "10m".
+	MaxAge string `json:"maxAge"`
+
+	// parsed MaxAge
+	maxAge time.Duration
+}
+
+// corsPolicyFor returns the policy of a route family pattern belongs to,
+// i.e. the one with the longest prefix of pattern in config.CORS.
+// It returns nil if the route is not accessible from other origins.
+func corsPolicyFor(pattern string) *corsPolicy {
+	var (
+		policy *corsPolicy
+		n      = -1
+	)
+	for prefix, p := range config.CORS {
+		if len(prefix) > n && strings.HasPrefix(pattern, prefix) {
+			policy, n = p, len(prefix)
+		}
+	}
+	return policy
+}
+
+// allowOrigin returns the value of Access-Control-Allow-Origin header
+// for the request origin, or an empty string if the origin is not allowed.
+func (p *corsPolicy) allowOrigin(origin string) string {
+	for _, o := range p.Origins {
+		switch {
+		case o == "*":
+			return "*"
+		case o == origin:
+			return origin
+		}
+	}
+	return ""
+}
+
+// setCORSHeaders sets CORS response headers on w according to the policy
+// of a route with the given pattern. The allow is a list of methods
+// the route supports, used in responses to preflight requests.
+// It returns false if r is not a cross-origin request allowed by the policy.
+func setCORSHeaders(w http.ResponseWriter, r *http.Request, pattern, allow string) bool {
+	p := corsPolicyFor(pattern)
+	if p == nil {
+		return false
+	}
+	h := w.Header()
+	// responses differ by origin unless all are allowed,
+	// including same-origin ones without Origin header
+	if len(p.Origins) == 0 || p.Origins[0] != "*" {
+		h.Add("Vary", "Origin")
+	}
+	origin := r.Header.Get("origin")
+	if origin == "" {
+		return false
+	}
+	ao := p.allowOrigin(origin)
+	if ao == "" {
+		return false
+	}
+	h.Set("Access-Control-Allow-Origin", ao)
+	if p.Credentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	h.Set("Access-Control-Expose-Headers", "Etag, Delta-Base")
+	if r.Method != "OPTIONS" || r.Header.Get("access-control-request-method") == "" {
+		return true
+	}
+	// preflight
+	h.Set("Access-Control-Allow-Methods", allow)
+	if v := r.Header.Get("access-control-request-headers"); v != "" {
+		h.Set("Access-Control-Allow-Headers", v)
+	}
+	if p.maxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(p.maxAge/time.Second)))
+	}
+	return true
+}
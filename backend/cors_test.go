@@ -0,0 +1,76 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSetCORSHeaders(t *testing.T) {
+	defer preserveConfig()()
+	config.CORS = map[string]*corsPolicy{
+		"/api/v1/":         {Origins: []string{"https://partner.example.org"}, Credentials: true, maxAge: 10 * time.Minute},
+		"/api/v1/schedule": {Origins: []string{"*"}},
+	}
+
+	table := []struct {
+		method, pattern, origin string
+		ok                      bool
+		allowOrigin, creds      string
+		allowMethods, maxAge    string
+		vary                    string
+	}{
+		{"GET", "/api/v1/schedule", "https://any.example.com", true, "*", "", "", "", ""},
+		{"GET", "/api/v1/schedule", "", false, "", "", "", "", ""},
+		{"GET", "/api/v1/user/notify", "https://partner.example.org", true, "https://partner.example.org", "true", "", "", "Origin"},
+		{"GET", "/api/v1/user/notify", "https://evil.example.com", false, "", "", "", "", "Origin"},
+		// same-origin responses must not be cached for cross-origin requests
+		{"GET", "/api/v1/user/notify", "", false, "", "", "", "", "Origin"},
+		{"OPTIONS", "/api/v1/user/notify", "https://partner.example.org", true, "https://partner.example.org", "true", "GET, OPTIONS", "600", "Origin"},
+		{"GET", "/api/social", "https://any.example.com", false, "", "", "", "", ""},
+	}
+	for i, test := range table {
+		r := newTestRequest(t, test.method, test.pattern, nil)
+		if test.origin != "" {
+			r.Header.Set("origin", test.origin)
+		}
+		if test.method == "OPTIONS" {
+			r.Header.Set("access-control-request-method", "GET")
+		}
+		w := httptest.NewRecorder()
+		ok := setCORSHeaders(w, r, test.pattern, "GET, OPTIONS")
+		if ok != test.ok {
+			t.Errorf("%d: setCORSHeaders = %v; want %v", i, ok, test.ok)
+		}
+		h := w.Header()
+		if v := h.Get("access-control-allow-origin"); v != test.allowOrigin {
+			t.Errorf("%d: Access-Control-Allow-Origin = %q; want %q", i, v, test.allowOrigin)
+		}
+		if v := h.Get("access-control-allow-credentials"); v != test.creds {
+			t.Errorf("%d: Access-Control-Allow-Credentials = %q; want %q", i, v, test.creds)
+		}
+		if v := h.Get("access-control-allow-methods"); v != test.allowMethods {
+			t.Errorf("%d: Access-Control-Allow-Methods = %q; want %q", i, v, test.allowMethods)
+		}
+		if v := h.Get("access-control-max-age"); v != test.maxAge {
+			t.Errorf("%d: Access-Control-Max-Age = %q; want %q", i, v, test.maxAge)
+		}
+		if v := h.Get("vary"); v != test.vary {
+			t.Errorf("%d: Vary = %q; want %q", i, v, test.vary)
+		}
+	}
+}
@@ -19,12 +19,54 @@
 package main
 
 import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/net/context"
 )
 
+// maxMemChanges is the max number of dataChanges kept in memDB.
+const maxMemChanges = 1000
+
+// memDB keeps event data and its changes in memory until a persistent DB is implemented.
+// The data does not survive restarts: the first sync after a start fetches it anew.
+var memDB struct {
+	sync.Mutex
+	seq     int64           // last etag
+	events  []*memEventData // sorted by modified time
+	changes []*memChanges   // sorted by updated time
+	synced  time.Time       // last successful sync
+	// sessions revocation times, keyed by user ID
+	sessRevoked map[string]time.Time
+}
+
+// memEventData is a gob-encoded version of eventData stored in memDB.
+type memEventData struct {
+	etag     string
+	modified time.Time
+	data     []byte
+}
+
+// decode returns a new copy of eventData stored in ent.
+func (ent *memEventData) decode() (*eventData, error) {
+	d := &eventData{etag: ent.etag, modified: ent.modified}
+	return d, gob.NewDecoder(bytes.NewReader(ent.data)).Decode(d)
+}
+
+// memChanges is a JSON-encoded dataChanges stored in memDB.
+type memChanges struct {
+	updated time.Time
+	data    []byte
+}
+
 // RunInTransaction runs f in a transaction.
 // It calls f with a transaction context tc that f should use for all operations.
 func runInTransaction(c context.Context, f func(tc context.Context) error) error {
@@ -83,6 +125,18 @@ func listUsersWithPush(c context.Context) ([]string, error) {
 	return nil, errors.New("not implemented")
 }
 
+// countUsersWithPush returns the number of users with userPush.Enabled == true
+// and, unless prop is empty, the userPush datastore property prop set to true.
+func countUsersWithPush(c context.Context, prop string) (int, error) {
+	return 0, errors.New("not implemented")
+}
+
+// listUsersWithPushBatch returns at most limit user IDs with userPush.Enabled == true,
+// starting at cursor, and a cursor of the next batch.
+func listUsersWithPushBatch(c context.Context, cursor string, limit int) ([]string, string, error) {
+	return nil, "", errors.New("not implemented")
+}
+
 // storeLocalAppFolderMeta saves data.FileID and data.Etag in a local db under key of user uid.
 func storeLocalAppFolderMeta(c context.Context, uid string, data *appFolderData) error {
 	return errors.New("not implemented")
@@ -93,25 +147,128 @@ func getLocalAppFolderMeta(c context.Context, uid string) (*appFolderData, error
 	return nil, errors.New("not implemented")
 }
 
+// storeEventData saves d in memDB along with a new etag,
+// keeping at most eventDataHistory most recent versions.
+// Unexported fields other than d.modified are not stored.
 func storeEventData(c context.Context, d *eventData) error {
-	return errors.New("not implemented")
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(d); err != nil {
+		return fmt.Errorf("storeEventData: %v", err)
+	}
+	memDB.Lock()
+	defer memDB.Unlock()
+	memDB.seq++
+	ent := &memEventData{
+		etag:     strconv.FormatInt(memDB.seq, 16),
+		modified: d.modified,
+		data:     b.Bytes(),
+	}
+	// keep the versions sorted by modified time, same as datastore queries do
+	i := sort.Search(len(memDB.events), func(i int) bool {
+		return memDB.events[i].modified.After(d.modified)
+	})
+	memDB.events = append(memDB.events, nil)
+	copy(memDB.events[i+1:], memDB.events[i:])
+	memDB.events[i] = ent
+	if n := len(memDB.events); n > eventDataHistory {
+		memDB.events = memDB.events[n-eventDataHistory:]
+	}
+	return nil
 }
 
 // clearEventData deletes all EventData entities.
 func clearEventData(c context.Context) error {
-	return errors.New("not implemented")
+	if err := cache.flush(c); err != nil {
+		return err
+	}
+	memDB.Lock()
+	memDB.events = nil
+	memDB.Unlock()
+	return nil
 }
 
+// getLatestEventData fetches most recent version of eventData previously saved with storeEventData().
+//
+// etags adheres to rfc7232 semantics. If one of etags matches etag of the entity,
+// an empty eventData with only etag and modified fields set is returned
+// along with errNotModified error.
 func getLatestEventData(c context.Context, etags []string) (*eventData, error) {
-	return nil, errors.New("not implemented")
+	memDB.Lock()
+	var ent *memEventData
+	if n := len(memDB.events); n > 0 {
+		ent = memDB.events[n-1]
+	}
+	memDB.Unlock()
+	if ent == nil {
+		return &eventData{}, nil
+	}
+	for _, t := range etags {
+		if ent.etag == strings.Trim(t, `"`) {
+			return &eventData{etag: ent.etag, modified: ent.modified}, errNotModified
+		}
+	}
+	return ent.decode()
+}
+
+// pingDatastore verifies the datastore is reachable.
+// memDB always is.
+func pingDatastore(c context.Context) error {
+	return nil
 }
 
+// getEventDataByEtag fetches a version of eventData with the given etag.
+// Only eventDataHistory most recent versions are kept;
+// errNotFound is returned if none of them matches etag.
+func getEventDataByEtag(c context.Context, etag string) (*eventData, error) {
+	memDB.Lock()
+	var ent *memEventData
+	for _, e := range memDB.events {
+		if e.etag == etag {
+			ent = e
+			break
+		}
+	}
+	memDB.Unlock()
+	if ent == nil {
+		return nil, errNotFound
+	}
+	return ent.decode()
+}
+
+// getSessionByID returns the session from getLatestEventData() if it exists,
+// otherwise an error.
 func getSessionByID(c context.Context, id string) (*eventSession, error) {
-	return nil, errors.New("not implemented")
+	d, err := getLatestEventData(c, nil)
+	if err != nil {
+		return nil, err
+	}
+	s, ok := d.Sessions[id]
+	if !ok {
+		return nil, errNotFound
+	}
+	return s, nil
 }
 
+// storeChanges saves d in memDB, keeping at most maxMemChanges most recent ones.
+// Even though d.Token is stored, its value must not be used when
+// retrieved later on.
 func storeChanges(c context.Context, d *dataChanges) error {
-	return errors.New("not implemented")
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	memDB.Lock()
+	defer memDB.Unlock()
+	i := sort.Search(len(memDB.changes), func(i int) bool {
+		return memDB.changes[i].updated.After(d.Updated)
+	})
+	memDB.changes = append(memDB.changes, nil)
+	copy(memDB.changes[i+1:], memDB.changes[i:])
+	memDB.changes[i] = &memChanges{updated: d.Updated, data: b}
+	if n := len(memDB.changes); n > maxMemChanges {
+		memDB.changes = memDB.changes[n-maxMemChanges:]
+	}
+	return nil
 }
 
 // getChangesSince queries DB for all changes occurred since time t
@@ -121,7 +278,71 @@ func storeChanges(c context.Context, d *dataChanges) error {
 // At most 1000 changes will be returned.
 // Resulting dataChanges.Changed time will be set to the most recent one.
 func getChangesSince(c context.Context, t time.Time) (*dataChanges, error) {
-	return nil, errors.New("not implemented")
+	memDB.Lock()
+	i := sort.Search(len(memDB.changes), func(i int) bool {
+		return memDB.changes[i].updated.After(t)
+	})
+	res := append([]*memChanges(nil), memDB.changes[i:]...)
+	memDB.Unlock()
+	if len(res) > 1000 {
+		res = res[:1000]
+	}
+
+	changes := &dataChanges{
+		Updated: t,
+		eventData: eventData{
+			Sessions: make(map[string]*eventSession),
+			Speakers: make(map[string]*eventSpeaker),
+			Videos:   make(map[string]*eventVideo),
+		},
+	}
+	for _, item := range res {
+		dc := &dataChanges{}
+		if err := json.Unmarshal(item.data, dc); err != nil {
+			errorf(c, "getChangesSince: %v at ts = %s", err, item.updated)
+			continue
+		}
+		mergeChanges(changes, dc)
+	}
+	return changes, nil
+}
+
+// storeSyncTime records t as the time of the last successful event data sync.
+func storeSyncTime(c context.Context, t time.Time) error {
+	memDB.Lock()
+	memDB.synced = t
+	memDB.Unlock()
+	return nil
+}
+
+// getSyncTime returns the time recorded with storeSyncTime,
+// or errNotFound if there was no successful sync yet.
+func getSyncTime(c context.Context) (time.Time, error) {
+	memDB.Lock()
+	defer memDB.Unlock()
+	if memDB.synced.IsZero() {
+		return memDB.synced, errNotFound
+	}
+	return memDB.synced, nil
+}
+
+// storeSessionsRevoked records t as the time all sessions of user uid were revoked at.
+func storeSessionsRevoked(c context.Context, uid string, t time.Time) error {
+	memDB.Lock()
+	defer memDB.Unlock()
+	if memDB.sessRevoked == nil {
+		memDB.sessRevoked = make(map[string]time.Time)
+	}
+	memDB.sessRevoked[uid] = t
+	return nil
+}
+
+// getSessionsRevoked returns the time recorded with storeSessionsRevoked,
+// or zero time if sessions of user uid have never been revoked.
+func getSessionsRevoked(c context.Context, uid string) (time.Time, error) {
+	memDB.Lock()
+	defer memDB.Unlock()
+	return memDB.sessRevoked[uid], nil
 }
 
 // storeNextSessions saves IDs of items under kindNext entity kind,
@@ -155,3 +376,34 @@ func updateEggCache(c context.Context, egg *easterEgg) error {
 func getCachedEgg(c context.Context) (*easterEgg, error) {
 	return nil, errors.New("not implemented")
 }
+
+// storeAnnouncement saves a in a persistent DB.
+// A new ID is assigned to a if a.ID is empty.
+func storeAnnouncement(c context.Context, a *announcement) error {
+	return errors.New("not implemented")
+}
+
+// getAnnouncement fetches announcement with the given id from a persistent DB.
+func getAnnouncement(c context.Context, id string) (*announcement, error) {
+	return nil, errors.New("not implemented")
+}
+
+// listAnnouncements returns at most limit most recent announcements.
+func listAnnouncements(c context.Context, limit int) ([]*announcement, error) {
+	return nil, errors.New("not implemented")
+}
+
+// dueAnnouncements returns unsent announcements scheduled at or before t.
+func dueAnnouncements(c context.Context, t time.Time) ([]*announcement, error) {
+	return nil, errors.New("not implemented")
+}
+
+// storeBroadcast saves b in a persistent DB.
+func storeBroadcast(c context.Context, b *broadcast) error {
+	return errors.New("not implemented")
+}
+
+// getBroadcast fetches broadcast progress record with the given id from a persistent DB.
+func getBroadcast(c context.Context, id string) (*broadcast, error) {
+	return nil, errors.New("not implemented")
+}
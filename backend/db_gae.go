@@ -24,6 +24,7 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
+	"strconv"
 	"strings"
 	"time"
 
@@ -40,6 +41,10 @@ const (
 	kindAppFolder   = "AppFolder"
 	kindNext        = "Next"
 	kindEgg         = "Egg"
+	kindAnnounce    = "Announce"
+	kindBroadcast   = "Broadcast"
+	kindSync        = "Sync"
+	kindSessRevoked = "SessRevoked"
 )
 
 type eventDataCache struct {
@@ -178,6 +183,9 @@ func getUserPushInfo(c context.Context, uid string) (*userPush, error) {
 	if p.Ext.Enabled {
 		p.Pext = &p.Ext
 	}
+	if p.Quiet.Enabled {
+		p.Pquiet = &p.Quiet
+	}
 	return p, err
 }
 
@@ -200,6 +208,55 @@ func listUsersWithPush(c context.Context) ([]string, error) {
 	return users, nil
 }
 
+// countUsersWithPush returns the number of users with userPush.Enabled == true
+// and, unless prop is empty, the userPush datastore property prop set to true,
+// e.g. "io" or "ext.on".
+func countUsersWithPush(c context.Context, prop string) (int, error) {
+	q := datastore.NewQuery(kindUserPush).Filter("on =", true).KeysOnly()
+	if prop != "" {
+		q = q.Filter(prop+" =", true)
+	}
+	n, err := q.Count(c)
+	if err != nil {
+		return 0, fmt.Errorf("countUsersWithPush: %v", err)
+	}
+	return n, nil
+}
+
+// listUsersWithPushBatch is similar to listUsersWithPush but returns at most limit
+// user IDs, starting at cursor. An empty cursor starts from the beginning.
+// The returned next cursor is empty when there are no more users.
+func listUsersWithPushBatch(c context.Context, cursor string, limit int) ([]string, string, error) {
+	q := datastore.NewQuery(kindUserPush).Filter("on =", true).KeysOnly().Limit(limit)
+	if cursor != "" {
+		cur, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return nil, "", fmt.Errorf("listUsersWithPushBatch: %v", err)
+		}
+		q = q.Start(cur)
+	}
+	users := make([]string, 0, limit)
+	t := q.Run(c)
+	for {
+		k, err := t.Next(nil)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, "", fmt.Errorf("listUsersWithPushBatch: %v", err)
+		}
+		users = append(users, k.StringID())
+	}
+	if len(users) < limit {
+		return users, "", nil
+	}
+	cur, err := t.Cursor()
+	if err != nil {
+		return nil, "", fmt.Errorf("listUsersWithPushBatch: %v", err)
+	}
+	return users, cur.String(), nil
+}
+
 // storeLocalAppFolderMeta saves data.FileID and data.Etag in a local db under key of user uid.
 func storeLocalAppFolderMeta(c context.Context, uid string, data *appFolderData) error {
 	key := datastore.NewKey(c, kindAppFolder, uid, 0, nil)
@@ -313,6 +370,45 @@ func getLatestEventData(c context.Context, etags []string) (*eventData, error) {
 	return data, gob.NewDecoder(bytes.NewReader(res.Bytes)).Decode(data)
 }
 
+// pingDatastore verifies the datastore is reachable
+// with a keys-only query of a single EventData entity.
+func pingDatastore(c context.Context) error {
+	q := datastore.NewQuery(kindEventData).
+		Ancestor(eventDataParent(c)).
+		KeysOnly().
+		Limit(1)
+	_, err := q.GetAll(c, nil)
+	return err
+}
+
+// getEventDataByEtag fetches a version of eventData with the given etag,
+// previously saved with storeEventData().
+// Only eventDataHistory most recent versions are looked at;
+// errNotFound is returned if none of them matches etag.
+func getEventDataByEtag(c context.Context, etag string) (*eventData, error) {
+	q := datastore.NewQuery(kindEventData).
+		Ancestor(eventDataParent(c)).
+		Order("-ts").
+		Limit(eventDataHistory).
+		KeysOnly()
+	keys, err := q.GetAll(c, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		if hexKey(k) != etag {
+			continue
+		}
+		ent := &eventDataCache{}
+		if err := datastore.Get(c, k, ent); err != nil {
+			return nil, err
+		}
+		data := &eventData{etag: etag, modified: ent.Timestamp}
+		return data, gob.NewDecoder(bytes.NewReader(ent.Bytes)).Decode(data)
+	}
+	return nil, errNotFound
+}
+
 // getSessionByID returns the session from getLatestEventData() if it exists,
 // otherwise an error.
 func getSessionByID(c context.Context, id string) (*eventSession, error) {
@@ -434,6 +530,54 @@ func filterNextSessions(c context.Context, items []*eventSession) ([]*eventSessi
 	return res, nil
 }
 
+// syncStatus is the only entity of kindSync.
+type syncStatus struct {
+	Last time.Time `datastore:"last,noindex"`
+}
+
+// storeSyncTime records t as the time of the last successful event data sync.
+func storeSyncTime(c context.Context, t time.Time) error {
+	k := datastore.NewKey(c, kindSync, "status", 0, nil)
+	_, err := datastore.Put(c, k, &syncStatus{Last: t})
+	return err
+}
+
+// getSyncTime returns the time recorded with storeSyncTime,
+// or errNotFound if there was no successful sync yet.
+func getSyncTime(c context.Context) (time.Time, error) {
+	k := datastore.NewKey(c, kindSync, "status", 0, nil)
+	s := &syncStatus{}
+	err := datastore.Get(c, k, s)
+	if err == datastore.ErrNoSuchEntity {
+		err = errNotFound
+	}
+	return s.Last, err
+}
+
+// sessionsRevoked is an entity of kindSessRevoked, keyed by user ID.
+type sessionsRevoked struct {
+	At time.Time `datastore:"at,noindex"`
+}
+
+// storeSessionsRevoked records t as the time all sessions of user uid were revoked at.
+func storeSessionsRevoked(c context.Context, uid string, t time.Time) error {
+	k := datastore.NewKey(c, kindSessRevoked, uid, 0, nil)
+	_, err := datastore.Put(c, k, &sessionsRevoked{At: t})
+	return err
+}
+
+// getSessionsRevoked returns the time recorded with storeSessionsRevoked,
+// or zero time if sessions of user uid have never been revoked.
+func getSessionsRevoked(c context.Context, uid string) (time.Time, error) {
+	k := datastore.NewKey(c, kindSessRevoked, uid, 0, nil)
+	ent := &sessionsRevoked{}
+	err := datastore.Get(c, k, ent)
+	if err == datastore.ErrNoSuchEntity {
+		err = nil
+	}
+	return ent.At, err
+}
+
 // storeEasterEgg replaces current easter egg data with egg.
 func storeEasterEgg(c context.Context, egg *easterEgg) error {
 	k := datastore.NewKey(c, kindEgg, "latest", 0, nil)
@@ -482,6 +626,88 @@ func getCachedEgg(c context.Context) (*easterEgg, error) {
 	return egg, json.Unmarshal(b, egg)
 }
 
+// storeAnnouncement saves a in the datastore.
+// A new ID is assigned to a if a.ID is empty.
+func storeAnnouncement(c context.Context, a *announcement) error {
+	key := datastore.NewIncompleteKey(c, kindAnnounce, nil)
+	if a.ID != "" {
+		id, err := strconv.ParseInt(a.ID, 10, 64)
+		if err != nil {
+			return fmt.Errorf("storeAnnouncement: invalid ID %q", a.ID)
+		}
+		key = datastore.NewKey(c, kindAnnounce, "", id, nil)
+	}
+	key, err := datastore.Put(c, key, a)
+	if err != nil {
+		return err
+	}
+	a.ID = strconv.FormatInt(key.IntID(), 10)
+	return nil
+}
+
+// getAnnouncement fetches announcement with the given id from the datastore.
+// It returns errNotFound if no such announcement exists.
+func getAnnouncement(c context.Context, id string) (*announcement, error) {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil, errNotFound
+	}
+	a := &announcement{ID: id}
+	err = datastore.Get(c, datastore.NewKey(c, kindAnnounce, "", n, nil), a)
+	if err == datastore.ErrNoSuchEntity {
+		err = errNotFound
+	}
+	return a, err
+}
+
+// listAnnouncements returns at most limit most recent announcements,
+// ordered by their send time.
+func listAnnouncements(c context.Context, limit int) ([]*announcement, error) {
+	q := datastore.NewQuery(kindAnnounce).Order("-at").Limit(limit)
+	return queryAnnouncements(c, q)
+}
+
+// dueAnnouncements returns unsent announcements scheduled at or before t.
+// It might not return most recent result because of the datastore eventual consistency.
+func dueAnnouncements(c context.Context, t time.Time) ([]*announcement, error) {
+	q := datastore.NewQuery(kindAnnounce).
+		Filter("sent =", false).
+		Filter("at <=", t).
+		Order("at")
+	return queryAnnouncements(c, q)
+}
+
+// queryAnnouncements runs q and returns the results with their IDs set.
+func queryAnnouncements(c context.Context, q *datastore.Query) ([]*announcement, error) {
+	var res []*announcement
+	keys, err := q.GetAll(c, &res)
+	if err != nil {
+		return nil, err
+	}
+	for i, k := range keys {
+		res[i].ID = strconv.FormatInt(k.IntID(), 10)
+	}
+	return res, nil
+}
+
+// storeBroadcast saves b in the datastore under b.ID key.
+func storeBroadcast(c context.Context, b *broadcast) error {
+	key := datastore.NewKey(c, kindBroadcast, b.ID, 0, nil)
+	_, err := datastore.Put(c, key, b)
+	return err
+}
+
+// getBroadcast fetches broadcast progress record with the given id from the datastore.
+// It returns errNotFound if no such record exists.
+func getBroadcast(c context.Context, id string) (*broadcast, error) {
+	b := &broadcast{ID: id}
+	err := datastore.Get(c, datastore.NewKey(c, kindBroadcast, id, 0, nil), b)
+	if err == datastore.ErrNoSuchEntity {
+		err = errNotFound
+	}
+	return b, err
+}
+
 // eventDataParent returns a common ancestor for all kindEventData entities.
 func eventDataParent(c context.Context) *datastore.Key {
 	return datastore.NewKey(c, kindEventData, "root", 0, nil)
@@ -17,6 +17,7 @@ package main
 import (
 	"errors"
 	"fmt"
+	"net/http"
 	"time"
 )
 
@@ -26,6 +27,7 @@ var (
 	errAuthTokenType = errors.New("invalid token type")
 	errBadData       = errors.New("malformed or otherwise invalid data")
 	errConflict      = errors.New("precondition or data conflict")
+	errCSRF          = errors.New("missing or invalid CSRF token")
 	errNotFound      = errors.New("data not found")
 	errNotModified   = errors.New("content not modified")
 )
@@ -51,17 +53,98 @@ func (pe *pushError) String() string {
 		pe.retry, pe.remove, pe.after, pe.msg)
 }
 
+// API error codes. Unlike error messages, they are stable
+// and can be relied upon by clients.
+const (
+	errCodeBadRequest   = "bad_request"
+	errCodeBadData      = "bad_data"
+	errCodeAuthRequired = "auth_required"
+	errCodeAuthInvalid  = "auth_invalid"
+	errCodeTokenType    = "invalid_token_type"
+	errCodeForbidden    = "forbidden"
+	errCodeNotFound     = "not_found"
+	errCodeMethod       = "method_not_allowed"
+	errCodeConflict     = "conflict"
+	errCodeCSRF         = "csrf_invalid"
+	errCodeRateLimit    = "rate_limited"
+	errCodeInternal     = "internal"
+)
+
+// knownErrors maps errors of this package to HTTP status and error codes.
+var knownErrors = map[error]struct {
+	status int
+	code   string
+}{
+	errAuthMissing:   {http.StatusUnauthorized, errCodeAuthRequired},
+	errAuthInvalid:   {http.StatusForbidden, errCodeAuthInvalid},
+	errAuthTokenType: {498, errCodeTokenType},
+	errBadData:       {http.StatusBadRequest, errCodeBadData},
+	errNotFound:      {http.StatusNotFound, errCodeNotFound},
+	errConflict:      {http.StatusConflict, errCodeConflict},
+	errCSRF:          {http.StatusForbidden, errCodeCSRF},
+}
+
+// statusErrCodes are error codes of errors unknown to knownErrors.
+var statusErrCodes = map[int]string{
+	http.StatusBadRequest:       errCodeBadRequest,
+	http.StatusUnauthorized:     errCodeAuthRequired,
+	http.StatusForbidden:        errCodeForbidden,
+	http.StatusNotFound:         errCodeNotFound,
+	http.StatusMethodNotAllowed: errCodeMethod,
+	http.StatusConflict:         errCodeConflict,
+	http.StatusTooManyRequests:  errCodeRateLimit,
+}
+
 // apiError is an error used by API handlers
+//  - err: the underlying error, if any
+//  - code: HTTP response status code
+//  - msg: error message; err message is used if empty
+//  - ecode: machine-readable error code, one of errCode consts
+//  - details: optional data specific to the error, sent along with the message
 type apiError struct {
-	err  error
-	code int
-	msg  string
+	err     error
+	code    int
+	msg     string
+	ecode   string
+	details map[string]interface{}
 }
 
 func (ae *apiError) Error() string {
+	if ae.msg == "" && ae.err != nil {
+		return ae.err.Error()
+	}
 	return ae.msg
 }
 
+// toAPIError converts err to an *apiError with HTTP status code,
+// unless err is already an *apiError or one of knownErrors,
+// in which case their status code takes precedence.
+// Missing error code is derived from the status.
+func toAPIError(code int, err interface{}) *apiError {
+	var ae apiError
+	switch err := err.(type) {
+	case *apiError:
+		ae = *err
+	case error:
+		ae = apiError{err: err, code: code}
+		if k, ok := knownErrors[err]; ok {
+			ae.code, ae.ecode = k.status, k.code
+		}
+	default:
+		ae = apiError{code: code, msg: fmt.Sprint(err)}
+	}
+	if ae.code == 0 {
+		ae.code = http.StatusInternalServerError
+	}
+	if ae.ecode == "" {
+		ae.ecode = statusErrCodes[ae.code]
+	}
+	if ae.ecode == "" && ae.code >= 500 {
+		ae.ecode = errCodeInternal
+	}
+	return &ae
+}
+
 // prefixedErr returns a func that creates errors with the given prefix.
 func prefixedErr(prefix string) func(interface{}) error {
 	return func(err interface{}) error {
@@ -0,0 +1,122 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestToAPIError(t *testing.T) {
+	table := []struct {
+		code  int
+		err   interface{}
+		scode int
+		ecode string
+		msg   string
+	}{
+		{http.StatusBadRequest, "invalid data", http.StatusBadRequest, errCodeBadRequest, "invalid data"},
+		{http.StatusInternalServerError, errNotFound, http.StatusNotFound, errCodeNotFound, errNotFound.Error()},
+		{http.StatusInternalServerError, errAuthInvalid, http.StatusForbidden, errCodeAuthInvalid, errAuthInvalid.Error()},
+		{http.StatusInternalServerError, errors.New("db down"), http.StatusInternalServerError, errCodeInternal, "db down"},
+		{http.StatusInternalServerError, &apiError{code: http.StatusBadRequest, msg: "invalid endpoint"},
+			http.StatusBadRequest, errCodeBadRequest, "invalid endpoint"},
+		{http.StatusOK, &apiError{code: 498, ecode: errCodeTokenType}, 498, errCodeTokenType, ""},
+		{http.StatusTeapot, "teapot", http.StatusTeapot, "", "teapot"},
+	}
+	for i, test := range table {
+		ae := toAPIError(test.code, test.err)
+		if ae.code != test.scode {
+			t.Errorf("%d: ae.code = %d; want %d", i, ae.code, test.scode)
+		}
+		if ae.ecode != test.ecode {
+			t.Errorf("%d: ae.ecode = %q; want %q", i, ae.ecode, test.ecode)
+		}
+		if ae.Error() != test.msg {
+			t.Errorf("%d: ae.Error() = %q; want %q", i, ae.Error(), test.msg)
+		}
+	}
+}
+
+func TestWriteJSONError(t *testing.T) {
+	defer preserveConfig()()
+	table := []struct {
+		env  string
+		code int
+		err  interface{}
+		msg  string
+	}{
+		{"dev", http.StatusInternalServerError, errors.New("secret internals"), "secret internals"},
+		{"prod", http.StatusInternalServerError, errors.New("secret internals"), "Internal Server Error"},
+		{"prod", http.StatusBadRequest, "invalid data", "invalid data"},
+	}
+	for i, test := range table {
+		config.Env = test.env
+		r := newTestRequest(t, "GET", "/", nil)
+		r.Header.Set("x-request-id", "req-1")
+		w := httptest.NewRecorder()
+		// replaced with JSON
+		w.Header().Set("content-type", "text/html;charset=utf-8")
+		writeJSONError(newContext(r), w, test.code, test.err)
+
+		if w.Code != test.code {
+			t.Errorf("%d: w.Code = %d; want %d", i, w.Code, test.code)
+		}
+		var body struct {
+			Error, Code, RequestID string
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%d: json.Unmarshal(%s): %v", i, w.Body.String(), err)
+		}
+		if body.Error != test.msg {
+			t.Errorf("%d: body.Error = %q; want %q", i, body.Error, test.msg)
+		}
+		if body.Code == "" {
+			t.Errorf("%d: body.Code is empty", i)
+		}
+		if v := w.Header().Get("content-type"); v != "application/json;charset=utf-8" {
+			t.Errorf("%d: content-type = %q; want application/json;charset=utf-8", i, v)
+		}
+		if isGAEtest {
+			continue
+		}
+		if body.RequestID != "req-1" {
+			t.Errorf("%d: body.RequestID = %q; want req-1", i, body.RequestID)
+		}
+	}
+}
+
+func TestServeManifestError(t *testing.T) {
+	defer preserveConfig()()
+	config.Env = "prod"
+	config.Dir = "/does/not/exist"
+	w := httptest.NewRecorder()
+	serveManifest(w, newTestRequest(t, "GET", "/manifest.json", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("w.Code = %d; want 500", w.Code)
+	}
+	var body struct{ Error, Code string }
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("json.Unmarshal(%s): %v", w.Body.String(), err)
+	}
+	// no file paths in prod
+	if body.Error != "Internal Server Error" || body.Code != errCodeInternal {
+		t.Errorf("body = %+v; want redacted internal error", body)
+	}
+}
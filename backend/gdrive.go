@@ -48,6 +48,7 @@ type appFolderData struct {
 // Resulting appFolderData will have zero-valued FileID, zero-valued Etag
 // and a copy of defaultBookmarks if the file doesn't exist yet.
 func getAppFolderData(c context.Context, cred *oauth2Credentials, fresh bool) (*appFolderData, error) {
+	defer driveDuration.since(time.Now(), "get")
 	perr := prefixedErr("getAppFolderData")
 	hc := oauth2Client(c, cred.tokenSource(c))
 	// get file ID and etag
@@ -156,6 +157,7 @@ func fetchAppFolderMeta(hc *http.Client) (*appFolderData, error) {
 // storeAppFolderData uploads data using drive API, updates data.Etag with the new value
 // and saves this info using storeLocalAppFolderMeta() func.
 func storeAppFolderData(c context.Context, cred *oauth2Credentials, data *appFolderData) error {
+	defer driveDuration.since(time.Now(), "store")
 	hc := oauth2Client(c, cred.tokenSource(c))
 	// upload to gdrive
 	var err error
@@ -21,6 +21,7 @@ import (
 	"html/template"
 	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
@@ -50,73 +51,168 @@ var (
 	// rootHandleFn is a request handler func for config.Prefix pattern.
 	// GAE and standalone servers have different root handle func.
 	rootHandleFn func(http.ResponseWriter, *http.Request)
+	// httpHandle registers a handler for the given pattern.
+	// Tests replace it to inspect registered routes.
+	httpHandle = http.Handle
+	// isAdminRequest reports whether r is made by one of config.Admins.
+	// GAE and standalone servers authenticate admins differently.
+	isAdminRequest = func(r *http.Request) bool { return false }
+	// isCronOrTask reports whether r is made by GAE Cron or Task Queue service.
+	// Only GAE removes X-Appengine headers from external requests,
+	// so standalone servers trust none.
+	isCronOrTask = func(r *http.Request) bool { return false }
 )
 
 // registerHandlers sets up all backend handle funcs, including the API.
+// Each route is registered along with its description, see routeInfo.
 func registerHandlers() {
 	// HTML and other non-API
-	handle("/", rootHandleFn)
-	handle("/sitemap.xml", serveSitemap)
-	handle("/manifest.json", serveManifest)
+	page := &routeInfo{Internal: true, Ops: []*routeOp{{Method: "GET"}}}
+	handle("/", rootHandleFn, page)
+	handle("/sitemap.xml", serveSitemap, page)
+	handle("/manifest.json", serveManifest, page)
 	// API v0 - pre-phase2
-	handle("/api/extended", serveIOExtEntries)
-	handle("/api/social", serveSocial)
+	handle("/api/extended", serveIOExtEntries, &routeInfo{Internal: true, Ops: []*routeOp{{Method: "GET"}}})
+	handle("/api/social", serveSocial, &routeInfo{Internal: true, Ops: []*routeOp{{Method: "GET"}}})
 	// API v1
-	handle("/api/v1/extended", serveIOExtEntries)
-	handle("/api/v1/social", serveSocial)
-	handle("/api/v1/auth", handleAuth)
-	handle("/api/v1/schedule", serveSchedule)
-	handle("/api/v1/easter-egg", handleEasterEgg)
-	handle("/api/v1/user/schedule", handleUserSchedule)
-	handle("/api/v1/user/schedule/", handleUserSchedule)
-	handle("/api/v1/user/notify", handleUserNotifySettings)
-	handle("/api/v1/user/updates", serveUserUpdates)
-	handle("/api/v1/user/survey", handleUserSurvey)
-	handle("/api/v1/user/survey/", handleUserSurvey)
+	handle("/api/v1/openapi.json", serveOpenAPI, &routeInfo{
+		Summary: "OpenAPI description of this API",
+		Ops:     []*routeOp{{Method: "GET", Res: map[string]interface{}{}}},
+	})
+	handle("/api/v1/extended", serveIOExtEntries, &routeInfo{
+		Summary: "I/O Extended events",
+		Ops:     []*routeOp{{Method: "GET", Res: []*extEntry{}}},
+	})
+	handle("/api/v1/social", serveSocial, &routeInfo{
+		Summary: "Social feed",
+		Ops:     []*routeOp{{Method: "GET", Res: []*socEntry{}}},
+	})
+	handle("/api/v1/auth", handleAuth, &routeInfo{
+		Summary: "Exchange OAuth 2 authorization code for user credentials",
+		Ops: []*routeOp{{Method: "POST", Auth: authBearer, Req: &authFlow{}, Res: &struct {
+			CSRFToken string `json:"csrfToken,omitempty"`
+		}{}}},
+	})
+	handle("/api/v1/auth/logout", handleLogout, &routeInfo{
+		Summary: "Sign out of all browser sessions of the user",
+		Ops:     []*routeOp{{Method: "POST", Auth: authBearer + " " + authSession}},
+	})
+	handle("/api/v1/schedule", serveSchedule, &routeInfo{
+		Summary: "Event schedule, or changes since a previous version with ?delta=true",
+		Ops:     []*routeOp{{Method: "GET", Res: &apiSchedule{}}},
+	})
+	handle("/api/v1/schedule/stream", serveScheduleStream, &routeInfo{
+		Summary: "Server-Sent Events stream of schedule changes",
+		Ops:     []*routeOp{{Method: "GET", Res: "", ResType: "text/event-stream"}},
+	})
+	handle("/api/v1/easter-egg", handleEasterEgg, &routeInfo{
+		Summary: "Easter egg link",
+		Ops: []*routeOp{
+			{Method: "GET", Res: &struct {
+				Link string `json:"link"`
+			}{}},
+			{Method: "POST", Summary: "Replace easter egg link", Auth: authSync, Req: &easterEgg{}},
+		},
+	})
+	// user data is accessible with a session cookie too
+	userAuth := authBearer + " " + authSession
+	bookmarks := &routeInfo{
+		Summary: "Bookmarked sessions of the user",
+		Param:   "sid",
+		Ops: []*routeOp{
+			{Method: "GET", Auth: userAuth, Res: []string{}},
+			{Method: "PUT", Summary: "Bookmark sessions", Auth: userAuth, Req: []string{}, Res: []string{}},
+			{Method: "DELETE", Summary: "Remove bookmarks", Auth: userAuth, Req: []string{}, Res: []string{}},
+		},
+	}
+	handle("/api/v1/user/schedule", handleUserSchedule, bookmarks)
+	handle("/api/v1/user/schedule/", handleUserSchedule, bookmarks)
+	notify := &routeInfo{
+		Summary: "Push notification settings of the user",
+		Ops: []*routeOp{
+			{Method: "GET", Auth: userAuth, Res: &userPush{}},
+			{Method: "PUT", Auth: userAuth, Req: &userPush{}, Res: &userPush{}},
+		},
+	}
+	handle("/api/v1/user/notify", handleUserNotifySettings, notify)
+	handle("/api/v1/user/updates", serveUserUpdates, &routeInfo{
+		Summary: "Changes since the time encoded in SW token",
+		Ops: []*routeOp{
+			{Method: "GET", Auth: authBearer + " " + authSWToken, Res: &dataChanges{}},
+			{Method: "DELETE", Summary: "Revoke all SW tokens of the user", Auth: userAuth},
+		},
+	})
+	survey := &routeInfo{
+		Summary: "Session feedback surveys of the user",
+		Param:   "sid",
+		Ops: []*routeOp{
+			{Method: "GET", Summary: "Sessions with submitted feedback", Auth: userAuth, Res: []string{}},
+			{Method: "PUT", Summary: "Submit session feedback", Auth: userAuth, Req: &sessionSurvey{}, Res: []string{}},
+		},
+	}
+	handle("/api/v1/user/survey", handleUserSurvey, survey)
+	handle("/api/v1/user/survey/", handleUserSurvey, survey)
 	// API v2
-	handle("/api/v2/user/notify", handleUserNotifySettings)
+	handle("/api/v2/user/notify", handleUserNotifySettings, notify)
+	handle("/metrics", serveMetrics, &routeInfo{Internal: true, Ops: []*routeOp{{Method: "GET"}}})
 	// background jobs
-	handle("/sync/gcs", syncEventData)
-	handle("/task/notify-subscribers", handleNotifySubscribers)
-	handle("/task/ping-user", handlePingUser)
-	handle("/task/ping-device", handlePingDevice)
-	handle("/task/ping-ext", handlePingExt)
-	handle("/task/clock", handleClock)
+	task := &routeInfo{Internal: true, Ops: []*routeOp{{Method: "POST"}}}
+	cron := &routeInfo{Internal: true, Ops: []*routeOp{{Method: "GET"}, {Method: "POST"}}}
+	handle("/sync/gcs", syncEventData, cron)
+	handle("/task/notify-subscribers", handleNotifySubscribers, task)
+	handle("/task/ping-user", handlePingUser, task)
+	handle("/task/ping-device", handlePingDevice, task)
+	handle("/task/ping-ext", handlePingExt, task)
+	handle("/task/clock", handleClock, cron)
 	// debug handlers; not available in prod
 	if !isProd() {
-		handle("/debug/srvget", debugServiceGetURL)
-		handle("/debug/push", debugPush)
-		handle("/debug/sync", debugSync)
+		debug := &routeInfo{Internal: true, Ops: []*routeOp{{Method: "GET"}, {Method: "POST"}}}
+		handle("/debug/srvget", debugServiceGetURL, debug)
+		handle("/debug/push", debugPush, debug)
+		handle("/debug/sync", debugSync, debug)
 	}
+	// site admin stuff, accessible only to config.Admins
+	httpHandle(prefixedPattern("/admin/"), checkAdmin(handler(handleAdmin)))
 	// setup root redirect if we're prefixed
 	if config.Prefix != "/" {
 		var redirect http.Handler = http.HandlerFunc(redirectHandler)
 		if wrapHandler != nil {
 			redirect = wrapHandler(redirect)
 		}
-		http.Handle("/", redirect)
+		httpHandle("/", redirect)
 	}
+	// health checks for load balancers, not prefixed either
+	httpHandle("/healthz", http.HandlerFunc(serveHealth))
+	httpHandle("/readyz", http.HandlerFunc(serveReadiness))
 	// warmup, can't use prefix
-	http.HandleFunc("/_ah/warmup", func(w http.ResponseWriter, r *http.Request) {
+	httpHandle("/_ah/warmup", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		c := newContext(r)
 		logf(c, "warmup: env = %s; devserver? %v", config.Env, isDevServer())
-	})
+	}))
 }
 
 // handle registers a handle function fn for the pattern prefixed
-// with httpPrefix.
-func handle(pattern string, fn func(w http.ResponseWriter, r *http.Request)) {
+// with httpPrefix. info describes the route and is required;
+// requests with methods not in info.Ops never reach fn.
+func handle(pattern string, fn func(w http.ResponseWriter, r *http.Request), info *routeInfo) {
+	routes[pattern] = info
+	httpHandle(prefixedPattern(pattern), handler(instrumentHandler(pattern, info, route(pattern, info, fn))))
+}
+
+// prefixedPattern returns pattern prefixed with config.Prefix,
+// preserving the trailing slash of subtree patterns.
+func prefixedPattern(pattern string) string {
 	p := path.Join(config.Prefix, pattern)
 	if pattern[len(pattern)-1] == '/' {
 		p += "/"
 	}
-	http.Handle(p, handler(fn))
+	return p
 }
 
-// handler creates a new func from fn with stripped prefix
-// and wrapped with wrapHandler.
+// handler creates a new func from fn with stripped prefix,
+// compressed responses and wrapped with wrapHandler.
 func handler(fn func(w http.ResponseWriter, r *http.Request)) http.Handler {
-	var h http.Handler = http.HandlerFunc(fn)
+	var h http.Handler = compressHandler(http.HandlerFunc(fn))
 	if config.Prefix != "/" {
 		h = http.StripPrefix(config.Prefix, h)
 	}
@@ -212,22 +308,16 @@ func serveTemplate(w http.ResponseWriter, r *http.Request) {
 // serveSitemap responds with sitemap XML entries for a better SEO.
 func serveSitemap(w http.ResponseWriter, r *http.Request) {
 	c := newContext(r)
-	base := &url.URL{
-		Scheme: "https",
-		Host:   r.Host,
-		Path:   config.Prefix + "/",
-	}
-	if r.TLS == nil {
-		base.Scheme = "http"
-	}
+	base := baseURL(r)
+	base.Path = config.Prefix + "/"
 	m, err := getSitemap(c, base)
 	if err != nil {
-		writeError(w, err)
+		writeJSONError(c, w, errStatus(err), err)
 		return
 	}
 	res, err := xml.MarshalIndent(m, "  ", "    ")
 	if err != nil {
-		writeError(w, err)
+		writeJSONError(c, w, errStatus(err), err)
 		return
 	}
 	w.Header().Set("content-type", "application/xml")
@@ -236,9 +326,10 @@ func serveSitemap(w http.ResponseWriter, r *http.Request) {
 
 // serveSitemap responds with app manifest.
 func serveManifest(w http.ResponseWriter, r *http.Request) {
+	c := newContext(r)
 	m, err := renderManifest()
 	if err != nil {
-		writeError(w, err)
+		writeJSONError(c, w, errStatus(err), err)
 		return
 	}
 	w.Header().Set("content-type", "application/manifest+json")
@@ -250,10 +341,14 @@ func serveManifest(w http.ResponseWriter, r *http.Request) {
 func serveIOExtEntries(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 	_, refresh := r.Form["refresh"]
+	refresh = refresh && allowRefresh(r)
 
 	c := newContext(r)
 	w.Header().Set("Cache-Control", "public, max-age=60")
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	if refresh && !allowRate(c, w, refreshRateLimit, clientIP(r)) {
+		return
+	}
 
 	// respond with stubbed JSON entries in dev mode
 	if isDev() {
@@ -281,15 +376,25 @@ func serveIOExtEntries(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// allowRefresh reports whether r is allowed to bypass cache with ?refresh
+// and force a fetch from upstream. Only cron jobs, task queues and admins are.
+func allowRefresh(r *http.Request) bool {
+	return isCronOrTask(r) || isAdminRequest(r)
+}
+
 // serveSocial responds with 10 most recent tweets.
 // See socEntry struct for fields format.
 func serveSocial(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 	_, refresh := r.Form["refresh"]
+	refresh = refresh && allowRefresh(r)
 
 	c := newContext(r)
 	w.Header().Set("Cache-Control", "public, max-age=60")
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	if refresh && !allowRate(c, w, refreshRateLimit, clientIP(r)) {
+		return
+	}
 
 	// respond with stubbed JSON entries in dev mode
 	if isDev() {
@@ -317,6 +422,14 @@ func serveSocial(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// authFlow is the payload of /api/v1/auth requests.
+type authFlow struct {
+	// one-time authorization code from hybrid server-side flow
+	Code string `json:"code"`
+	// set session cookies for the browser
+	Session bool `json:"session,omitempty"`
+}
+
 // handleAuth is the main authentication handler.
 // It expects the following request header and body:
 //
@@ -328,10 +441,15 @@ func serveSocial(w http.ResponseWriter, r *http.Request) {
 // and code verifications. The client can count it as "fully logged in" confirmation.
 //
 // ID token is prefered over access token.
+//
+// With "session": true in the body, the response also sets session cookies,
+// see authRequest, and contains {"csrfToken": "..."}.
 func handleAuth(w http.ResponseWriter, r *http.Request) {
-	// TODO: don't propagate error messages for security reasons
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
 	c := newContext(r)
+	if !allowRate(c, w, authRateLimit, clientIP(r)) {
+		return
+	}
 	ah := r.Header.Get("authorization")
 
 	c, err := authUser(c, ah)
@@ -339,13 +457,15 @@ func handleAuth(w http.ResponseWriter, r *http.Request) {
 		writeJSONError(c, w, errStatus(err), err)
 		return
 	}
-	var flow struct {
-		Code string `json:"code"`
-	}
+	var flow authFlow
 	if err := json.NewDecoder(r.Body).Decode(&flow); err != nil {
 		writeJSONError(c, w, http.StatusBadRequest, err)
 		return
 	}
+	if flow.Session && !sessionsEnabled() {
+		writeJSONError(c, w, http.StatusBadRequest, "sessions are not enabled")
+		return
+	}
 	err = runInTransaction(c, func(c context.Context) error {
 		creds, err := fetchCredentials(c, flow.Code)
 		if err != nil {
@@ -355,7 +475,39 @@ func handleAuth(w http.ResponseWriter, r *http.Request) {
 	})
 	if err != nil {
 		writeJSONError(c, w, errStatus(err), err)
+		return
+	}
+	if !flow.Session {
+		return
+	}
+
+	s, err := newSession(contextUser(c), contextEmail(c))
+	if err == nil {
+		err = setSessionCookies(w, r, s)
+	}
+	if err != nil {
+		writeJSONError(c, w, http.StatusInternalServerError, err)
+		return
+	}
+	fmt.Fprintf(w, `{"csrfToken": %q}`, s.csrf)
+}
+
+// handleLogout revokes all sessions of the user signed in so far
+// and removes session cookies set by handleAuth.
+// Like other session-authenticated requests, it requires the CSRF token.
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	c, err := authRequest(newContext(r), w, r)
+	if err != nil {
+		writeJSONError(c, w, errStatus(err), err)
+		return
 	}
+	if err := revokeSessions(c, contextUser(c), time.Now()); err != nil {
+		writeJSONError(c, w, errStatus(err), err)
+		return
+	}
+	clearSessionCookies(w)
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func serveSchedule(w http.ResponseWriter, r *http.Request) {
@@ -374,7 +526,8 @@ func serveSchedule(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	data, err := getLatestEventData(c, r.Header["If-None-Match"])
+	inm := r.Header["If-None-Match"]
+	data, err := getLatestEventData(c, inm)
 	if err == errNotModified {
 		w.Header().Set("etag", `"`+data.etag+`"`)
 		w.WriteHeader(http.StatusNotModified)
@@ -385,17 +538,106 @@ func serveSchedule(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	b, err := json.Marshal(toAPISchedule(data))
-	if err != nil {
+	// binary format is negotiated with Accept header
+	w.Header().Add("Vary", "Accept")
+	proto := acceptsProto(r)
+	format := "json"
+	if proto {
+		format = "proto"
+	}
+
+	// respond with changes since the client version, if it is still around
+	if r.FormValue("delta") == "true" && len(inm) > 0 {
+		w.Header().Add("Vary", "If-None-Match")
+		base := strings.Trim(inm[0], `"`)
+		b, err := scheduleDelta(c, base, data, proto)
+		if err == nil {
+			if proto {
+				w.Header().Set("Content-Type", protoContentType)
+			}
+			// a delta is good only for clients with the same base version
+			w.Header().Set("Cache-Control", "private, no-store")
+			w.Header().Set("etag", `"`+data.etag+`"`)
+			w.Header().Set("delta-base", `"`+base+`"`)
+			w.Write(b)
+			return
+		}
+		if err != errNotFound {
+			errorf(c, "scheduleDelta(%q): %v", base, err)
+		}
+		// fall back to a full response
+	}
+
+	// big schedules are compressed once per version
+	w.Header().Set("etag", `"`+data.etag+`"`)
+	if proto {
+		w.Header().Set("Content-Type", protoContentType)
+	}
+	enc := acceptedEncoding(r)
+	key := "sched:" + format + ":" + enc + ":" + data.etag
+	if enc != "" {
+		if b, err := cache.get(c, key); err == nil {
+			w.Header().Set("Content-Encoding", enc)
+			w.Write(b)
+			return
+		}
+	}
+
+	var b []byte
+	if s := toAPISchedule(data); proto {
+		b = s.marshalProto()
+	} else if b, err = json.Marshal(s); err != nil {
 		writeJSONError(c, w, errStatus(err), err)
 		return
 	}
-	w.Header().Set("etag", `"`+data.etag+`"`)
+	if enc != "" {
+		if zb, err := compress(enc, b); err == nil {
+			if err := cache.set(c, key, zb, time.Hour); err != nil {
+				errorf(c, "serveSchedule: %v", err)
+			}
+			w.Header().Set("Content-Encoding", enc)
+			b = zb
+		}
+	}
 	w.Write(b)
 }
 
+// scheduleDelta returns dataChanges between eventData versions
+// identified by etag base and the latest one, encoded in JSON,
+// or protobuf if proto is true.
+// The result is cached, so that clients with the same base version
+// don't cause the diff to be computed each time.
+// It returns errNotFound if the base version does not exist anymore.
+func scheduleDelta(c context.Context, base string, latest *eventData, proto bool) ([]byte, error) {
+	key := "sched:delta:" + base + ":" + latest.etag
+	if proto {
+		key += ":proto"
+	}
+	if b, err := cache.get(c, key); err == nil {
+		return b, nil
+	}
+	old, err := getEventDataByEtag(c, base)
+	if err != nil {
+		return nil, err
+	}
+	dc := diffEventData(old, latest)
+	if dc == nil {
+		dc = &dataChanges{Updated: latest.modified}
+	}
+	var b []byte
+	if proto {
+		b = dc.marshalProto()
+	} else if b, err = json.Marshal(dc); err != nil {
+		return nil, err
+	}
+	if err := cache.set(c, key, b, time.Hour); err != nil {
+		errorf(c, "scheduleDelta: %v", err)
+	}
+	return b, nil
+}
+
 func handleUserSchedule(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "GET" {
+	if r.Method == "GET" || r.Method == "HEAD" {
 		serveUserSchedule(w, r)
 		return
 	}
@@ -404,11 +646,14 @@ func handleUserSchedule(w http.ResponseWriter, r *http.Request) {
 
 func serveUserSchedule(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
-	c, err := authUser(newContext(r), r.Header.Get("authorization"))
+	c, err := authRequest(newContext(r), w, r)
 	if err != nil {
 		writeJSONError(c, w, errStatus(err), err)
 		return
 	}
+	if !allowRate(c, w, bookmarksRateLimit, contextUser(c)) {
+		return
+	}
 
 	bookmarks, err := userSchedule(c, contextUser(c))
 	if err != nil {
@@ -424,26 +669,27 @@ func serveUserSchedule(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleUserBookmarks(w http.ResponseWriter, r *http.Request) {
-	if m := r.Header.Get("x-http-method-override"); m != "" {
-		r.Method = strings.ToUpper(m)
-	}
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
-	c, err := authUser(newContext(r), r.Header.Get("authorization"))
+	c, err := authRequest(newContext(r), w, r)
 	if err != nil {
 		writeJSONError(c, w, errStatus(err), err)
 		return
 	}
 	user := contextUser(c)
+	if !allowRate(c, w, bookmarksRateLimit, user) {
+		return
+	}
 
 	// get session IDs from either request body or URL path
 	// the former has precedence
 	var ids []string
 	err = json.NewDecoder(r.Body).Decode(&ids)
 	if err != nil || len(ids) == 0 {
-		ids = []string{path.Base(r.URL.Path)}
+		ids = []string{pathParam(r, "/api/v1/user/schedule/")}
 	}
+	c = withLogField(c, "sessions", ids)
 	for _, id := range ids {
-		if id == "" || id == "schedule" {
+		if id == "" {
 			writeJSONError(c, w, http.StatusBadRequest, "invalid session ID")
 			return
 		}
@@ -457,7 +703,8 @@ func handleUserBookmarks(w http.ResponseWriter, r *http.Request) {
 	case "DELETE":
 		bookmarks, err = unbookmarkSessions(c, user, ids...)
 	default:
-		writeJSONError(c, w, http.StatusBadRequest, "invalid request method")
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE, OPTIONS")
+		writeJSONError(c, w, http.StatusMethodNotAllowed, "method not allowed: "+r.Method)
 		return
 	}
 
@@ -475,17 +722,20 @@ func handleUserBookmarks(w http.ResponseWriter, r *http.Request) {
 // based on HTTP method of request r.
 func handleUserNotifySettings(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
-	case "GET":
+	case "GET", "HEAD":
 		serveUserNotifySettings(w, r)
 	case "PUT":
 		patchUserNotifySettings(w, r)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, OPTIONS")
+		writeJSONError(newContext(r), w, http.StatusMethodNotAllowed, "method not allowed: "+r.Method)
 	}
 }
 
 // serveUserNotifySettings responds with the current user push configuration.
 func serveUserNotifySettings(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
-	c, err := authUser(newContext(r), r.Header.Get("authorization"))
+	c, err := authRequest(newContext(r), w, r)
 	if err != nil {
 		writeJSONError(c, w, errStatus(err), err)
 		return
@@ -504,7 +754,7 @@ func serveUserNotifySettings(w http.ResponseWriter, r *http.Request) {
 // It doesn't modify existing parameters not present in the payload of r.
 func patchUserNotifySettings(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
-	c, err := authUser(newContext(r), r.Header.Get("authorization"))
+	c, err := authRequest(newContext(r), w, r)
 	if err != nil {
 		writeJSONError(c, w, errStatus(err), err)
 		return
@@ -544,6 +794,32 @@ func patchUserNotifySettings(w http.ResponseWriter, r *http.Request) {
 				data.Pext = &data.Ext
 			}
 		}
+		if v, ok := body["quiet"]; ok {
+			switch v := v.(type) {
+			case nil:
+				// turned off, including the defaults
+				data.Quiet = quietHours{Off: true}
+				data.Pquiet = nil
+			case map[string]interface{}:
+				if len(v) == 0 {
+					// back to the defaults
+					data.Quiet = quietHours{}
+					data.Pquiet = nil
+					break
+				}
+				q := quietHours{Enabled: true}
+				q.Start, _ = v["start"].(string)
+				q.End, _ = v["end"].(string)
+				q.Timezone, _ = v["timezone"].(string)
+				if !q.valid() {
+					return &apiError{msg: "invalid quiet hours", code: http.StatusBadRequest}
+				}
+				data.Quiet = q
+				data.Pquiet = &data.Quiet
+			default:
+				return &apiError{msg: "invalid quiet hours", code: http.StatusBadRequest}
+			}
+		}
 		regid, _ := body["subscriber"].(string)
 		endpoint, _ := body["endpoint"].(string)
 		endpoint = pushEndpointURL(regid, endpoint)
@@ -566,7 +842,7 @@ func patchUserNotifySettings(w http.ResponseWriter, r *http.Request) {
 	})
 
 	if terr != nil {
-		writeJSONError(c, w, errStatus(terr), err)
+		writeJSONError(c, w, errStatus(terr), terr)
 		return
 	}
 	json.NewEncoder(w).Encode(data)
@@ -578,15 +854,14 @@ func patchUserNotifySettings(w http.ResponseWriter, r *http.Request) {
 func syncEventData(w http.ResponseWriter, r *http.Request) {
 	c := newContext(r)
 	// allow only cron jobs, task queues and GCS but don't tell them that
-	tque := r.Header.Get("x-appengine-cron") == "true" || r.Header.Get("x-appengine-taskname") != ""
-	if t := r.Header.Get("x-goog-channel-token"); t != config.SyncToken && !tque {
+	if t := r.Header.Get("x-goog-channel-token"); t != config.SyncToken && !isCronOrTask(r) {
 		logf(c, "NOT performing sync: x-goog-channel-token = %q", t)
 		return
 	}
 
-	i, err := cache.inc(c, syncGCSCacheKey, 1, 0)
+	i, err := cache.inc(c, syncGCSCacheKey, 1, 0, 0)
 	if err != nil {
-		writeError(w, err)
+		writeJSONError(c, w, errStatus(err), err)
 		return
 	}
 	if i > 1 {
@@ -594,7 +869,10 @@ func syncEventData(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	start := time.Now()
+	var diff *dataChanges
 	err = runInTransaction(c, func(c context.Context) error {
+		diff = nil // in case of a retry
 		oldData, err := getLatestEventData(c, nil)
 		if err != nil {
 			return err
@@ -612,7 +890,7 @@ func syncEventData(w http.ResponseWriter, r *http.Request) {
 			return err
 		}
 
-		diff := diffEventData(oldData, newData)
+		diff = diffEventData(oldData, newData)
 		if isEmptyChanges(diff) {
 			logf(c, "%s: diff is empty (last: %s)", config.Schedule.ManifestURL, oldData.modified)
 			return nil
@@ -626,14 +904,22 @@ func syncEventData(w http.ResponseWriter, r *http.Request) {
 		return nil
 	})
 
-	if _, cerr := cache.inc(c, syncGCSCacheKey, -1000, 0); cerr != nil {
+	if _, cerr := cache.inc(c, syncGCSCacheKey, -1000, 0, 0); cerr != nil {
 		errorf(c, cerr.Error())
 	}
+	syncDuration.since(start, resultLabel(err))
 
 	if err != nil {
 		errorf(c, "syncEventSchedule: %v", err)
-		writeError(w, err)
+		writeJSONError(c, w, errStatus(err), err)
+		return
+	}
+	// also when the data is not modified, so that readiness checks can tell
+	// a stalled sync from a schedule which has not been edited for a while
+	if err := storeSyncTime(c, start); err != nil {
+		errorf(c, "storeSyncTime: %v", err)
 	}
+	publishChanges(c, diff)
 }
 
 // serverUserUpdates responds with a dataChanges containing a diff
@@ -642,6 +928,11 @@ func syncEventData(w http.ResponseWriter, r *http.Request) {
 // must know beforehand.
 func serveUserUpdates(w http.ResponseWriter, r *http.Request) {
 	ah := r.Header.Get("authorization")
+	// revoke all SW tokens of the user
+	if r.Method == "DELETE" {
+		revokeSWTokens(w, r)
+		return
+	}
 	// first request to get SW token
 	if strings.HasPrefix(strings.ToLower(ah), bearerHeader) {
 		serveSWToken(w, r)
@@ -651,29 +942,39 @@ func serveUserUpdates(w http.ResponseWriter, r *http.Request) {
 	// handle a request with SW token
 	c := newContext(r)
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
-	user, ts, err := decodeSWToken(ah)
+	tok, err := decodeSWToken(ah)
 	if err != nil {
 		writeJSONError(c, w, http.StatusForbidden, err)
 		return
 	}
+	user := tok.user
 	c = context.WithValue(c, ctxKeyUser, user)
 
-	// fetch user data in parallel with dataChanges
+	// check revocation before any upstream requests are made on behalf of the user
+	pushInfo, err := getUserPushInfo(c, user)
+	if err != nil {
+		writeJSONError(c, w, errStatus(err), err)
+		return
+	}
+	// revocation time has a second precision, same as the tokens,
+	// so a token issued in the same second is revoked too
+	if !tok.issued.After(pushInfo.SWRevoked) {
+		writeJSONError(c, w, http.StatusForbidden, "decodeSWToken: token revoked")
+		return
+	}
+
+	// fetch user bookmarks in parallel with dataChanges
 	var (
 		bookmarks []string
-		pushInfo  *userPush
 		userErr   error
 	)
 	done := make(chan struct{})
 	go func() {
 		defer close(done)
-		if bookmarks, userErr = userSchedule(c, user); userErr != nil {
-			return
-		}
-		pushInfo, userErr = getUserPushInfo(c, user)
+		bookmarks, userErr = userSchedule(c, user)
 	}()
 
-	dc, err := getChangesSince(c, ts)
+	dc, err := getChangesSince(c, tok.since)
 	if err != nil {
 		writeJSONError(c, w, errStatus(err), err)
 		return
@@ -681,7 +982,7 @@ func serveUserUpdates(w http.ResponseWriter, r *http.Request) {
 
 	select {
 	case <-time.After(10 * time.Second):
-		errorf(c, "userSchedule/getUserPushInfo timed out")
+		errorf(c, "userSchedule timed out")
 		writeJSONError(c, w, http.StatusInternalServerError, "timeout")
 		return
 	case <-done:
@@ -694,9 +995,15 @@ func serveUserUpdates(w http.ResponseWriter, r *http.Request) {
 		writeJSONError(c, w, http.StatusInternalServerError, userErr)
 		return
 	}
-
 	filterUserChanges(dc, bookmarks, pushInfo.Pext)
-	dc.Token, err = encodeSWToken(user, dc.Updated.Add(1*time.Second))
+	if err := filterUserAnnouncements(c, dc, pushInfo, bookmarks); err != nil {
+		writeJSONError(c, w, errStatus(err), err)
+		return
+	}
+	// keep the original issue time so that the token eventually expires,
+	// but sign it with the current key
+	tok.since = dc.Updated.Add(1 * time.Second)
+	dc.Token, err = tok.encode()
 	if err != nil {
 		writeJSONError(c, w, http.StatusInternalServerError, err)
 	}
@@ -705,7 +1012,7 @@ func serveUserUpdates(w http.ResponseWriter, r *http.Request) {
 		logsess = append(logsess, k)
 	}
 	logf(c, "sending %d updated sessions to user %s: %s", len(logsess), user, strings.Join(logsess, ", "))
-	if err := json.NewEncoder(w).Encode(dc); err != nil {
+	if err := writeChanges(w, r, dc); err != nil {
 		errorf(c, "serveUserUpdates: encode resp: %v", err)
 	}
 }
@@ -714,7 +1021,7 @@ func serveUserUpdates(w http.ResponseWriter, r *http.Request) {
 // in subsequent serveUserUpdates requests.
 func serveSWToken(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
-	c, err := authUser(newContext(r), r.Header.Get("authorization"))
+	c, err := authRequest(newContext(r), w, r)
 	if err != nil {
 		writeJSONError(c, w, errStatus(err), err)
 		return
@@ -727,14 +1034,49 @@ func serveSWToken(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	dc := &dataChanges{Token: token, Updated: now}
-	if err := json.NewEncoder(w).Encode(dc); err != nil {
+	if err := writeChanges(w, r, dc); err != nil {
 		errorf(c, "serveSWToke: encode resp: %v", err)
 	}
 }
 
+// writeChanges encodes dc into w as JSON, or protobuf if the client of r asked for it.
+func writeChanges(w http.ResponseWriter, r *http.Request, dc *dataChanges) error {
+	w.Header().Add("Vary", "Accept")
+	if !acceptsProto(r) {
+		return json.NewEncoder(w).Encode(dc)
+	}
+	w.Header().Set("Content-Type", protoContentType)
+	_, err := w.Write(dc.marshalProto())
+	return err
+}
+
+// revokeSWTokens invalidates all SW tokens issued to the user so far.
+// The client must request a new token with an OAuth 2 bearer token afterwards.
+func revokeSWTokens(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	c, err := authRequest(newContext(r), w, r)
+	if err != nil {
+		writeJSONError(c, w, errStatus(err), err)
+		return
+	}
+	err = runInTransaction(c, func(c context.Context) error {
+		pi, err := getUserPushInfo(c, contextUser(c))
+		if err != nil {
+			return err
+		}
+		pi.SWRevoked = time.Now().Truncate(time.Second)
+		return storeUserPushInfo(c, pi)
+	})
+	if err != nil {
+		writeJSONError(c, w, errStatus(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
 // handleUserSurvey is the entry point for /api/v1/user/survey
 func handleUserSurvey(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "GET" {
+	if r.Method == "GET" || r.Method == "HEAD" {
 		serveUserSurvey(w, r)
 		return
 	}
@@ -745,7 +1087,7 @@ func handleUserSurvey(w http.ResponseWriter, r *http.Request) {
 // a user has already submitted feedback for.
 func serveUserSurvey(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
-	c, err := authUser(newContext(r), r.Header.Get("authorization"))
+	c, err := authRequest(newContext(r), w, r)
 	if err != nil {
 		writeJSONError(c, w, errStatus(err), err)
 		return
@@ -770,7 +1112,7 @@ func serveUserSurvey(w http.ResponseWriter, r *http.Request) {
 // submitUserSurvey submits survey responses for a specific session or a batch.
 func submitUserSurvey(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
-	c, err := authUser(newContext(r), r.Header.Get("authorization"))
+	c, err := authRequest(newContext(r), w, r)
 	if err != nil {
 		writeJSONError(c, w, errStatus(err), err)
 		return
@@ -786,7 +1128,12 @@ func submitUserSurvey(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sid := path.Base(r.URL.Path)
+	sid := pathParam(r, "/api/v1/user/survey/")
+	c = withLogField(c, "sessions", []string{sid})
+	if sid == "" {
+		writeJSONError(c, w, http.StatusNotFound, "no session ID")
+		return
+	}
 	if isDev() {
 		w.Write([]byte(`["` + sid + `"]`))
 		return
@@ -831,7 +1178,14 @@ func submitUserSurvey(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(data)
 }
 
-// TODO: add ioext params
+// handleNotifySubscribers schedules a /task/ping-user for each user
+// with notifications enabled.
+//
+// Users are processed in batches of notifyBatchSize, one batch per task.
+// Each task schedules the next batch only after the current one succeeded,
+// using a datastore cursor passed in "cursor" param.
+// All tasks of a single broadcast share the same "id" param, which is used
+// to name the tasks so that retries never ping a user twice.
 func handleNotifySubscribers(w http.ResponseWriter, r *http.Request) {
 	c := newContext(r)
 	retry, err := taskRetryCount(r)
@@ -842,25 +1196,69 @@ func handleNotifySubscribers(w http.ResponseWriter, r *http.Request) {
 
 	all := r.FormValue("all") == "true"
 	sessions := strings.Split(r.FormValue("sessions"), " ")
-	if len(sessions) == 0 && !all {
+	c = withLogField(c, "broadcast", r.FormValue("id"))
+	var (
+		ioext    []*extEntry
+		announce []*announcement
+	)
+	if err := decodeTaskValue(r, "ioext", &ioext); err != nil {
+		errorf(c, "handleNotifySubscribers: %v", err)
+		return
+	}
+	if err := decodeTaskValue(r, "announce", &announce); err != nil {
+		errorf(c, "handleNotifySubscribers: %v", err)
+		return
+	}
+	if len(sessions) == 0 && len(ioext) == 0 && len(announce) == 0 && !all {
 		logf(c, "handleNotifySubscribers: empty sessions list; won't notify")
 		return
 	}
 
-	users, err := listUsersWithPush(c)
+	id := r.FormValue("id")
+	if id == "" {
+		errorf(c, "handleNotifySubscribers: missing broadcast id")
+		return
+	}
+	batch, _ := strconv.Atoi(r.FormValue("batch"))
+
+	users, next, err := listUsersWithPushBatch(c, r.FormValue("cursor"), notifyBatchSize)
 	if err != nil {
 		errorf(c, "handleNotifySubscribers: %v", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	logf(c, "found %d users with notifications enabled", len(users))
-	for _, id := range users {
-		if err := pingUserAsync(c, id, sessions, all); err != nil {
-			errorf(c, "handleNotifySubscribers: %v", err)
-			// TODO: handle this error case
+	params := url.Values{}
+	for _, k := range []string{"sessions", "ioext", "announce", "all"} {
+		if v, ok := r.Form[k]; ok {
+			params[k] = v
 		}
 	}
+	if failed, err := pingUsersAsync(c, id, users, params); err != nil {
+		// retry the whole batch; tasks added earlier won't be added again
+		errorf(c, "handleNotifySubscribers: %d of %d users failed: %v", len(failed), len(users), err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	b, err := recordBroadcastBatch(c, id, batch, len(users), next == "")
+	if err != nil {
+		// progress is informational; don't ping the batch again
+		errorf(c, "handleNotifySubscribers: %v", err)
+	} else {
+		logf(c, "broadcast %s: batch %d done, %d users so far", id, batch, b.Users)
+	}
+	if next == "" {
+		return
+	}
+
+	params.Set("id", id)
+	params.Set("cursor", next)
+	params.Set("batch", strconv.Itoa(batch+1))
+	if err := notifySubscribersNextAsync(c, params); err != nil {
+		errorf(c, "handleNotifySubscribers: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
 }
 
 // handlePingUser schedules a GCM "ping" to user devices based on certain conditions.
@@ -874,10 +1272,23 @@ func handlePingUser(w http.ResponseWriter, r *http.Request) {
 
 	user := r.FormValue("uid")
 	all := r.FormValue("all") == "true"
-	// TODO: add ioext conditions
 	sessions := strings.Split(r.FormValue("sessions"), " ")
 	sort.Strings(sessions)
-	if user == "" || (len(sessions) == 0 && !all) {
+	c = withLogField(c, "user", user)
+	c = withLogField(c, "sessions", sessions)
+	var (
+		ioext    []*extEntry
+		announce []*announcement
+	)
+	if err := decodeTaskValue(r, "ioext", &ioext); err != nil {
+		errorf(c, "handlePingUser: %v", err)
+		return
+	}
+	if err := decodeTaskValue(r, "announce", &announce); err != nil {
+		errorf(c, "handlePingUser: %v", err)
+		return
+	}
+	if user == "" || (len(sessions) == 0 && len(ioext) == 0 && len(announce) == 0 && !all) {
 		errorf(c, "invalid params user = %q; session = %v; all = %v", user, sessions, all)
 		return
 	}
@@ -907,8 +1318,14 @@ func handlePingUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	matched := all
-	if !all {
+	matched := all || len(nearbyIOExtEntries(ioext, pi.Pext)) > 0
+	for _, a := range announce {
+		// session tag targets need user bookmarks, checked below
+		if !matched && !a.isTagTarget() {
+			matched = a.targetsUser(pi, nil, nil)
+		}
+	}
+	if !matched {
 		bookmarks, err := userSchedule(c, user)
 		if ue, ok := err.(*url.Error); ok && (ue.Err == errAuthInvalid || ue.Err == errAuthMissing) {
 			errorf(c, "unrecoverable: %v", err)
@@ -925,6 +1342,15 @@ func handlePingUser(w http.ResponseWriter, r *http.Request) {
 				break
 			}
 		}
+		if !matched && len(announce) > 0 {
+			list, err := userAnnouncements(c, announce, pi, bookmarks)
+			if err != nil {
+				errorf(c, "%v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			matched = len(list) > 0
+		}
 	}
 
 	if !matched {
@@ -932,20 +1358,38 @@ func handlePingUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// respect quiet hours and pings budget
+	slot, err := reservePing(c, pi, time.Now())
+	if err != nil {
+		errorf(c, "reservePing: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if slot == nil {
+		logf(c, "a ping is already scheduled; coalescing")
+		return
+	}
+	if slot.delay > 0 {
+		logf(c, "delaying ping by %s", slot.delay)
+	}
+
 	// retry scheduling of /task/ping-device n times in case of errors,
 	// pausing i seconds on each iteration where i ranges from 0 to n.
 	// currently this will total to about 15sec latency in the worst successful case.
 	nr := 5
 	endpoints := pi.Endpoints
 	for i := 0; i < nr+1; i++ {
-		endpoints, err = pingDevicesAsync(c, user, endpoints, 0)
+		endpoints, err = pingDevicesAsync(c, user, endpoints, slot.delay)
 		if err == nil {
-			break
+			return
 		}
 		errorf(c, "couldn't schedule ping for %d of %d devices; retry = %d/%d",
 			len(endpoints), len(pi.Endpoints), i, nr)
 		time.Sleep(time.Duration(i) * time.Second)
 	}
+	// let the task retry ping all devices as if this one never happened
+	slot.release(c)
+	w.WriteHeader(http.StatusInternalServerError)
 }
 
 // handlePingDevices handles a request to notify a single user device.
@@ -959,6 +1403,7 @@ func handlePingDevice(w http.ResponseWriter, r *http.Request) {
 
 	uid := r.FormValue("uid")
 	endpoint := r.FormValue("endpoint")
+	c = withLogField(c, "user", uid)
 	if uid == "" || endpoint == "" {
 		errorf(c, "invalid params: uid = %q; endpoint = %q", uid, endpoint)
 		return
@@ -1073,7 +1518,9 @@ func handleClock(w http.ResponseWriter, r *http.Request) {
 	upsurvey := upcomingSurveys(now, sessions)
 	allsess := append(upsess, upsurvey...)
 
+	var dc *dataChanges
 	terr := runInTransaction(c, func(c context.Context) error {
+		dc = nil // in case of a retry
 		allsess, err = filterNextSessions(c, allsess)
 		if err != nil {
 			return err
@@ -1082,7 +1529,7 @@ func handleClock(w http.ResponseWriter, r *http.Request) {
 			return nil
 		}
 		logf(c, "found %d upcoming sessions and %d surveys", len(upsess), len(upsurvey))
-		dc := &dataChanges{
+		dc = &dataChanges{
 			Updated:   now,
 			eventData: eventData{Sessions: make(map[string]*eventSession, len(allsess))},
 		}
@@ -1099,6 +1546,12 @@ func handleClock(w http.ResponseWriter, r *http.Request) {
 	})
 	if terr != nil {
 		errorf(c, "txn err: %v", terr)
+	} else {
+		publishChanges(c, dc)
+	}
+
+	if err := sendDueAnnouncements(c, now); err != nil {
+		errorf(c, "sendDueAnnouncements: %v", err)
 	}
 }
 
@@ -1142,6 +1595,22 @@ func serveEasterEgg(w http.ResponseWriter, r *http.Request) {
 func handleAdmin(w http.ResponseWriter, r *http.Request) {
 	c := newContext(r)
 
+	switch strings.TrimPrefix(r.URL.Path, "/admin/") {
+	case "announce/preview":
+		serveAnnouncePreview(w, r)
+		return
+	case "announce":
+		if r.Method == "POST" {
+			createAnnouncement(w, r)
+			return
+		}
+	case "refresh":
+		if r.Method == "POST" {
+			refreshFeeds(w, r)
+			return
+		}
+	}
+
 	if r.Method == "GET" {
 		w.Header().Set("Content-Type", "text/html;charset=utf-8")
 		tfile := "home"
@@ -1150,16 +1619,113 @@ func handleAdmin(w http.ResponseWriter, r *http.Request) {
 		}
 		t, err := template.ParseFiles(filepath.Join(config.Dir, templatesDir, "admin", tfile+".html"))
 		if err != nil {
-			writeError(w, err)
+			writeJSONError(c, w, errStatus(err), err)
 			return
 		}
-		if err := t.Execute(w, nil); err != nil {
+		var data interface{}
+		if tfile == "announce" {
+			if data, err = listAnnouncements(c, 50); err != nil {
+				writeJSONError(c, w, errStatus(err), err)
+				return
+			}
+		}
+		if err := t.Execute(w, data); err != nil {
 			errorf(c, "handleAdmin: %v", err)
 		}
 		return
 	}
 }
 
+// refreshFeeds fetches social and I/O Extended entries from upstream,
+// bypassing and replacing their cached copies.
+// It responds with the number of fetched entries of each feed.
+func refreshFeeds(w http.ResponseWriter, r *http.Request) {
+	c := newContext(r)
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	if !isJSONRequest(r) {
+		writeJSONError(c, w, http.StatusUnsupportedMediaType, "content type must be application/json")
+		return
+	}
+	soc, err := socialEntries(c, true)
+	if err != nil {
+		writeJSONError(c, w, http.StatusInternalServerError, err)
+		return
+	}
+	ext, err := ioExtEntries(c, true)
+	if err != nil {
+		writeJSONError(c, w, http.StatusInternalServerError, err)
+		return
+	}
+	fmt.Fprintf(w, `{"social": %d, "extended": %d}`, len(soc), len(ext))
+}
+
+// createAnnouncement stores a new announcement from the request r payload
+// and sends it right away unless scheduled for later.
+// It responds with the stored announcement.
+func createAnnouncement(w http.ResponseWriter, r *http.Request) {
+	c := newContext(r)
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	if !isJSONRequest(r) {
+		writeJSONError(c, w, http.StatusUnsupportedMediaType, "content type must be application/json")
+		return
+	}
+	a := &announcement{}
+	if err := json.NewDecoder(r.Body).Decode(a); err != nil {
+		writeJSONError(c, w, http.StatusBadRequest, err)
+		return
+	}
+	if !a.valid() {
+		writeJSONError(c, w, http.StatusBadRequest, "title and body are required")
+		return
+	}
+	if err := validateTarget(c, a); err != nil {
+		writeJSONError(c, w, errStatus(err), err)
+		return
+	}
+	a.ID = ""
+	a.Sent = false
+	now := time.Now()
+	if a.SendAt.IsZero() {
+		a.SendAt = now
+	}
+	if err := storeAnnouncement(c, a); err != nil {
+		writeJSONError(c, w, errStatus(err), err)
+		return
+	}
+	if !a.SendAt.After(now) {
+		if err := sendAnnouncement(c, a.ID); err != nil {
+			writeJSONError(c, w, errStatus(err), err)
+			return
+		}
+		a.Sent = true
+	}
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(a); err != nil {
+		errorf(c, "createAnnouncement: %v", err)
+	}
+}
+
+// isJSONRequest reports whether r payload is of application/json content type.
+// Cross-site HTML forms can't send such requests, so admin POST handlers,
+// authenticated with cookies only, require it to prevent CSRF.
+func isJSONRequest(r *http.Request) bool {
+	t, _, err := mime.ParseMediaType(r.Header.Get("content-type"))
+	return err == nil && t == "application/json"
+}
+
+// serveAnnouncePreview responds with the number of users
+// an announcement with target r.FormValue("target") would reach.
+func serveAnnouncePreview(w http.ResponseWriter, r *http.Request) {
+	c := newContext(r)
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	n, exact, err := announcementRecipients(c, r.FormValue("target"))
+	if err != nil {
+		writeJSONError(c, w, errStatus(err), err)
+		return
+	}
+	fmt.Fprintf(w, `{"recipients": %d, "exact": %v}`, n, exact)
+}
+
 // debugGetURL fetches a URL with service account credentials.
 // Should not be available on prod.
 func debugServiceGetURL(w http.ResponseWriter, r *http.Request) {
@@ -1201,7 +1767,7 @@ func debugPush(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html;charset=utf-8")
 		t, err := template.ParseFiles(filepath.Join(config.Dir, templatesDir, "debug", "push.html"))
 		if err != nil {
-			writeError(w, err)
+			writeJSONError(c, w, errStatus(err), err)
 			return
 		}
 		if err := t.Execute(w, nil); err != nil {
@@ -1237,7 +1803,9 @@ func debugPush(w http.ResponseWriter, r *http.Request) {
 
 	if err := runInTransaction(c, fn); err != nil {
 		writeJSONError(c, w, http.StatusInternalServerError, err)
+		return
 	}
+	publishChanges(c, dc)
 }
 
 // debugSync updates locally stored EventData with staging or prod data.
@@ -1249,7 +1817,7 @@ func debugSync(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html;charset=utf-8")
 		t, err := template.ParseFiles(filepath.Join(config.Dir, templatesDir, "debug", "sync.html"))
 		if err != nil {
-			writeError(w, err)
+			writeJSONError(c, w, errStatus(err), err)
 			return
 		}
 		data := struct {
@@ -1270,49 +1838,43 @@ func debugSync(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := clearEventData(c); err != nil {
-		writeError(w, err)
+		writeJSONError(c, w, errStatus(err), err)
 	}
 }
 
-// writeJSONError sets response code to 500 and writes an error message to w.
-// If err is *apiError, code is overwritten by err.code.
-// TODO: remove code from the args and use only apiError.
+// writeJSONError writes err to w as a JSON object:
+//
+//     {"error": "message", "code": "not_found", "details": {...}, "requestId": "..."}
+//
+// where code is one of errCode consts; details and requestId are optional.
+// Response status is the code arg unless err is an *apiError or one of knownErrors,
+// see toAPIError. Messages of internal errors are not sent in prod.
+// It replaces Content-Type set by the caller, e.g. for an HTML or XML response.
 func writeJSONError(c context.Context, w http.ResponseWriter, code int, err interface{}) {
 	errorf(c, "%v", err)
-	if aerr, ok := err.(*apiError); ok {
-		code = aerr.code
+	ae := toAPIError(code, err)
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	body := struct {
+		Error     string                 `json:"error"`
+		Code      string                 `json:"code"`
+		Details   map[string]interface{} `json:"details,omitempty"`
+		RequestID string                 `json:"requestId,omitempty"`
+	}{ae.Error(), ae.ecode, ae.details, requestID(c)}
+	if ae.code >= 500 && isProd() {
+		body.Error = http.StatusText(ae.code)
+		body.Details = nil
+	}
+	w.WriteHeader(ae.code)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		errorf(c, "writeJSONError: %v", err)
 	}
-	w.WriteHeader(code)
-	fmt.Fprintf(w, `{"error": %q}`, err)
-}
-
-// writeError writes error to w as is, using errStatus() status code.
-func writeError(w http.ResponseWriter, err error) {
-	w.WriteHeader(errStatus(err))
-	w.Write([]byte(err.Error()))
 }
 
-// errStatus converts some known errors of this package into the corresponding
-// HTTP response status code.
+// errStatus converts *apiError and known errors of this package, see knownErrors,
+// into the corresponding HTTP response status code.
 // Defaults to 500 Internal Server Error.
 func errStatus(err error) int {
-	if aerr, ok := err.(*apiError); ok {
-		return aerr.code
-	}
-	switch err {
-	case errAuthMissing:
-		return http.StatusUnauthorized
-	case errAuthInvalid:
-		return http.StatusForbidden
-	case errAuthTokenType:
-		return 498
-	case errBadData:
-		return http.StatusBadRequest
-	case errNotFound:
-		return http.StatusNotFound
-	default:
-		return http.StatusInternalServerError
-	}
+	return toAPIError(http.StatusInternalServerError, err).code
 }
 
 // taskRetryCount returns the number times the task has been retried.
@@ -1324,9 +1886,30 @@ func taskRetryCount(r *http.Request) (int, error) {
 	return n - 1, nil
 }
 
+// decodeTaskValue decodes JSON-encoded form value of a task request r
+// under the key name into v. It leaves v unmodified if the value is empty.
+func decodeTaskValue(r *http.Request, name string, v interface{}) error {
+	s := r.FormValue(name)
+	if s == "" {
+		return nil
+	}
+	if err := json.Unmarshal([]byte(s), v); err != nil {
+		return fmt.Errorf("decodeTaskValue(%q): %v", name, err)
+	}
+	return nil
+}
+
+// apiSchedule is /api/v1/schedule response format.
+type apiSchedule struct {
+	Sessions []*eventSession          `json:"sessions,omitempty"`
+	Videos   []*eventVideo            `json:"video_library,omitempty"`
+	Speakers map[string]*eventSpeaker `json:"speakers,omitempty"`
+	Tags     map[string]*eventTag     `json:"tags,omitempty"`
+}
+
 // toAPISchedule converts eventData to /api/v1/schedule response format.
 // Original d elements may be modified.
-func toAPISchedule(d *eventData) interface{} {
+func toAPISchedule(d *eventData) *apiSchedule {
 	sessions := make([]*eventSession, 0, len(d.Sessions))
 	for _, s := range d.Sessions {
 		sessions = append(sessions, s)
@@ -1340,12 +1923,7 @@ func toAPISchedule(d *eventData) interface{} {
 		videos = append(videos, v)
 	}
 	sort.Sort(sortedVideosList(videos))
-	return &struct {
-		Sessions []*eventSession          `json:"sessions,omitempty"`
-		Videos   []*eventVideo            `json:"video_library,omitempty"`
-		Speakers map[string]*eventSpeaker `json:"speakers,omitempty"`
-		Tags     map[string]*eventTag     `json:"tags,omitempty"`
-	}{
+	return &apiSchedule{
 		Sessions: sessions,
 		Videos:   videos,
 		Speakers: d.Speakers,
@@ -1369,14 +1947,8 @@ func canonicalURL(r *http.Request, q url.Values) string {
 		p += "/"
 	}
 
-	u := &url.URL{
-		Scheme: "https",
-		Host:   r.Host,
-		Path:   p,
-	}
-	if r.TLS == nil {
-		u.Scheme = "http"
-	}
+	u := baseURL(r)
+	u.Path = p
 	if q != nil {
 		u.RawQuery = q.Encode()
 	}
@@ -1387,9 +1959,28 @@ func canonicalURL(r *http.Request, q url.Values) string {
 // See below for specific keys.
 type ctxKey int
 
-const ctxKeyUser ctxKey = iota
+const (
+	ctxKeyUser ctxKey = iota
+	ctxKeyRequestID
+	ctxKeyLogFields
+	ctxKeyEmail
+	ctxKeyHostedDomain
+)
 
 func contextUser(c context.Context) string {
 	user, _ := c.Value(ctxKeyUser).(string)
 	return user
 }
+
+// contextEmail returns verified email of the user authenticated with an ID token.
+// It is empty for other authentication methods or unverified emails.
+func contextEmail(c context.Context) string {
+	email, _ := c.Value(ctxKeyEmail).(string)
+	return email
+}
+
+// contextHostedDomain returns G Suite domain of the user authenticated with an ID token.
+func contextHostedDomain(c context.Context) string {
+	hd, _ := c.Value(ctxKeyHostedDomain).(string)
+	return hd
+}
@@ -27,6 +27,7 @@ import (
 	"reflect"
 	"sort"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -156,6 +157,78 @@ func TestServeSchedule(t *testing.T) {
 	}
 }
 
+func TestServeScheduleDelta(t *testing.T) {
+	defer resetTestState(t)
+	defer preserveConfig()()
+	config.Env = "prod"
+	c := newContext(newTestRequest(t, "GET", "/dummy", nil))
+	defer clearEventData(c)
+
+	if err := storeEventData(c, &eventData{
+		modified: time.Now().Add(-time.Hour),
+		Sessions: map[string]*eventSession{
+			"one": &eventSession{Id: "one", Title: "One"},
+			"two": &eventSession{Id: "two", Title: "Two"},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	old, err := getLatestEventData(c, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storeEventData(c, &eventData{
+		modified: time.Now(),
+		Sessions: map[string]*eventSession{
+			"one": &eventSession{Id: "one", Title: "One"},
+			"two": &eventSession{Id: "two", Title: "Two updated"},
+		},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	table := []struct {
+		etag  string
+		delta bool
+	}{
+		{old.etag, true},
+		{"gone", false},
+	}
+	for i, test := range table {
+		r := newTestRequest(t, "GET", "/api/v1/schedule?delta=true", nil)
+		r.Header.Set("if-none-match", `"`+test.etag+`"`)
+		w := httptest.NewRecorder()
+		serveSchedule(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("%d: w.Code = %d; want 200", i, w.Code)
+		}
+		// a delta depends on the client version and must not be reused for other clients
+		if v := strings.Join(w.Header()["Vary"], ", "); !strings.Contains(v, "If-None-Match") {
+			t.Errorf("%d: vary = %q; want If-None-Match", i, v)
+		}
+		base := w.Header().Get("delta-base")
+		if !test.delta {
+			if base != "" {
+				t.Errorf("%d: delta-base = %q; want empty", i, base)
+			}
+			continue
+		}
+		if base != `"`+test.etag+`"` {
+			t.Errorf("%d: delta-base = %q; want %q", i, base, `"`+test.etag+`"`)
+		}
+		if v := w.Header().Get("cache-control"); v != "private, no-store" {
+			t.Errorf("%d: cache-control = %q; want 'private, no-store'", i, v)
+		}
+		dc := &dataChanges{}
+		if err := json.Unmarshal(w.Body.Bytes(), dc); err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if len(dc.Sessions) != 1 || dc.Sessions["two"] == nil {
+			t.Errorf("%d: dc.Sessions = %+v; want only 'two'", i, dc.Sessions)
+		}
+	}
+}
+
 func TestServeTemplate(t *testing.T) {
 	defer resetTestState(t)
 	defer preserveConfig()()
@@ -1430,6 +1503,48 @@ func TestStoreUserPushConfigV2(t *testing.T) {
 	}
 }
 
+func TestStoreUserPushQuietHours(t *testing.T) {
+	if !isGAEtest {
+		t.Skipf("not implemented yet; isGAEtest = %v", isGAEtest)
+	}
+	defer resetTestState(t)
+
+	table := []struct {
+		body    string
+		code    int
+		enabled bool
+		off     bool
+	}{
+		{`{"quiet": {"start": "22:00", "end": "07:00"}}`, http.StatusOK, true, false},
+		{`{"quiet": null}`, http.StatusOK, false, true},
+		{`{"quiet": {}}`, http.StatusOK, false, false},
+		{`{"quiet": {"start": "25:00", "end": "07:00"}}`, http.StatusBadRequest, false, false},
+		{`{"quiet": "22:00"}`, http.StatusBadRequest, false, false},
+		{`{"quiet": false}`, http.StatusBadRequest, false, false},
+	}
+	for i, test := range table {
+		resetTestState(t)
+		r := newTestRequest(t, "PUT", "/api/v1/user/notify", strings.NewReader(test.body))
+		r.Header.Set("Authorization", "Bearer "+testIDToken)
+		w := httptest.NewRecorder()
+		handleUserNotifySettings(w, r)
+		if w.Code != test.code {
+			t.Errorf("%d: w.Code = %d; want %d\nResponse: %s", i, w.Code, test.code, w.Body.String())
+		}
+		if test.code != http.StatusOK {
+			continue
+		}
+		pi, err := getUserPushInfo(newContext(r), testUserID)
+		if err != nil {
+			t.Errorf("%d: getUserPushInfo: %v", i, err)
+			continue
+		}
+		if pi.Quiet.Enabled != test.enabled || pi.Quiet.Off != test.off {
+			t.Errorf("%d: pi.Quiet = %+v; want Enabled = %v, Off = %v", i, pi.Quiet, test.enabled, test.off)
+		}
+	}
+}
+
 func TestFirstSyncEventData(t *testing.T) {
 	if !isGAEtest {
 		t.Skipf("not implemented yet; isGAEtest = %v", isGAEtest)
@@ -1812,10 +1927,11 @@ func TestServeSWToken(t *testing.T) {
 		t.Fatalf("json.Unmarshal(%q): %v", w.Body.String(), err)
 	}
 
-	user, ts, err := decodeSWToken(body.Token)
+	tok, err := decodeSWToken(body.Token)
 	if err != nil {
 		t.Fatalf("decodeSWToken(%q): %v", body.Token, err)
 	}
+	user, ts := tok.user, tok.since
 	if user != testUserID {
 		t.Errorf("user = %q; want %q", user, testUserID)
 	}
@@ -1865,10 +1981,11 @@ func TestServeUserUpdates(t *testing.T) {
 	}
 
 	swToken := fetchFirstSWToken(t, testIDToken)
-	_, swTime, err := decodeSWToken(swToken)
+	swTok, err := decodeSWToken(swToken)
 	if err != nil {
 		t.Fatal(err)
 	}
+	swTime := swTok.since
 	timeBefore, timeAfter := swTime.AddDate(0, 0, -1), swTime.AddDate(0, 0, 1)
 	swTokenBefore, _ := encodeSWToken(testUserID, timeBefore.Add(-1*time.Second))
 	swTokenAfter, _ := encodeSWToken(testUserID, timeAfter)
@@ -1937,10 +2054,11 @@ func TestServeUserUpdates(t *testing.T) {
 				t.Errorf("%d: res.Sessions[%q].Update = %q; want %q", i, id, s.Update, updateDetails)
 			}
 		}
-		user, next, err := decodeSWToken(res.Token)
+		tok, err := decodeSWToken(res.Token)
 		if err != nil {
-			t.Errorf("%d: decodeSWToken(%q): %v", i, res.Token, err)
+			t.Fatalf("%d: decodeSWToken(%q): %v", i, res.Token, err)
 		}
+		user, next := tok.user, tok.since
 		if user != testUserID {
 			t.Errorf("%d: user = %q; want %q", i, user, testUserID)
 		}
@@ -1950,6 +2068,45 @@ func TestServeUserUpdates(t *testing.T) {
 	}
 }
 
+func TestServeUserUpdatesRevoked(t *testing.T) {
+	if !isGAEtest {
+		t.Skipf("not implemented yet; isGAEtest = %v", isGAEtest)
+	}
+	defer resetTestState(t)
+	defer preserveConfig()()
+
+	var upstream int32
+	gdrive := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&upstream, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer gdrive.Close()
+	config.Google.Drive.FilesURL = gdrive.URL + "/list"
+
+	c := newContext(newTestRequest(t, "GET", "/dummy", nil))
+	revoked := time.Now().Truncate(time.Second)
+	if err := storeUserPushInfo(c, &userPush{userID: testUserID, SWRevoked: revoked}); err != nil {
+		t.Fatal(err)
+	}
+	// issued earlier in the same second as the revocation
+	tok := &swToken{user: testUserID, since: revoked, issued: revoked}
+	token, err := tok.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := newTestRequest(t, "GET", "/api/v1/user/updates", nil)
+	r.Header.Set("authorization", token)
+	w := httptest.NewRecorder()
+	serveUserUpdates(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("w.Code = %d; want 403\nResponse: %s", w.Code, w.Body.String())
+	}
+	if n := atomic.LoadInt32(&upstream); n != 0 {
+		t.Errorf("upstream requests = %d; want 0", n)
+	}
+}
+
 func TestHandlePingExt(t *testing.T) {
 	defer resetTestState(t)
 	defer preserveConfig()()
@@ -2666,3 +2823,42 @@ func compareStringSlices(a, b []string) bool {
 	sort.Strings(b)
 	return reflect.DeepEqual(a, b)
 }
+
+func TestAllowRefresh(t *testing.T) {
+	defer func(fn func(*http.Request) bool) { isAdminRequest = fn }(isAdminRequest)
+	table := []struct {
+		header, value string
+		admin         bool
+		allow         bool
+	}{
+		{"", "", false, false},
+		// X-Appengine headers are trusted only on GAE
+		{"x-appengine-cron", "true", false, isGAEtest},
+		{"x-appengine-taskname", "task-1", false, isGAEtest},
+		{"x-appengine-cron", "false", false, false},
+		{"", "", true, true},
+	}
+	for i, test := range table {
+		r := newTestRequest(t, "GET", "/api/v1/social?refresh", nil)
+		if test.header != "" {
+			r.Header.Set(test.header, test.value)
+		}
+		admin := test.admin
+		isAdminRequest = func(*http.Request) bool { return admin }
+		if v := allowRefresh(r); v != test.allow {
+			t.Errorf("%d: allowRefresh = %v; want %v", i, v, test.allow)
+		}
+	}
+}
+
+func TestRefreshFeedsContentType(t *testing.T) {
+	for _, ctype := range []string{"", "text/plain", "multipart/form-data"} {
+		r := newTestRequest(t, "POST", "/admin/refresh", nil)
+		r.Header.Set("content-type", ctype)
+		w := httptest.NewRecorder()
+		refreshFeeds(w, r)
+		if w.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("%q: w.Code = %d; want %d", ctype, w.Code, http.StatusUnsupportedMediaType)
+		}
+	}
+}
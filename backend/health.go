@@ -0,0 +1,192 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// readyCheck is a named check of a dependency state, see serveReadiness.
+type readyCheck struct {
+	name string
+	fn   func(c context.Context) error
+}
+
+// readyWarning is an error of a readyCheck which is reported
+// but doesn't make the server unready, e.g. stale data which can still be served.
+type readyWarning string
+
+func (w readyWarning) Error() string {
+	return string(w)
+}
+
+var (
+	// readyChecks are run by serveReadiness.
+	readyChecks = []readyCheck{
+		{"config", checkConfig},
+		{"templates", checkTemplates},
+		{"cache", checkCache},
+	}
+	// dataReadyChecks need a datastore, which only GAE server has.
+	// It appends them to readyChecks.
+	dataReadyChecks = []readyCheck{
+		{"datastore", pingDatastore},
+		{"eventdata", checkEventData},
+	}
+	// readyTemplates are parsed by checkTemplates.
+	readyTemplates = []string{"home", "error_404", "error_500"}
+)
+
+// serveHealth responds with 200 OK as long as the process is alive.
+func serveHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(`{"status": "ok"}`))
+}
+
+// serveReadiness runs all readyChecks and responds with their results:
+//
+//     {"status": "ok", "checks": {"cache": {"status": "ok", "latency": 0.001}, ...}}
+//
+// Response status code is 503 Service Unavailable if any of the checks fails.
+// Checks which return a readyWarning have "warn" status, as does the response
+// if there are no failures, but the status code is 200 OK.
+// In prod, error details are included only for admins and metrics scrapers,
+// see allowMetrics.
+func serveReadiness(w http.ResponseWriter, r *http.Request) {
+	c := newContext(r)
+	type result struct {
+		Status  string  `json:"status"`
+		Error   string  `json:"error,omitempty"`
+		Latency float64 `json:"latency"`
+	}
+	res := struct {
+		Status string             `json:"status"`
+		Checks map[string]*result `json:"checks"`
+	}{"ok", make(map[string]*result)}
+
+	details := !isProd() || allowMetrics(r)
+	for _, check := range readyChecks {
+		start := time.Now()
+		err := check.fn(c)
+		cr := &result{Status: "ok", Latency: time.Since(start).Seconds()}
+		if _, ok := err.(readyWarning); ok {
+			errorf(c, "serveReadiness: %s: %v", check.name, err)
+			if res.Status == "ok" {
+				res.Status = "warn"
+			}
+			cr.Status = "warn"
+		} else if err != nil {
+			errorf(c, "serveReadiness: %s: %v", check.name, err)
+			res.Status = "fail"
+			cr.Status = "fail"
+		}
+		if err != nil && details {
+			cr.Error = err.Error()
+		}
+		res.Checks[check.name] = cr
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	if res.Status == "fail" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		errorf(c, "serveReadiness: %v", err)
+	}
+}
+
+// checkConfig verifies the config has been loaded with initConfig.
+func checkConfig(c context.Context) error {
+	var missing []string
+	if config.Env == "" {
+		missing = append(missing, "env")
+	}
+	if config.Dir == "" {
+		missing = append(missing, "dir")
+	}
+	if config.Schedule.Location == nil {
+		missing = append(missing, "schedule.timezone")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// checkTemplates verifies readyTemplates can be parsed.
+func checkTemplates(c context.Context) error {
+	for _, name := range readyTemplates {
+		if _, err := parseTemplate(name, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkCache verifies a value put in the cache can be read back.
+func checkCache(c context.Context) error {
+	key := fmt.Sprintf("health:%d", time.Now().UnixNano())
+	val := []byte(key)
+	if err := cache.set(c, key, val, time.Minute); err != nil {
+		return err
+	}
+	defer cache.deleleMulti(c, []string{key})
+	b, err := cache.get(c, key)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(b, val) {
+		return errors.New("cache round-trip value mismatch")
+	}
+	return nil
+}
+
+// checkEventData verifies event data is present. If the last successful sync
+// happened more than config.Health.MaxDataAge ago, unless the latter is zero,
+// it results in a readyWarning: a stalled sync would otherwise make all instances
+// unready at once, though they can still serve the data.
+func checkEventData(c context.Context) error {
+	data, err := getLatestEventData(c, nil)
+	if err != nil {
+		return err
+	}
+	if data.modified.IsZero() {
+		return errors.New("no event data")
+	}
+	if config.Health.maxDataAge == 0 {
+		return nil
+	}
+	synced, err := getSyncTime(c)
+	if err == errNotFound {
+		return readyWarning("no successful sync yet")
+	}
+	if err != nil {
+		return err
+	}
+	if age := time.Since(synced); age > config.Health.maxDataAge {
+		return readyWarning(fmt.Sprintf("last successful sync was %s ago", age))
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestServeReadiness(t *testing.T) {
+	defer preserveConfig()()
+	defer func(checks []readyCheck) { readyChecks = checks }(readyChecks)
+
+	ok := func(context.Context) error { return nil }
+	fail := func(context.Context) error { return errors.New("db down") }
+	stale := func(context.Context) error { return readyWarning("data is old") }
+	table := []struct {
+		env    string
+		checks []readyCheck
+		code   int
+		status string
+		errmsg string
+	}{
+		{"dev", []readyCheck{{"a", ok}, {"b", ok}}, http.StatusOK, "ok", ""},
+		{"dev", []readyCheck{{"a", ok}, {"b", fail}}, http.StatusServiceUnavailable, "fail", "db down"},
+		{"prod", []readyCheck{{"a", ok}, {"b", fail}}, http.StatusServiceUnavailable, "fail", ""},
+		{"dev", []readyCheck{{"a", ok}, {"b", stale}}, http.StatusOK, "warn", "data is old"},
+		{"dev", []readyCheck{{"a", fail}, {"b", stale}}, http.StatusServiceUnavailable, "fail", "data is old"},
+	}
+	for i, test := range table {
+		config.Env = test.env
+		readyChecks = test.checks
+		w := httptest.NewRecorder()
+		serveReadiness(w, newTestRequest(t, "GET", "/readyz", nil))
+
+		if w.Code != test.code {
+			t.Errorf("%d: w.Code = %d; want %d", i, w.Code, test.code)
+		}
+		var res struct {
+			Status string
+			Checks map[string]struct{ Status, Error string }
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("%d: json.Unmarshal(%s): %v", i, w.Body.String(), err)
+		}
+		if res.Status != test.status {
+			t.Errorf("%d: res.Status = %q; want %q", i, res.Status, test.status)
+		}
+		if len(res.Checks) != len(test.checks) {
+			t.Errorf("%d: len(res.Checks) = %d; want %d", i, len(res.Checks), len(test.checks))
+		}
+		if v := res.Checks["b"].Error; v != test.errmsg {
+			t.Errorf("%d: res.Checks[b].Error = %q; want %q", i, v, test.errmsg)
+		}
+	}
+}
+
+func TestCheckEventData(t *testing.T) {
+	defer resetTestState(t)
+	defer preserveConfig()()
+	config.Health.maxDataAge = 24 * time.Hour
+	c := newContext(newTestRequest(t, "GET", "/readyz", nil))
+	defer clearEventData(c)
+
+	// the schedule hasn't been edited for a while
+	if err := storeEventData(c, &eventData{modified: time.Now().Add(-48 * time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	table := []struct {
+		synced time.Time
+		warn   bool
+	}{
+		{time.Now().Add(-48 * time.Hour), true},
+		{time.Now().Add(-time.Minute), false},
+	}
+	for i, test := range table {
+		if err := storeSyncTime(c, test.synced); err != nil {
+			t.Fatal(err)
+		}
+		err := checkEventData(c)
+		if _, warn := err.(readyWarning); warn != test.warn || (err != nil && !warn) {
+			t.Errorf("%d: checkEventData = %v; want warning = %v", i, err, test.warn)
+		}
+	}
+}
+
+func TestCheckCache(t *testing.T) {
+	defer resetTestState(t)
+	c := newContext(newTestRequest(t, "GET", "/readyz", nil))
+	if err := checkCache(c); err != nil {
+		t.Errorf("checkCache: %v", err)
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	defer preserveConfig()()
+	config.Env = ""
+	if err := checkConfig(nil); err == nil {
+		t.Errorf("checkConfig: nil error; want missing env")
+	}
+}
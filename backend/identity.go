@@ -0,0 +1,210 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// This file is used only when compiled without GAE support.
+// It replaces GAE Users API based access checks of server_gae.go.
+
+// +build !appengine
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// allow requests prefixed with passthruPrefixes to bypass checkWhitelist
+	passthruPrefixes = []string{
+		"/manifest.json",
+		signInPath,
+		"/sync",
+		"/api/v1/user",
+		"/api/v1/easter-egg",
+	}
+
+	// identify returns verified email of the user who made request r,
+	// or an empty string if the user is not signed in.
+	// It is a var so that a different identity provider can be plugged in.
+	identify = sessionEmail
+)
+
+// signInPath is the path of handleSignIn, relative to config.Prefix.
+const signInPath = "/auth/signin"
+
+// allowPassthrough returns true if the request r can be handled w/o whitelist check.
+// Unlike GAE, there are no Cron or Task Queue jobs.
+func allowPassthrough(r *http.Request) bool {
+	for _, p := range passthruPrefixes {
+		if strings.HasPrefix(r.URL.Path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkWhitelist checks whether the current user is allowed to access
+// handler h using isWhitelisted() func before handing over in-flight request.
+// It responds with the sign-in page if no user found or with 403
+// (Forbidden) HTTP error code if the current user is not whitelisted.
+func checkWhitelist(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if allowPassthrough(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		email := identifyRequest(r)
+		switch {
+		case email != "" && isWhitelisted(email):
+			h.ServeHTTP(w, r)
+		case email != "":
+			errorf(newContext(r), "%s is not whitelisted", email)
+			http.Error(w, "Access denied, sorry. Try with a different account.", http.StatusForbidden)
+		default:
+			serveSignIn(w, r)
+		}
+	})
+}
+
+// checkAdmin is similar to checkWhitelist with the following exceptions:
+//  - doesn't test allowPassthrough()
+//  - looks up user emails in config.Admins instead of config.Whitelist.
+func checkAdmin(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		email := identifyRequest(r)
+		switch {
+		case email != "" && isAdmin(email):
+			h.ServeHTTP(w, r)
+		case email != "":
+			errorf(newContext(r), "%s is not admin", email)
+			http.Error(w, "Admins only, sorry. Try with a different account.", http.StatusForbidden)
+		default:
+			serveSignIn(w, r)
+		}
+	})
+}
+
+// isStandaloneAdmin returns true if r is made by a signed in user
+// who is also in config.Admins.
+func isStandaloneAdmin(r *http.Request) bool {
+	email := identifyRequest(r)
+	return email != "" && isAdmin(email)
+}
+
+// identifyRequest returns identify(r) result, treating errors as anonymous users.
+func identifyRequest(r *http.Request) string {
+	email, err := identify(r)
+	if err != nil {
+		errorf(newContext(r), "identify: %v", err)
+		return ""
+	}
+	return email
+}
+
+// sessionEmail returns email of the user signed in with sessionCookie,
+// see handleSignIn. Invalid, expired and revoked sessions result in an error.
+func sessionEmail(r *http.Request) (string, error) {
+	ck, err := r.Cookie(sessionCookie)
+	if err != nil || ck.Value == "" {
+		return "", nil
+	}
+	s, err := decodeSession(ck.Value)
+	if err != nil {
+		return "", err
+	}
+	revoked, err := sessionRevoked(newContext(r), s)
+	if err != nil {
+		return "", err
+	}
+	if revoked {
+		return "", errors.New("sessionEmail: session revoked")
+	}
+	return s.email, nil
+}
+
+// handleSignIn verifies ID token posted by the sign-in page, see serveSignIn,
+// and signs in the user with session cookies, responding with 204 No Content.
+// The token must have a verified email. Like admin handlers, it accepts only
+// application/json requests, so that other sites can't sign in their users.
+func handleSignIn(w http.ResponseWriter, r *http.Request) {
+	c := newContext(r)
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeJSONError(c, w, http.StatusMethodNotAllowed, "method not allowed: "+r.Method)
+		return
+	}
+	if !isJSONRequest(r) {
+		writeJSONError(c, w, http.StatusUnsupportedMediaType, "content type must be application/json")
+		return
+	}
+	if !sessionsEnabled() {
+		writeJSONError(c, w, http.StatusInternalServerError, "sessions are not enabled")
+		return
+	}
+	if !allowRate(c, w, authRateLimit, clientIP(r)) {
+		return
+	}
+	var body struct {
+		IDToken string `json:"idToken"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSONError(c, w, http.StatusBadRequest, err)
+		return
+	}
+	claims, err := verifyIDTokenClaims(c, body.IDToken)
+	if err != nil {
+		writeJSONError(c, w, http.StatusUnauthorized, err)
+		return
+	}
+	if claims.email == "" {
+		writeJSONError(c, w, http.StatusUnauthorized, "no verified email")
+		return
+	}
+	s, err := newSession(claims.sub, claims.email)
+	if err == nil {
+		err = setSessionCookies(w, r, s)
+	}
+	if err != nil {
+		writeJSONError(c, w, http.StatusInternalServerError, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveSignIn responds with 401 Unauthorized and a page which signs in
+// the user with Google Sign-In, posts ID token to handleSignIn and reloads.
+func serveSignIn(w http.ResponseWriter, r *http.Request) {
+	c := newContext(r)
+	t, err := template.ParseFiles(filepath.Join(config.Dir, templatesDir, "auth", "signin.html"))
+	if err != nil {
+		writeJSONError(c, w, errStatus(err), err)
+		return
+	}
+	data := struct {
+		ClientID  string
+		SignInURL string
+	}{config.Google.Auth.Client, path.Join(config.Prefix, signInPath)}
+	w.Header().Set("Content-Type", "text/html;charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusUnauthorized)
+	if err := t.Execute(w, data); err != nil {
+		errorf(newContext(r), "serveSignIn: %v", err)
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !appengine
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// addTestSession adds sessionCookie of a user with the given email to r.
+// It expects setTestSessionConfig.
+func addTestSession(t *testing.T, r *http.Request, email string) {
+	s, err := newSession(testUserID, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := s.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: v})
+}
+
+func TestSessionEmail(t *testing.T) {
+	defer preserveConfig()()
+	setTestSessionConfig()
+
+	r := newTestRequest(t, "GET", "/", nil)
+	if email, err := sessionEmail(r); email != "" || err != nil {
+		t.Errorf("sessionEmail() = %q, %v; want empty", email, err)
+	}
+	addTestSession(t, r, "dude@example.org")
+	if email, err := sessionEmail(r); email != "dude@example.org" || err != nil {
+		t.Errorf("sessionEmail() = %q, %v; want dude@example.org", email, err)
+	}
+	r = newTestRequest(t, "GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: "invalid"})
+	if email, err := sessionEmail(r); email != "" || err == nil {
+		t.Errorf("sessionEmail(invalid) = %q, %v; want error", email, err)
+	}
+
+	// signed out
+	s, _ := newSession("revoked-user", "dude@example.org")
+	s.signedIn = time.Now().Add(-time.Minute)
+	v, _ := s.encode()
+	c := newContext(r)
+	if err := revokeSessions(c, s.user, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	r = newTestRequest(t, "GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: v})
+	if email, err := sessionEmail(r); email != "" || err == nil {
+		t.Errorf("sessionEmail(revoked) = %q, %v; want error", email, err)
+	}
+}
+
+func TestHandleSignIn(t *testing.T) {
+	defer preserveConfig()()
+	setTestSessionConfig()
+
+	verified := map[string]interface{}{"email": "dude@example.org", "email_verified": true}
+	table := []struct {
+		method, ctype string
+		claims        map[string]interface{}
+		code          int
+	}{
+		{"POST", "application/json", verified, http.StatusNoContent},
+		{"GET", "application/json", verified, http.StatusMethodNotAllowed},
+		{"POST", "text/plain", verified, http.StatusUnsupportedMediaType},
+		{"POST", "application/json", map[string]interface{}{"email": "dude@example.org"}, http.StatusUnauthorized},
+		{"POST", "application/json", map[string]interface{}{
+			"email": "dude@example.org", "email_verified": true, "aud": "other-client"}, http.StatusUnauthorized},
+		{"POST", "application/json", map[string]interface{}{
+			"email": "dude@example.org", "email_verified": true, "exp": time.Now().Add(-time.Hour).Unix()}, http.StatusUnauthorized},
+	}
+	for i, test := range table {
+		cache.flush(newContext(newTestRequest(t, "GET", "/", nil)))
+		body := fmt.Sprintf(`{"idToken": %q}`, signTestIDToken(t, test.claims))
+		r := newTestRequest(t, test.method, "/io2015"+signInPath, strings.NewReader(body))
+		r.Header.Set("content-type", test.ctype)
+		w := httptest.NewRecorder()
+		handleSignIn(w, r)
+		if w.Code != test.code {
+			t.Errorf("%d: w.Code = %d; want %d\nResponse: %s", i, w.Code, test.code, w.Body.String())
+		}
+		ck := responseCookies(w)[sessionCookie]
+		if test.code != http.StatusNoContent {
+			if ck != nil {
+				t.Errorf("%d: session cookie is set: %+v", i, ck)
+			}
+			continue
+		}
+		if ck == nil || !ck.HttpOnly {
+			t.Fatalf("%d: session cookie = %+v; want HttpOnly", i, ck)
+		}
+		r = newTestRequest(t, "GET", "/io2015/", nil)
+		r.AddCookie(ck)
+		if email, err := sessionEmail(r); email != "dude@example.org" || err != nil {
+			t.Errorf("%d: sessionEmail() = %q, %v; want dude@example.org", i, email, err)
+		}
+	}
+
+	// sessions are not configured
+	config.Session.Secrets = nil
+	r := newTestRequest(t, "POST", "/io2015"+signInPath, strings.NewReader(`{"idToken": "x"}`))
+	r.Header.Set("content-type", "application/json")
+	w := httptest.NewRecorder()
+	handleSignIn(w, r)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("w.Code = %d; want 500", w.Code)
+	}
+}
+
+func TestCheckAdmin(t *testing.T) {
+	defer preserveConfig()()
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	setTestSessionConfig()
+	config.Whitelist = []string{"white@example.org"}
+	config.Admins = []string{"admin@example.org"}
+
+	table := []struct {
+		env   string
+		email string
+		code  int
+	}{
+		{"stage", "", http.StatusUnauthorized},
+		{"stage", "dude@example.org", http.StatusForbidden},
+		{"stage", "white@example.org", http.StatusForbidden},
+		{"stage", "admin@example.org", http.StatusOK},
+		{"prod", "", http.StatusUnauthorized},
+		{"prod", "white@example.org", http.StatusForbidden},
+		{"prod", "admin@example.org", http.StatusOK},
+	}
+	for _, test := range table {
+		config.Env = test.env
+		w := httptest.NewRecorder()
+		r := newTestRequest(t, "GET", "/io2015/admin/", nil)
+		if test.email != "" {
+			addTestSession(t, r, test.email)
+		}
+		checkAdmin(h).ServeHTTP(w, r)
+
+		if w.Code != test.code {
+			t.Errorf("%s: w.Code = %d; want %d\nResponse: %s", test.email, w.Code, test.code, w.Body.String())
+		}
+		if w.Code == http.StatusOK && w.Body.String() != "ok" {
+			t.Errorf("w.Body = %s; want 'ok'", w.Body.String())
+		}
+		if v := isStandaloneAdmin(r); v != (test.code == http.StatusOK) {
+			t.Errorf("%s: isStandaloneAdmin = %v; want %v", test.email, v, !v)
+		}
+	}
+}
+
+func TestCheckWhitelist(t *testing.T) {
+	defer preserveConfig()()
+	defer func(p []string) { passthruPrefixes = p }(passthruPrefixes)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	setTestSessionConfig()
+	config.Env = "stage"
+	config.Whitelist = []string{"@white.example.org", "white@example.org"} // sorted
+	config.Admins = []string{"admin@example.org"}
+	passthruPrefixes = []string{"/io2015/api/v1/user"}
+
+	table := []struct {
+		path  string
+		email string
+		code  int
+	}{
+		{"/io2015/", "", http.StatusUnauthorized},
+		{"/io2015/", "dude@example.org", http.StatusForbidden},
+		{"/io2015/", "white@example.org", http.StatusOK},
+		{"/io2015/", "dude@white.example.org", http.StatusOK},
+		{"/io2015/", "admin@example.org", http.StatusOK},
+		{"/io2015/api/v1/user/schedule", "", http.StatusOK},
+	}
+	for _, test := range table {
+		w := httptest.NewRecorder()
+		r := newTestRequest(t, "GET", test.path, nil)
+		if test.email != "" {
+			addTestSession(t, r, test.email)
+		}
+		checkWhitelist(h).ServeHTTP(w, r)
+
+		if w.Code != test.code {
+			t.Errorf("%s %s: w.Code = %d; want %d\nResponse: %s",
+				test.path, test.email, w.Code, test.code, w.Body.String())
+		}
+	}
+}
@@ -17,6 +17,7 @@ package main
 import (
 	"encoding/json"
 	"encoding/xml"
+	"math"
 	"strconv"
 	"time"
 
@@ -29,8 +30,18 @@ const (
 	// ioextCacheTimeout is how long until cached extFeed entries are expired.
 	// The content is still refreshed much earlier via cron jobs.
 	ioextCacheTimeout = 48 * time.Hour
+
+	// ioextRadius is the distance in km within which I/O Extended events
+	// are considered to be near a user location.
+	ioextRadius = 80
+	// earthRadius is the mean Earth radius in km.
+	earthRadius = 6371
 )
 
+// ioextFlight dedupes concurrent fetches of I/O Extended entries,
+// so that their changes are notified once.
+var ioextFlight = &flightGroup{}
+
 // extFeed is the root element of a Google Sheet feed.
 type extFeed struct {
 	XMLName xml.Name    `xml:"feed"`
@@ -49,30 +60,115 @@ type extEntry struct {
 	XMLLng string  `json:"-" xml:"http://schemas.google.com/spreadsheets/2006/extended longitude"`
 }
 
-// ioExtEntries fetches I/O Extended items either from cache or a spreadsheet.
-// Cache can be invalidated by providing refresh = true.
+// ioExtEntries returns cached I/O Extended entries or fetches them from config.IoExtFeedURL
+// if refresh is true or nothing is cached.
+//
+// When the fetched entries differ from the previously cached ones,
+// users with I/O Extended notifications enabled are notified about the changes.
+// There is nothing to compare to after the cached entries expire in ioextCacheTimeout,
+// so changes made since the last fetch are not notified.
+// Concurrent fetches are deduped within an instance, see ioextFlight,
+// but two instances refreshing at the same time may notify the same changes twice.
 func ioExtEntries(c context.Context, refresh bool) ([]*extEntry, error) {
 	feedURL := config.IoExtFeedURL
-	if !refresh {
-		entries, err := ioExtEntriesFromCache(c, feedURL)
-		if err == nil {
-			return entries, nil
-		}
+	cached, cerr := ioExtEntriesFromCache(c, feedURL)
+	if !refresh && cerr == nil {
+		return cached, nil
 	}
 
-	entries, err := fetchIOExtEntries(c, feedURL)
+	entries, err := ioextFlight.do(feedURL, func() (interface{}, error) {
+		entries, err := fetchIOExtEntries(c, feedURL)
+		if err != nil {
+			return nil, err
+		}
+		data, err := json.Marshal(entries)
+		if err != nil {
+			errorf(c, "ioExtEntries: %v", err)
+		} else if err := cache.set(c, feedURL, data, ioextCacheTimeout); err != nil {
+			errorf(c, "ioExtEntries: cache.put(%q): %v", feedURL, err)
+		}
+
+		if cerr != nil {
+			logf(c, "ioExtEntries: no cached entries to diff with: %v", cerr)
+			return entries, nil
+		}
+		if err := notifyIOExtChanges(c, diffIOExtEntries(cached, entries)); err != nil {
+			errorf(c, "ioExtEntries: %v", err)
+		}
+		return entries, nil
+	})
 	if err != nil {
 		return nil, err
 	}
+	return entries.([]*extEntry), nil
+}
 
-	data, err := json.Marshal(entries)
-	if err != nil {
-		errorf(c, "ioExtEntries: %v", err)
-	} else if err := cache.set(c, feedURL, data, ioextCacheTimeout); err != nil {
-		errorf(c, "ioExtEntries: cache.put(%q): %v", feedURL, err)
+// notifyIOExtChanges stores new or changed entries as dataChanges
+// and spawns up workers to send push notifications to nearby users.
+func notifyIOExtChanges(c context.Context, entries []*extEntry) error {
+	if len(entries) == 0 {
+		return nil
 	}
+	logf(c, "found %d new or modified I/O Extended entries", len(entries))
+	dc := &dataChanges{Updated: time.Now(), IoExt: entries}
+	err := runInTransaction(c, func(c context.Context) error {
+		if err := storeChanges(c, dc); err != nil {
+			return err
+		}
+		return notifySubscribersAsync(c, dc, false)
+	})
+	if err == nil {
+		publishChanges(c, dc)
+	}
+	return err
+}
 
-	return entries, nil
+// diffIOExtEntries returns elements of b which are either not in a
+// or have different field values. Entries are identified by their Link.
+// The result is empty if a is empty.
+func diffIOExtEntries(a, b []*extEntry) []*extEntry {
+	if len(a) == 0 {
+		return nil
+	}
+	old := make(map[string]*extEntry, len(a))
+	for _, e := range a {
+		old[e.Link] = e
+	}
+	var res []*extEntry
+	for _, e := range b {
+		if o, ok := old[e.Link]; !ok || o.Name != e.Name || o.City != e.City || o.Lat != e.Lat || o.Lng != e.Lng {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// nearbyIOExtEntries returns a subset of entries located within ioextRadius of ext.
+// It returns nil if ext is nil.
+func nearbyIOExtEntries(entries []*extEntry, ext *ioExtPush) []*extEntry {
+	if ext == nil {
+		return nil
+	}
+	var res []*extEntry
+	for _, e := range entries {
+		if distance(e.Lat, e.Lng, ext.Lat, ext.Lng) <= ioextRadius {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// distance returns great-circle distance in km between two points
+// using haversine formula.
+func distance(lat1, lng1, lat2, lng2 float64) float64 {
+	rad := func(deg float64) float64 {
+		return deg * math.Pi / 180
+	}
+	dlat := rad(lat2 - lat1)
+	dlng := rad(lng2 - lng1)
+	h := math.Sin(dlat/2)*math.Sin(dlat/2) +
+		math.Cos(rad(lat1))*math.Cos(rad(lat2))*math.Sin(dlng/2)*math.Sin(dlng/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(h))
 }
 
 // ioExtEntriesFromCache is the same as ioExtEntries but uses only cached items.
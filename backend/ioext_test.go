@@ -67,3 +67,49 @@ func TextFetchIOExtEntries(t *testing.T) {
 		t.Errorf("entry.Lng = %f; want %f", entry.Lng, v)
 	}
 }
+
+func TestDiffIOExtEntries(t *testing.T) {
+	a := []*extEntry{
+		{Name: "Madrid", Link: "https://event-1", Lat: 40.401982, Lng: -3.608424},
+		{Name: "Nyeri", Link: "https://event-2", Lat: -0.420219, Lng: 36.947596},
+	}
+	b := []*extEntry{
+		{Name: "Madrid", Link: "https://event-1", Lat: 40.401982, Lng: -3.608424},
+		{Name: "Nyeri updated", Link: "https://event-2", Lat: -0.420219, Lng: 36.947596},
+		{Name: "Amsterdam", Link: "https://event-3", Lat: 52.37607, Lng: 4.886114},
+	}
+	diff := diffIOExtEntries(a, b)
+	if len(diff) != 2 {
+		t.Fatalf("len(diff) = %d; want 2", len(diff))
+	}
+	if diff[0].Link != "https://event-2" || diff[1].Link != "https://event-3" {
+		t.Errorf("diff = %+v, %+v; want event-2, event-3", diff[0], diff[1])
+	}
+	if diff := diffIOExtEntries(nil, b); len(diff) != 0 {
+		t.Errorf("diffIOExtEntries(nil, b) = %v; want empty", diff)
+	}
+}
+
+func TestFilterUserChangesIOExt(t *testing.T) {
+	entries := []*extEntry{
+		{Name: "Amsterdam", Link: "https://event-1", Lat: 52.37607, Lng: 4.886114},
+		{Name: "Utrecht", Link: "https://event-2", Lat: 52.090737, Lng: 5.12142},
+		{Name: "Madrid", Link: "https://event-3", Lat: 40.401982, Lng: -3.608424},
+	}
+	dc := &dataChanges{IoExt: entries}
+	filterUserChanges(dc, nil, &ioExtPush{Enabled: true, Lat: 52.37, Lng: 4.89})
+	if len(dc.IoExt) != 2 {
+		t.Fatalf("len(dc.IoExt) = %d; want 2", len(dc.IoExt))
+	}
+	for _, e := range dc.IoExt {
+		if e.Name == "Madrid" {
+			t.Errorf("%+v is not within %dkm", e, ioextRadius)
+		}
+	}
+
+	dc = &dataChanges{IoExt: entries}
+	filterUserChanges(dc, nil, nil)
+	if len(dc.IoExt) != 0 {
+		t.Errorf("dc.IoExt = %v; want empty", dc.IoExt)
+	}
+}
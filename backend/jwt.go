@@ -16,6 +16,7 @@ package main
 
 import (
 	"bytes"
+	"crypto/rsa"
 	"encoding/gob"
 	"encoding/json"
 	"errors"
@@ -23,56 +24,239 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
 	"golang.org/x/net/context"
 )
 
+const (
+	// idTokenKeysTTL is how long parsed idTokenCerts are kept in memory.
+	idTokenKeysTTL = 10 * time.Minute
+	// idTokenRefetchDelay is the min interval of refetching idTokenCerts
+	// when a token is signed with an unknown key, e.g. after a key rotation.
+	idTokenRefetchDelay = time.Minute
+)
+
+// idTokenIssuers are accepted values of ID tokens "iss" claim.
+var idTokenIssuers = []string{"accounts.google.com", "https://accounts.google.com"}
+
+// idTokenKeys are parsed public keys of idTokenCerts, keyed by cert IDs.
+// They are kept in memory of the instance to avoid decoding and parsing
+// the certificates on every ID token verification.
+var idTokenKeys idTokenKeysCache
+
+// idTokenKeysCache is the type of idTokenKeys.
+type idTokenKeysCache struct {
+	sync.Mutex
+	url     string
+	keys    map[string]*rsa.PublicKey
+	exp     time.Time
+	fetched time.Time // last fetch from config.Google.CertURL
+}
+
+// idClaims are verified claims of a Google ID token.
+type idClaims struct {
+	// user ID
+	sub string
+	// email is set only if verified
+	email string
+	// hosted domain of G Suite users
+	hd string
+}
+
 // verifyIDToken verifies Google ID token, which heavily based on JWT.
 // It returns user ID of the pricipal who granted an authorization.
 func verifyIDToken(c context.Context, t string) (string, error) {
-	token, err := jwt.Parse(t, func(j *jwt.Token) (interface{}, error) {
+	claims, err := verifyIDTokenClaims(c, t)
+	if err != nil {
+		return "", err
+	}
+	return claims.sub, nil
+}
+
+// verifyIDTokenClaims verifies signature of Google ID token t and its claims
+// as specified by OpenID Connect: iss must be one of idTokenIssuers, and aud,
+// as well as azp if present, one of idTokenAudiences. Times of exp, iat and nbf
+// claims are compared with config.Google.Auth.clockSkew tolerance.
+func verifyIDTokenClaims(c context.Context, t string) (*idClaims, error) {
+	p := &jwt.Parser{ValidMethods: []string{"RS256"}, UseJSONNumber: true}
+	token, err := p.Parse(t, func(j *jwt.Token) (interface{}, error) {
 		kid, _ := j.Header["kid"].(string)
-		keys, err := idTokenCerts(c)
+		return idTokenKey(c, kid)
+	})
+	if err != nil {
+		// times are verified below, allowing for clock skew
+		ve, ok := err.(*jwt.ValidationError)
+		if !ok || ve.Errors&^(jwt.ValidationErrorExpired|jwt.ValidationErrorNotValidYet) != 0 {
+			return nil, err
+		}
+	}
+
+	claims := token.Claims
+	iss, _ := claims["iss"].(string)
+	if !containsString(idTokenIssuers, iss) {
+		return nil, fmt.Errorf("verifyIDToken: invalid 'iss' claim %q", iss)
+	}
+	auds := idTokenAudiences()
+	switch aud := claims["aud"].(type) {
+	case string:
+		if !containsString(auds, aud) {
+			return nil, fmt.Errorf("verifyIDToken: invalid 'aud' claim %q", aud)
+		}
+	case []interface{}:
+		// multiple audiences require azp, see below
+		if _, ok := claims["azp"]; !ok || len(aud) == 0 {
+			return nil, errors.New("verifyIDToken: multiple audiences with no 'azp' claim")
+		}
+		for _, a := range aud {
+			if s, _ := a.(string); !containsString(auds, s) {
+				return nil, fmt.Errorf("verifyIDToken: invalid 'aud' claim %v", a)
+			}
+		}
+	default:
+		return nil, errors.New("verifyIDToken: missing 'aud' claim")
+	}
+	if azp, ok := claims["azp"]; ok {
+		if s, _ := azp.(string); !containsString(auds, s) {
+			return nil, fmt.Errorf("verifyIDToken: invalid 'azp' claim %v", azp)
+		}
+	}
+
+	now := time.Now()
+	skew := config.Google.Auth.clockSkew
+	exp, ok := claimTime(claims, "exp")
+	if !ok || !now.Before(exp.Add(skew)) {
+		return nil, errors.New("verifyIDToken: token expired")
+	}
+	iat, ok := claimTime(claims, "iat")
+	if !ok || iat.After(now.Add(skew)) {
+		return nil, errors.New("verifyIDToken: invalid 'iat' claim")
+	}
+	if nbf, ok := claimTime(claims, "nbf"); ok && nbf.After(now.Add(skew)) {
+		return nil, errors.New("verifyIDToken: token is not valid yet")
+	}
+
+	res := &idClaims{}
+	if res.sub, _ = claims["sub"].(string); res.sub == "" {
+		return nil, errors.New("verifyIDToken: invalid 'sub' claim")
+	}
+	// Google ID tokens used to have email_verified as a string
+	switch claims["email_verified"] {
+	case true, "true":
+		res.email, _ = claims["email"].(string)
+	}
+	res.hd, _ = claims["hd"].(string)
+	return res, nil
+}
+
+// idTokenAudiences returns accepted values of ID tokens "aud" and "azp" claims:
+// config.Google.Auth.Client and config.Google.Auth.Audiences.
+func idTokenAudiences() []string {
+	auds := []string{config.Google.Auth.Client}
+	return append(auds, config.Google.Auth.Audiences...)
+}
+
+// claimTime returns time of claim k with a numeric value of seconds since the Unix epoch.
+func claimTime(claims map[string]interface{}, k string) (time.Time, bool) {
+	var sec int64
+	switch v := claims[k].(type) {
+	case json.Number:
+		n, err := v.Int64()
 		if err != nil {
+			return time.Time{}, false
+		}
+		sec = n
+	case float64:
+		sec = int64(v)
+	default:
+		return time.Time{}, false
+	}
+	return time.Unix(sec, 0), true
+}
+
+// containsString reports whether list contains s.
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// idTokenKey returns public key kid of idTokenKeys, loading them with idTokenCerts
+// if missing or expired. Unknown keys result in refetching the certificates,
+// though no more often than idTokenRefetchDelay.
+func idTokenKey(c context.Context, kid string) (*rsa.PublicKey, error) {
+	k := &idTokenKeys
+	k.Lock()
+	defer k.Unlock()
+	now := time.Now()
+	if k.url != config.Google.CertURL || now.After(k.exp) {
+		if err := k.load(c, false); err != nil {
 			return nil, err
 		}
-		cert, ok := keys[kid]
-		if !ok {
-			return nil, fmt.Errorf("verifyIDToken: keys[%q] = nil", kid)
+	}
+	if key, ok := k.keys[kid]; ok {
+		return key, nil
+	}
+	if now.Sub(k.fetched) > idTokenRefetchDelay {
+		if err := k.load(c, true); err != nil {
+			return nil, err
 		}
-		return cert, nil
-	})
+		if key, ok := k.keys[kid]; ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("verifyIDToken: keys[%q] = nil", kid)
+}
 
+// load replaces keys with parsed idTokenCerts. The caller must hold the lock.
+// See idTokenCerts for refetch.
+func (k *idTokenKeysCache) load(c context.Context, refetch bool) error {
+	certs, fetched, err := idTokenCerts(c, refetch)
 	if err != nil {
-		return "", err
+		return err
 	}
-	sub, ok := token.Claims["sub"].(string)
-	if !ok {
-		return "", errors.New("verifyIDToken: invalid 'sub' claim")
+	keys := make(map[string]*rsa.PublicKey, len(certs))
+	for kid, cert := range certs {
+		key, err := jwt.ParseRSAPublicKeyFromPEM(cert)
+		if err != nil {
+			errorf(c, "idTokenKeys: cert %q: %v", kid, err)
+			continue
+		}
+		keys[kid] = key
 	}
-	return sub, nil
+	k.url = config.Google.CertURL
+	k.keys = keys
+	k.exp = time.Now().Add(idTokenKeysTTL)
+	if fetched {
+		k.fetched = time.Now()
+	}
+	return nil
 }
 
 // idTokenCerts returns public certificates used to encrypt ID tokens.
-// It returns a cached copy, if available, or fetches from a known URL otherwise.
+// It returns a cached copy, if available and refetch is false,
+// or fetches from a known URL otherwise, which is reported in the second result.
 // The returnd map is keyed after the cert IDs.
-func idTokenCerts(c context.Context) (map[string][]byte, error) {
+func idTokenCerts(c context.Context, refetch bool) (map[string][]byte, bool, error) {
 	certURL := config.Google.CertURL
 	// try cache first
-	keys, err := certsFromCache(c, certURL)
-	if err == nil {
-		return keys, nil
+	if !refetch {
+		if keys, err := certsFromCache(c, certURL); err == nil {
+			return keys, false, nil
+		}
 	}
 	// fetch from public endpoint otherwise
-	var exp time.Duration
-	keys, exp, err = fetchPublicKeys(c, certURL)
+	keys, exp, err := fetchPublicKeys(c, certURL)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	if exp <= 0 {
-		return keys, nil
+		return keys, true, nil
 	}
 	// cache the result for duration exp
 	var data bytes.Buffer
@@ -82,7 +266,7 @@ func idTokenCerts(c context.Context) (map[string][]byte, error) {
 		errorf(c, "idTokenCerts: cache.set(%q): %v", certURL, err)
 	}
 	// return the result anyway, even on cache errors
-	return keys, nil
+	return keys, true, nil
 }
 
 // certsFromCache returns cached public keys.
@@ -0,0 +1,112 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// logLevel is a severity of log messages.
+// Messages below config.logLevel are discarded.
+type logLevel int
+
+const (
+	logLevelDebug logLevel = iota - 1
+	logLevelInfo           // default
+	logLevelError
+)
+
+// logLevels maps appConfig.LogLevel values to logLevel.
+var logLevels = map[string]logLevel{
+	"debug": logLevelDebug,
+	"info":  logLevelInfo,
+	"error": logLevelError,
+}
+
+func (l logLevel) String() string {
+	for k, v := range logLevels {
+		if v == l {
+			return k
+		}
+	}
+	return fmt.Sprintf("level%d", int(l))
+}
+
+// logEnabled reports whether messages of level l are logged.
+func logEnabled(l logLevel) bool {
+	return l >= config.logLevel
+}
+
+// withLogField returns a copy of c which adds key field with value v
+// to all messages logged with the returned context.
+func withLogField(c context.Context, key string, v interface{}) context.Context {
+	fields := make(map[string]interface{})
+	if c != nil {
+		for k, v := range contextLogFields(c) {
+			fields[k] = v
+		}
+	} else {
+		c = context.Background()
+	}
+	fields[key] = v
+	return context.WithValue(c, ctxKeyLogFields, fields)
+}
+
+// logFields returns all fields of messages logged with context c,
+// including request ID and user, if known.
+// The returned map is a copy and can be modified.
+func logFields(c context.Context) map[string]interface{} {
+	fields := make(map[string]interface{})
+	if c == nil {
+		return fields
+	}
+	for k, v := range contextLogFields(c) {
+		fields[k] = v
+	}
+	if id := requestID(c); id != "" {
+		fields["requestId"] = id
+	}
+	if u := contextUser(c); u != "" {
+		fields["user"] = u
+	}
+	return fields
+}
+
+// contextLogFields returns fields added to c with withLogField.
+func contextLogFields(c context.Context) map[string]interface{} {
+	fields, _ := c.Value(ctxKeyLogFields).(map[string]interface{})
+	return fields
+}
+
+// formatLogFields formats fields as "[k1=v1 k2=v2] ", sorted by key,
+// or returns an empty string if there are no fields.
+func formatLogFields(fields map[string]interface{}) string {
+	if len(fields) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		keys[i] = fmt.Sprintf("%s=%v", k, fields[k])
+	}
+	return "[" + strings.Join(keys, " ") + "] "
+}
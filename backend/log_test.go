@@ -0,0 +1,81 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestLogFields(t *testing.T) {
+	c := newContext(newTestRequest(t, "GET", "/api/v1/user/schedule", nil))
+	c = context.WithValue(c, ctxKeyUser, "user-123")
+	c1 := withLogField(c, "sessions", []string{"a", "b"})
+	c2 := withLogField(c1, "status", 200)
+
+	fields := logFields(c2)
+	if v := fields["user"]; v != "user-123" {
+		t.Errorf("fields[user] = %v; want user-123", v)
+	}
+	if v := fields["status"]; v != 200 {
+		t.Errorf("fields[status] = %v; want 200", v)
+	}
+	if _, ok := fields["sessions"]; !ok {
+		t.Errorf("no sessions in %v", fields)
+	}
+	if _, ok := logFields(c1)["status"]; ok {
+		t.Errorf("withLogField modified parent context fields")
+	}
+	if fields := logFields(nil); len(fields) != 0 {
+		t.Errorf("logFields(nil) = %v; want empty", fields)
+	}
+}
+
+func TestFormatLogFields(t *testing.T) {
+	table := []struct {
+		fields map[string]interface{}
+		out    string
+	}{
+		{nil, ""},
+		{map[string]interface{}{"user": "u1"}, "[user=u1] "},
+		{map[string]interface{}{"user": "u1", "requestId": "r1"}, "[requestId=r1 user=u1] "},
+	}
+	for i, test := range table {
+		if v := formatLogFields(test.fields); v != test.out {
+			t.Errorf("%d: formatLogFields(%v) = %q; want %q", i, test.fields, v, test.out)
+		}
+	}
+}
+
+func TestLogEnabled(t *testing.T) {
+	defer preserveConfig()()
+	table := []struct {
+		min, level logLevel
+		enabled    bool
+	}{
+		{logLevelInfo, logLevelDebug, false},
+		{logLevelInfo, logLevelInfo, true},
+		{logLevelInfo, logLevelError, true},
+		{logLevelError, logLevelInfo, false},
+		{logLevelDebug, logLevelDebug, true},
+	}
+	for i, test := range table {
+		config.logLevel = test.min
+		if v := logEnabled(test.level); v != test.enabled {
+			t.Errorf("%d: logEnabled(%v) at %v = %v; want %v", i, test.level, test.min, v, test.enabled)
+		}
+	}
+}
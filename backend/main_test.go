@@ -78,6 +78,7 @@ func TestMain(m *testing.M) {
 	token.Claims = map[string]interface{}{
 		"iss": "accounts.google.com",
 		"exp": time.Now().Add(2 * time.Hour).Unix(),
+		"iat": time.Now().Unix(),
 		"aud": testClientID,
 		"azp": testClientID,
 		"sub": testUserID,
@@ -141,6 +142,32 @@ func preserveConfig() func() {
 	return func() { config = orig }
 }
 
+// signTestIDToken returns an ID token of testUserID with additional claims,
+// signed with testJWSKey. Claims with nil values are removed from the token.
+func signTestIDToken(t *testing.T, claims map[string]interface{}) string {
+	token := jwt.New(jwt.GetSigningMethod("RS256"))
+	token.Header["kid"] = testJWSCertID
+	token.Claims = map[string]interface{}{
+		"iss": "accounts.google.com",
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"iat": time.Now().Unix(),
+		"aud": testClientID,
+		"sub": testUserID,
+	}
+	for k, v := range claims {
+		if v == nil {
+			delete(token.Claims, k)
+			continue
+		}
+		token.Claims[k] = v
+	}
+	s, err := token.SignedString(testJWSKey)
+	if err != nil {
+		t.Fatalf("token.SignedString: %v", err)
+	}
+	return s
+}
+
 func jwsTestKey(notBefore, notAfter time.Time) (pemKey []byte, pemCert []byte) {
 	key, err := rsa.GenerateKey(rand.Reader, 1024)
 	if err != nil {
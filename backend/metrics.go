@@ -0,0 +1,284 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultBuckets are upper bounds of latency histogram buckets, in seconds.
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30}
+
+// Metrics exposed at /metrics in Prometheus text format.
+// They are kept in memory of each instance and reset on restart.
+var (
+	httpRequests = newCounter("iowa_http_requests_total",
+		"HTTP requests by route pattern, method and response status code.",
+		"route", "method", "code")
+	httpDuration = newHistogram("iowa_http_request_duration_seconds",
+		"HTTP request latency by route pattern.", defaultBuckets, "route")
+	syncDuration = newHistogram("iowa_sync_duration_seconds",
+		"Event data sync duration by result.", defaultBuckets, "result")
+	pushPings = newCounter("iowa_push_pings_total",
+		"Push pings by service and result: ok, retry, remove or error.", "service", "result")
+	cacheGets = newCounter("iowa_cache_gets_total",
+		"Cache lookups by result: hit, miss or error.", "result")
+	driveDuration = newHistogram("iowa_drive_request_duration_seconds",
+		"Google Drive AppFolder data requests latency by operation.", defaultBuckets, "op")
+)
+
+// metricsRegistry are all metrics created with newCounter and newHistogram.
+var metricsRegistry []metric
+
+// metric is a named family of time series, one per each set of label values.
+type metric interface {
+	// write writes all series of the metric to w in Prometheus text format.
+	write(w io.Writer)
+}
+
+// counter is a metric with values which only go up.
+type counter struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]float64 // keyed by seriesKey
+}
+
+// newCounter creates a new counter with the given label names
+// and adds it to metricsRegistry.
+func newCounter(name, help string, labels ...string) *counter {
+	m := &counter{name: name, help: help, labels: labels, values: make(map[string]float64)}
+	metricsRegistry = append(metricsRegistry, m)
+	return m
+}
+
+// inc increments the series of label values by 1.
+// The values must be in the same order as label names of m.
+func (m *counter) inc(values ...string) {
+	m.mu.Lock()
+	m.values[seriesKey(values)]++
+	m.mu.Unlock()
+}
+
+func (m *counter) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", m.name, m.help, m.name)
+	for _, k := range sortedKeys(m.values) {
+		fmt.Fprintf(w, "%s%s %s\n", m.name, formatLabels(m.labels, k, ""), formatFloat(m.values[k]))
+	}
+}
+
+// histogram samples observations in buckets of fixed upper bounds.
+type histogram struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries // keyed by seriesKey
+}
+
+// histogramSeries is a single series of histogram.
+// counts are not cumulative.
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// newHistogram creates a new histogram with the given sorted buckets
+// and label names, and adds it to metricsRegistry.
+func newHistogram(name, help string, buckets []float64, labels ...string) *histogram {
+	m := &histogram{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+	metricsRegistry = append(metricsRegistry, m)
+	return m
+}
+
+// observe adds v to the series of label values.
+func (m *histogram) observe(v float64, values ...string) {
+	k := seriesKey(values)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.series[k]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(m.buckets))}
+		m.series[k] = s
+	}
+	if i := sort.SearchFloat64s(m.buckets, v); i < len(m.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += v
+}
+
+// since observes time elapsed since start, in seconds.
+// It is handy in defer statements.
+func (m *histogram) since(start time.Time, values ...string) {
+	m.observe(time.Since(start).Seconds(), values...)
+}
+
+func (m *histogram) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", m.name, m.help, m.name)
+	for _, k := range sortedKeys(m.series) {
+		s := m.series[k]
+		var n uint64
+		for i, b := range m.buckets {
+			n += s.counts[i]
+			le := `le="` + formatFloat(b) + `"`
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, k, le), n)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(m.labels, k, `le="+Inf"`), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, formatLabels(m.labels, k, ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, formatLabels(m.labels, k, ""), s.count)
+	}
+}
+
+// seriesKey joins label values into a key of a single series.
+func seriesKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// formatLabels formats label names and values of series key k as {n1="v1",n2="v2"},
+// with extra label pair appended, if not empty.
+func formatLabels(names []string, k, extra string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, v := range strings.Split(k, "\xff") {
+			if i < len(names) {
+				pairs = append(pairs, names[i]+`="`+escapeLabel(v)+`"`)
+			}
+		}
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// resultLabel returns "ok" if err is nil, or "error" otherwise.
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// serveMetrics responds with all metrics of metricsRegistry in Prometheus text format.
+// In prod, the request must have "Authorization: Bearer <config.MetricsToken>" header
+// or be made by an admin. Others get 404 Not Found.
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	if isProd() && !allowMetrics(r) {
+		http.NotFound(w, r)
+		return
+	}
+	var buf bytes.Buffer
+	for _, m := range metricsRegistry {
+		m.write(&buf)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(buf.Bytes())
+}
+
+// allowMetrics reports whether r is allowed to read metrics in prod.
+func allowMetrics(r *http.Request) bool {
+	if isAdminRequest(r) {
+		return true
+	}
+	if config.MetricsToken == "" {
+		return false
+	}
+	ah := r.Header.Get("authorization")
+	if len(ah) < bearerHeaderLen || strings.ToLower(ah[:bearerHeaderLen]) != bearerHeader {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(ah[bearerHeaderLen:]), []byte(config.MetricsToken)) == 1
+}
+
+// instrumentHandler records requests count and latency of h
+// in httpRequests and httpDuration, labelled with route pattern.
+// Methods not allowed by info, except OPTIONS, are labelled "other",
+// so that clients can't create arbitrary time series.
+func instrumentHandler(pattern string, info *routeInfo, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h(sw, r)
+		httpDuration.since(start, pattern)
+		method := r.Method
+		if method != "OPTIONS" && !info.allows(method) {
+			method = "other"
+		}
+		httpRequests.inc(pattern, method, strconv.Itoa(sw.status))
+	}
+}
+
+// statusWriter records response status code written to the embedded ResponseWriter.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	sw.status = code
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+// Flush implements http.Flusher, which streaming responses rely on.
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// CloseNotify implements http.CloseNotifier.
+func (sw *statusWriter) CloseNotify() <-chan bool {
+	if cn, ok := sw.ResponseWriter.(http.CloseNotifier); ok {
+		return cn.CloseNotify()
+	}
+	return make(chan bool)
+}
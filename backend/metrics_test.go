@@ -0,0 +1,108 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCounterWrite(t *testing.T) {
+	m := &counter{name: "test_total", help: "Test.", labels: []string{"a", "b"}, values: make(map[string]float64)}
+	m.inc("x", `y"1`)
+	m.inc("x", `y"1`)
+	m.inc("z", "w")
+	var buf bytes.Buffer
+	m.write(&buf)
+	want := "# HELP test_total Test.\n# TYPE test_total counter\n" +
+		"test_total{a=\"x\",b=\"y\\\"1\"} 2\n" +
+		"test_total{a=\"z\",b=\"w\"} 1\n"
+	if buf.String() != want {
+		t.Errorf("write:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestHistogramWrite(t *testing.T) {
+	m := &histogram{
+		name:    "test_seconds",
+		help:    "Test.",
+		buckets: []float64{0.1, 1},
+		series:  make(map[string]*histogramSeries),
+	}
+	m.observe(0.05)
+	m.observe(0.5)
+	m.observe(2)
+	var buf bytes.Buffer
+	m.write(&buf)
+	want := "# HELP test_seconds Test.\n# TYPE test_seconds histogram\n" +
+		"test_seconds_bucket{le=\"0.1\"} 1\n" +
+		"test_seconds_bucket{le=\"1\"} 2\n" +
+		"test_seconds_bucket{le=\"+Inf\"} 3\n" +
+		"test_seconds_sum 2.55\n" +
+		"test_seconds_count 3\n"
+	if buf.String() != want {
+		t.Errorf("write:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	defer preserveConfig()()
+	config.MetricsToken = "metrics-secret"
+	info := &routeInfo{Ops: []*routeOp{{Method: "GET"}}}
+	h := instrumentHandler("/test", info, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	h(httptest.NewRecorder(), newTestRequest(t, "GET", "/test", nil))
+	h(httptest.NewRecorder(), newTestRequest(t, "MADEUP", "/test", nil))
+
+	table := []struct {
+		env, auth string
+		code      int
+	}{
+		{"dev", "", http.StatusOK},
+		{"prod", "", http.StatusNotFound},
+		{"prod", "Bearer wrong", http.StatusNotFound},
+		{"prod", "Bearer metrics-secret", http.StatusOK},
+	}
+	for i, test := range table {
+		config.Env = test.env
+		r := newTestRequest(t, "GET", "/metrics", nil)
+		if test.auth != "" {
+			r.Header.Set("authorization", test.auth)
+		}
+		w := httptest.NewRecorder()
+		serveMetrics(w, r)
+		if w.Code != test.code {
+			t.Errorf("%d: w.Code = %d; want %d", i, w.Code, test.code)
+		}
+		if test.code != http.StatusOK {
+			continue
+		}
+		for _, want := range []string{
+			`iowa_http_requests_total{route="/test",method="GET",code="418"} 1`,
+			`iowa_http_requests_total{route="/test",method="other",code="418"} 1`,
+		} {
+			if !strings.Contains(w.Body.String(), want) {
+				t.Errorf("%d: no %s in\n%s", i, want, w.Body.String())
+			}
+		}
+		if strings.Contains(w.Body.String(), "MADEUP") {
+			t.Errorf("%d: MADEUP method is recorded", i)
+		}
+	}
+}
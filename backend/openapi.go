@@ -0,0 +1,204 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// serveOpenAPI responds with OpenAPI 3 description of all public API routes.
+func serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	c := newContext(r)
+	if err := json.NewEncoder(w).Encode(openAPIDoc(routes)); err != nil {
+		errorf(c, "serveOpenAPI: %v", err)
+	}
+}
+
+// openAPIDoc generates OpenAPI 3 document from the routes metadata.
+func openAPIDoc(routes map[string]*routeInfo) map[string]interface{} {
+	schemas := openAPISchemas{}
+	paths := make(map[string]interface{})
+	for pattern, ri := range routes {
+		if ri == nil || ri.Internal {
+			continue
+		}
+		var params []interface{}
+		if ri.Param != "" && strings.HasSuffix(pattern, "/") {
+			pattern += "{" + ri.Param + "}"
+			params = append(params, map[string]interface{}{
+				"name":     ri.Param,
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]interface{}{"type": "string"},
+			})
+		}
+		item := make(map[string]interface{})
+		for _, op := range ri.Ops {
+			item[strings.ToLower(op.Method)] = schemas.operation(ri, op, params)
+		}
+		paths[pattern] = item
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.0",
+		"info": map[string]interface{}{
+			"title":   "Google I/O 2015 web app API",
+			"version": "1.0",
+		},
+		"servers": []interface{}{map[string]interface{}{"url": config.Prefix}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				authBearer:  map[string]interface{}{"type": "http", "scheme": "bearer"},
+				authSWToken: map[string]interface{}{"type": "apiKey", "in": "header", "name": "Authorization"},
+				authSync:    map[string]interface{}{"type": "apiKey", "in": "header", "name": "Authorization"},
+				authSession: map[string]interface{}{"type": "apiKey", "in": "cookie", "name": sessionCookie},
+			},
+		},
+	}
+}
+
+// openAPISchemas are named schemas of Go types,
+// referenced from operations with "#/components/schemas/name".
+type openAPISchemas map[string]interface{}
+
+// operation returns OpenAPI operation object of op.
+func (s openAPISchemas) operation(ri *routeInfo, op *routeOp, params []interface{}) map[string]interface{} {
+	summary := op.Summary
+	if summary == "" {
+		summary = ri.Summary
+	}
+	res := map[string]interface{}{"description": "OK"}
+	if op.Res != nil {
+		ctype := op.ResType
+		if ctype == "" {
+			ctype = "application/json"
+		}
+		res["content"] = map[string]interface{}{
+			ctype: map[string]interface{}{"schema": s.schema(reflect.TypeOf(op.Res))},
+		}
+	}
+	o := map[string]interface{}{
+		"summary":   summary,
+		"responses": map[string]interface{}{"200": res},
+	}
+	if len(params) > 0 {
+		o["parameters"] = params
+	}
+	if op.Req != nil {
+		o["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": s.schema(reflect.TypeOf(op.Req))},
+			},
+		}
+	}
+	if op.Auth != authNone {
+		var sec []interface{}
+		for _, a := range strings.Fields(op.Auth) {
+			sec = append(sec, map[string]interface{}{a: []string{}})
+		}
+		o["security"] = sec
+	}
+	return o
+}
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+// schema returns OpenAPI schema of type t, as encoded with encoding/json.
+// Named struct types are added to s and referenced.
+func (s openAPISchemas) schema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Implements(marshalerType) || reflect.PtrTo(t).Implements(marshalerType):
+		// custom encoding; can't tell
+		return map[string]interface{}{}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": s.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": s.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.object(t)
+		}
+		ref := map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+		if _, ok := s[t.Name()]; !ok {
+			// placeholder for recursive types
+			s[t.Name()] = nil
+			s[t.Name()] = s.object(t)
+		}
+		return ref
+	}
+	return map[string]interface{}{}
+}
+
+// object returns OpenAPI schema of struct type t.
+// Fields of embedded structs are inlined, as with encoding/json.
+func (s openAPISchemas) object(t reflect.Type) map[string]interface{} {
+	props := make(map[string]interface{})
+	s.addProps(props, t)
+	return map[string]interface{}{"type": "object", "properties": props}
+}
+
+func (s openAPISchemas) addProps(props map[string]interface{}, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			s.addProps(props, f.Type)
+			continue
+		}
+		if f.PkgPath != "" {
+			// unexported
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = s.schema(f.Type)
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// registerTestHandlers calls registerHandlers without touching http.DefaultServeMux
+// and returns registered patterns.
+// The returned func restores original state.
+func registerTestHandlers() ([]string, func()) {
+	origHandle, origRoutes := httpHandle, routes
+	var patterns []string
+	httpHandle = func(p string, h http.Handler) {
+		patterns = append(patterns, p)
+	}
+	routes = make(map[string]*routeInfo)
+	registerHandlers()
+	return patterns, func() {
+		httpHandle, routes = origHandle, origRoutes
+	}
+}
+
+func TestRoutesHaveInfo(t *testing.T) {
+	defer preserveConfig()()
+	config.Env = "dev"
+	config.Prefix = "/pref"
+	patterns, restore := registerTestHandlers()
+	defer restore()
+
+	if len(patterns) == 0 {
+		t.Fatal("no routes registered")
+	}
+	registered := make(map[string]bool, len(patterns))
+	for _, p := range patterns {
+		registered[p] = true
+	}
+	// registered directly on the mux; not part of the API
+	noInfo := []string{
+		"/", // root redirect of a prefixed app
+		"/healthz",
+		"/readyz",
+		"/_ah/warmup",
+		"/pref/admin/",
+	}
+	for _, p := range noInfo {
+		if !registered[p] {
+			t.Errorf("%s: allowlisted but not registered", p)
+		}
+		delete(registered, p)
+	}
+	for p := range routes {
+		pp := prefixedPattern(p)
+		if !registered[pp] {
+			t.Errorf("%s: has routeInfo but is not registered", p)
+		}
+		delete(registered, pp)
+	}
+	for p := range registered {
+		t.Errorf("%s: registered without routeInfo", p)
+	}
+
+	for p, ri := range routes {
+		if ri == nil {
+			t.Errorf("%s: no routeInfo", p)
+			continue
+		}
+		if len(ri.Ops) == 0 {
+			t.Errorf("%s: no operations", p)
+		}
+		for i, op := range ri.Ops {
+			if op.Method == "" {
+				t.Errorf("%s: Ops[%d].Method is empty", p, i)
+			}
+		}
+		if !ri.Internal && ri.Summary == "" {
+			t.Errorf("%s: public route has no summary", p)
+		}
+	}
+}
+
+func TestServeOpenAPI(t *testing.T) {
+	defer preserveConfig()()
+	config.Env = "dev"
+	_, restore := registerTestHandlers()
+	defer restore()
+
+	r := newTestRequest(t, "GET", "/api/v1/openapi.json", nil)
+	w := httptest.NewRecorder()
+	serveOpenAPI(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("w.Code = %d; want 200", w.Code)
+	}
+	var doc struct {
+		OpenAPI    string                                       `json:"openapi"`
+		Paths      map[string]map[string]map[string]interface{} `json:"paths"`
+		Components struct {
+			Schemas map[string]interface{} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("json.Unmarshal(%s): %v", w.Body.String(), err)
+	}
+	if doc.OpenAPI != "3.0.0" {
+		t.Errorf("doc.OpenAPI = %q; want 3.0.0", doc.OpenAPI)
+	}
+
+	table := []struct {
+		path, method string
+		present      bool
+	}{
+		{"/api/v1/schedule", "get", true},
+		{"/api/v1/user/schedule/{sid}", "put", true},
+		{"/api/v1/user/schedule/{sid}", "delete", true},
+		{"/api/v1/user/updates", "get", true},
+		{"/task/clock", "get", false},
+		{"/", "get", false},
+	}
+	for i, test := range table {
+		_, ok := doc.Paths[test.path][test.method]
+		if ok != test.present {
+			t.Errorf("%d: %s %s present = %v; want %v", i, test.method, test.path, ok, test.present)
+		}
+	}
+	for _, name := range []string{"eventSession", "dataChanges", "userPush"} {
+		if _, ok := doc.Components.Schemas[name]; !ok {
+			t.Errorf("no %q in doc.Components.Schemas", name)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// protoContentType is the media type of protobuf-encoded responses.
+// See ioweb.proto for the messages schema.
+const protoContentType = "application/x-protobuf"
+
+// protobuf wire types
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+)
+
+// acceptsProto returns true if the client of r asked for the protobuf wire format
+// with Accept header, and prefers it over JSON.
+func acceptsProto(r *http.Request) bool {
+	for _, v := range strings.Split(r.Header.Get("accept"), ",") {
+		t, params, err := mime.ParseMediaType(strings.TrimSpace(v))
+		if err != nil {
+			continue
+		}
+		if t != protoContentType && t != "application/protobuf" {
+			continue
+		}
+		return params["q"] != "0"
+	}
+	return false
+}
+
+// protoEncoder is a minimal encoder of protobuf messages.
+// Fields with default values are omitted, as in proto3.
+type protoEncoder struct {
+	buf []byte
+}
+
+func (e *protoEncoder) tag(field, wire int) {
+	e.uvarint(uint64(field)<<3 | uint64(wire))
+}
+
+func (e *protoEncoder) uvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	e.buf = append(e.buf, b[:n]...)
+}
+
+func (e *protoEncoder) string(field int, s string) {
+	if s == "" {
+		return
+	}
+	e.tag(field, protoBytes)
+	e.uvarint(uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *protoEncoder) strings(field int, list []string) {
+	for _, s := range list {
+		e.tag(field, protoBytes)
+		e.uvarint(uint64(len(s)))
+		e.buf = append(e.buf, s...)
+	}
+}
+
+func (e *protoEncoder) bool(field int, v bool) {
+	if !v {
+		return
+	}
+	e.tag(field, protoVarint)
+	e.uvarint(1)
+}
+
+func (e *protoEncoder) int64(field int, v int64) {
+	if v == 0 {
+		return
+	}
+	e.tag(field, protoVarint)
+	e.uvarint(uint64(v))
+}
+
+func (e *protoEncoder) double(field int, v float64) {
+	if v == 0 {
+		return
+	}
+	e.tag(field, protoFixed64)
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+	e.buf = append(e.buf, b[:]...)
+}
+
+// time encodes t as milliseconds since the Unix epoch.
+func (e *protoEncoder) time(field int, t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	e.int64(field, t.UnixNano()/int64(time.Millisecond))
+}
+
+// message encodes an embedded message written by fn.
+// Unlike scalar fields, it is always present in the output.
+func (e *protoEncoder) message(field int, fn func(*protoEncoder)) {
+	sub := &protoEncoder{}
+	fn(sub)
+	e.tag(field, protoBytes)
+	e.uvarint(uint64(len(sub.buf)))
+	e.buf = append(e.buf, sub.buf...)
+}
+
+// mapEntry encodes a map<string, V> entry with key k and value written by fn.
+func (e *protoEncoder) mapEntry(field int, k string, fn func(*protoEncoder)) {
+	e.message(field, func(e *protoEncoder) {
+		e.string(1, k)
+		e.message(2, fn)
+	})
+}
+
+func (s *eventSession) marshalProto(e *protoEncoder) {
+	e.string(1, s.Id)
+	e.string(2, s.Title)
+	e.string(3, s.Desc)
+	e.time(4, s.StartTime)
+	e.time(5, s.EndTime)
+	e.bool(6, s.IsLive)
+	e.bool(7, s.IsFeatured)
+	e.strings(8, s.Tags)
+	e.strings(9, s.Speakers)
+	e.string(10, s.Room)
+	e.string(11, s.Photo)
+	e.string(12, s.YouTube)
+	e.bool(13, s.HasRelated)
+	for _, r := range s.Related {
+		e.string(14, r.Id)
+	}
+	e.int64(15, int64(s.Day))
+	e.string(16, s.Block)
+	e.string(17, s.Start)
+	e.string(18, s.End)
+	for _, k := range sortedKeys(s.Filters) {
+		v := s.Filters[k]
+		e.message(19, func(e *protoEncoder) {
+			e.string(1, k)
+			e.bool(2, v)
+		})
+	}
+	e.string(20, s.Update)
+}
+
+func (s *eventSpeaker) marshalProto(e *protoEncoder) {
+	e.string(1, s.Id)
+	e.string(2, s.Name)
+	e.string(3, s.Bio)
+	e.string(4, s.Company)
+	e.string(5, s.Thumb)
+	e.string(6, s.Plusone)
+	e.string(7, s.Twitter)
+}
+
+func (v *eventVideo) marshalProto(e *protoEncoder) {
+	e.string(1, v.Id)
+	e.string(2, v.Title)
+	e.string(3, v.Desc)
+	e.string(4, v.Topic)
+	e.string(5, v.Speakers)
+	e.string(6, v.Thumb)
+}
+
+func (t *eventTag) marshalProto(e *protoEncoder) {
+	e.int64(1, int64(t.Order))
+	e.string(2, t.Tag)
+	e.string(3, t.Name)
+	e.string(4, t.Cat)
+}
+
+func (x *extEntry) marshalProto(e *protoEncoder) {
+	e.string(1, x.Name)
+	e.string(2, x.Link)
+	e.string(3, x.City)
+	e.double(4, x.Lat)
+	e.double(5, x.Lng)
+}
+
+func (a *announcement) marshalProto(e *protoEncoder) {
+	e.string(1, a.ID)
+	e.string(2, a.Title)
+	e.string(3, a.Body)
+	e.string(4, a.Link)
+	e.string(5, a.Target)
+	e.time(6, a.SendAt)
+	e.bool(7, a.Sent)
+}
+
+// marshalProto encodes s as ioweb.Schedule message.
+func (s *apiSchedule) marshalProto() []byte {
+	e := &protoEncoder{}
+	for _, item := range s.Sessions {
+		e.message(1, item.marshalProto)
+	}
+	for _, item := range s.Videos {
+		e.message(2, item.marshalProto)
+	}
+	for _, k := range sortedKeys(s.Speakers) {
+		e.mapEntry(3, k, s.Speakers[k].marshalProto)
+	}
+	for _, k := range sortedKeys(s.Tags) {
+		e.mapEntry(4, k, s.Tags[k].marshalProto)
+	}
+	return e.buf
+}
+
+// marshalProto encodes dc as ioweb.DataChanges message.
+func (dc *dataChanges) marshalProto() []byte {
+	e := &protoEncoder{}
+	e.string(1, dc.Token)
+	e.time(2, dc.Updated)
+	for _, k := range sortedKeys(dc.Sessions) {
+		e.mapEntry(3, k, dc.Sessions[k].marshalProto)
+	}
+	for _, k := range sortedKeys(dc.Speakers) {
+		e.mapEntry(4, k, dc.Speakers[k].marshalProto)
+	}
+	for _, k := range sortedKeys(dc.Videos) {
+		e.mapEntry(5, k, dc.Videos[k].marshalProto)
+	}
+	for _, k := range sortedKeys(dc.Tags) {
+		e.mapEntry(6, k, dc.Tags[k].marshalProto)
+	}
+	for _, item := range dc.IoExt {
+		e.message(7, item.marshalProto)
+	}
+	for _, item := range dc.Announcements {
+		e.message(8, item.marshalProto)
+	}
+	return e.buf
+}
+
+// sortedKeys returns keys of m, which must be a map with string keys,
+// in ascending order, so that the encoded output is deterministic.
+func sortedKeys(m interface{}) []string {
+	v := reflect.ValueOf(m)
+	keys := make([]string, 0, v.Len())
+	for _, k := range v.MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,210 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+)
+
+func TestAcceptsProto(t *testing.T) {
+	table := []struct {
+		accept string
+		proto  bool
+	}{
+		{"", false},
+		{"application/json", false},
+		{"application/x-protobuf", true},
+		{"application/json, application/protobuf", true},
+		{"application/x-protobuf;q=0", false},
+		{"*/*", false},
+	}
+	for i, test := range table {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Header.Set("accept", test.accept)
+		if v := acceptsProto(r); v != test.proto {
+			t.Errorf("%d: acceptsProto(%q) = %v; want %v", i, test.accept, v, test.proto)
+		}
+	}
+}
+
+func TestMarshalProto(t *testing.T) {
+	e := &protoEncoder{}
+	(&eventTag{Order: 1, Tag: "t", Name: "n"}).marshalProto(e)
+	want := []byte{0x08, 0x01, 0x12, 0x01, 't', 0x1a, 0x01, 'n'}
+	if !bytes.Equal(e.buf, want) {
+		t.Errorf("eventTag: % x; want % x", e.buf, want)
+	}
+
+	dc := &dataChanges{
+		Token:   "tok",
+		Updated: time.Unix(1, 0),
+		eventData: eventData{
+			Sessions: map[string]*eventSession{"s": &eventSession{Title: "T"}},
+		},
+	}
+	want = []byte{
+		0x0a, 0x03, 't', 'o', 'k', // token
+		0x10, 0xe8, 0x07, // ts = 1000 ms
+		0x1a, 0x08, // sessions map entry
+		0x0a, 0x01, 's', // key
+		0x12, 0x03, 0x12, 0x01, 'T', // value: Session{title: "T"}
+	}
+	if b := dc.marshalProto(); !bytes.Equal(b, want) {
+		t.Errorf("dataChanges: % x; want % x", b, want)
+	}
+}
+
+func TestMarshalProtoSchedule(t *testing.T) {
+	s := &apiSchedule{
+		Sessions: []*eventSession{{
+			Id:         "sess",
+			Title:      "Title",
+			Desc:       "Desc",
+			StartTime:  time.Unix(1, 0),
+			EndTime:    time.Unix(2, 0),
+			IsLive:     true,
+			IsFeatured: true,
+			Tags:       []string{"tag"},
+			Speakers:   []string{"sp"},
+			Room:       "room",
+			Photo:      "photo",
+			YouTube:    "yt",
+			HasRelated: true,
+			Related:    []*struct{ Id string `json:"id"` }{{Id: "rel"}},
+			Day:        1,
+			Block:      "block",
+			Start:      "start",
+			End:        "end",
+			Filters:    map[string]bool{"f": true},
+			Update:     "update",
+		}},
+		Videos: []*eventVideo{{Id: "vid", Title: "Title", Desc: "Desc", Topic: "topic", Speakers: "sp", Thumb: "thumb"}},
+		Speakers: map[string]*eventSpeaker{"sp": {
+			Id: "sp", Name: "Name", Bio: "Bio", Company: "Co", Thumb: "thumb", Plusone: "plus", Twitter: "tw",
+		}},
+		Tags: map[string]*eventTag{"tag": {Order: 1, Tag: "tag", Name: "Name", Cat: "TOPIC"}},
+	}
+	fields := decodeProtoFields(t, s.marshalProto())
+	if n := len(fields[1]); n != 1 {
+		t.Fatalf("len(sessions) = %d; want 1", n)
+	}
+	compareProtoJSON(t, "Session", fields[1][0].([]byte), s.Sessions[0])
+	if n := len(fields[2]); n != 1 {
+		t.Fatalf("len(video_library) = %d; want 1", n)
+	}
+	compareProtoJSON(t, "Video", fields[2][0].([]byte), s.Videos[0])
+	if n := len(fields[3]); n != 1 {
+		t.Fatalf("len(speakers) = %d; want 1", n)
+	}
+	entry := decodeProtoFields(t, fields[3][0].([]byte))
+	compareProtoJSON(t, "Speaker", entry[2][0].([]byte), s.Speakers["sp"])
+	if n := len(fields[4]); n != 1 {
+		t.Fatalf("len(tags) = %d; want 1", n)
+	}
+	entry = decodeProtoFields(t, fields[4][0].([]byte))
+	compareProtoJSON(t, "Tag", entry[2][0].([]byte), s.Tags["tag"])
+}
+
+// decodeProtoFields decodes message b into values keyed by field numbers.
+// Varint and fixed64 values are uint64, length-delimited ones are []byte.
+func decodeProtoFields(t *testing.T, b []byte) map[int][]interface{} {
+	fields := make(map[int][]interface{})
+	buf := proto.NewBuffer(b)
+	for len(buf.Unread()) > 0 {
+		key, err := buf.DecodeVarint()
+		if err != nil {
+			t.Fatalf("DecodeVarint: %v", err)
+		}
+		var v interface{}
+		switch key & 7 {
+		case protoVarint:
+			v, err = buf.DecodeVarint()
+		case protoFixed64:
+			v, err = buf.DecodeFixed64()
+		case protoBytes:
+			v, err = buf.DecodeRawBytes(true)
+		default:
+			t.Fatalf("field %d: unexpected wire type %d", key>>3, key&7)
+		}
+		if err != nil {
+			t.Fatalf("field %d: %v", key>>3, err)
+		}
+		fields[int(key>>3)] = append(fields[int(key>>3)], v)
+	}
+	return fields
+}
+
+// compareProtoJSON verifies that message b has a field for each JSON field of v,
+// which must have no empty values. Fields of ioweb.proto messages
+// are numbered in the order of their JSON counterparts.
+func compareProtoJSON(t *testing.T, name string, b []byte, v interface{}) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("%s: json.Marshal: %v", name, err)
+	}
+	var vals map[string]interface{}
+	if err := json.Unmarshal(j, &vals); err != nil {
+		t.Fatalf("%s: json.Unmarshal: %v", name, err)
+	}
+	// JSON keys in the order of v fields
+	var keys []string
+	dec := json.NewDecoder(bytes.NewReader(j))
+	dec.Token() // {
+	for dec.More() {
+		k, _ := dec.Token()
+		keys = append(keys, k.(string))
+		var skip json.RawMessage
+		if err := dec.Decode(&skip); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+
+	fields := decodeProtoFields(t, b)
+	if len(fields) != len(keys) {
+		t.Errorf("%s: %d proto fields; want %d of JSON %v", name, len(fields), len(keys), keys)
+	}
+	for i, k := range keys {
+		f := fields[i+1]
+		if len(f) == 0 {
+			t.Errorf("%s: field %d (%s) is missing", name, i+1, k)
+			continue
+		}
+		switch jv := vals[k].(type) {
+		case string:
+			// timestamps are encoded as varint
+			if pb, ok := f[0].([]byte); ok && string(pb) != jv {
+				t.Errorf("%s: %s = %q; want %q", name, k, pb, jv)
+			}
+		case float64:
+			if pv, ok := f[0].(uint64); !ok || float64(pv) != jv {
+				t.Errorf("%s: %s = %v; want %v", name, k, f[0], jv)
+			}
+		case bool:
+			if pv, ok := f[0].(uint64); !ok || pv != 1 {
+				t.Errorf("%s: %s = %v; want %v", name, k, f[0], jv)
+			}
+		case []interface{}:
+			if len(f) != len(jv) {
+				t.Errorf("%s: len(%s) = %d; want %d", name, k, len(f), len(jv))
+			}
+		}
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// forwardedHop is a single hop of a request on its way through proxies:
+// the address it came from, along with the scheme and host it was sent to.
+type forwardedHop struct {
+	addr  string
+	proto string
+	host  string
+}
+
+// forwardedClient returns the hop of r which came from the client.
+// Forwarded or X-Forwarded-* headers are taken into account only if r comes
+// from one of config.trustedProxies. The hops are then walked from the nearest
+// proxy back to the client, until one comes from an address which is not trusted.
+// Missing scheme and host are filled with those r was sent to.
+func forwardedClient(r *http.Request) *forwardedHop {
+	peer := &forwardedHop{addr: stripPort(r.RemoteAddr), proto: "http", host: r.Host}
+	if r.TLS != nil {
+		peer.proto = "https"
+	}
+	if !isTrustedProxy(peer.addr) {
+		return peer
+	}
+	hops := forwardedHops(r.Header)
+	if len(hops) == 0 {
+		return peer
+	}
+	i := len(hops) - 1
+	for i > 0 && isTrustedProxy(hops[i].addr) {
+		i--
+	}
+	h := *hops[i]
+	if h.addr == "" {
+		h.addr = peer.addr
+	}
+	if h.proto == "" {
+		h.proto = peer.proto
+	}
+	if h.host == "" {
+		h.host = peer.host
+	}
+	h.proto = strings.ToLower(h.proto)
+	return &h
+}
+
+// forwardedHops parses Forwarded header as specified in RFC 7239,
+// or X-Forwarded-For, X-Forwarded-Proto and X-Forwarded-Host headers
+// if the former is absent. The returned hops are ordered from the client
+// to the nearest proxy.
+//
+// X-Forwarded-Proto and X-Forwarded-Host values are matched with
+// X-Forwarded-For addresses if there is as many of them. Otherwise, the first
+// value applies to all hops, since it is normally set by the proxy facing clients.
+func forwardedHops(h http.Header) []*forwardedHop {
+	if v := h.Get("forwarded"); v != "" {
+		return parseForwarded(v)
+	}
+	addrs := splitHeader(h, "x-forwarded-for")
+	protos := splitHeader(h, "x-forwarded-proto")
+	hosts := splitHeader(h, "x-forwarded-host")
+	if len(addrs) == 0 {
+		addrs = []string{""}
+	}
+	hops := make([]*forwardedHop, len(addrs))
+	for i, a := range addrs {
+		hops[i] = &forwardedHop{
+			addr:  stripPort(a),
+			proto: matchHopValue(protos, i, len(addrs)),
+			host:  matchHopValue(hosts, i, len(addrs)),
+		}
+	}
+	return hops
+}
+
+// parseForwarded parses RFC 7239 Forwarded header value v, such as
+//
+//     for=192.0.2.43;proto=https, for="[2001:db8:cafe::17]:4711";host=example.org
+//
+// Unknown parameters and malformed pairs are ignored.
+func parseForwarded(v string) []*forwardedHop {
+	var hops []*forwardedHop
+	for _, elem := range strings.Split(v, ",") {
+		hop := &forwardedHop{}
+		for _, pair := range strings.Split(elem, ";") {
+			kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			val := strings.Trim(kv[1], `"`)
+			switch strings.ToLower(kv[0]) {
+			case "for":
+				hop.addr = stripPort(val)
+			case "proto":
+				hop.proto = val
+			case "host":
+				hop.host = val
+			}
+		}
+		hops = append(hops, hop)
+	}
+	return hops
+}
+
+// splitHeader returns comma-separated values of header k, with spaces trimmed.
+func splitHeader(h http.Header, k string) []string {
+	var res []string
+	for _, v := range h[http.CanonicalHeaderKey(k)] {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				res = append(res, s)
+			}
+		}
+	}
+	return res
+}
+
+// matchHopValue returns a value of hop i out of n, see forwardedHops.
+func matchHopValue(values []string, i, n int) string {
+	switch {
+	case len(values) == 0:
+		return ""
+	case len(values) == n:
+		return values[i]
+	}
+	return values[0]
+}
+
+// stripPort returns addr without port and IPv6 brackets.
+func stripPort(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.Trim(addr, "[]")
+}
+
+// isTrustedProxy reports whether IP address addr is in config.trustedProxies.
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range config.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseIPNet parses s as either CIDR notation or a single IP address.
+func parseIPNet(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		return n, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP address %q", s)
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// clientIP returns IP address of the client which sent r.
+func clientIP(r *http.Request) string {
+	return forwardedClient(r).addr
+}
+
+// requestScheme returns the scheme the client used to send r: "https" or "http".
+func requestScheme(r *http.Request) string {
+	if forwardedClient(r).proto == "https" {
+		return "https"
+	}
+	return "http"
+}
+
+// requestHost returns the host the client sent r to.
+func requestHost(r *http.Request) string {
+	return forwardedClient(r).host
+}
+
+// baseURL returns scheme and host of the site: config.baseURL if set,
+// or those of the client request r.
+func baseURL(r *http.Request) *url.URL {
+	if config.baseURL != nil {
+		u := *config.baseURL
+		return &u
+	}
+	return &url.URL{Scheme: requestScheme(r), Host: requestHost(r)}
+}
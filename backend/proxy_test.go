@@ -0,0 +1,168 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/url"
+	"testing"
+)
+
+func setTestTrustedProxies(t *testing.T, proxies ...string) {
+	config.trustedProxies = nil
+	for _, p := range proxies {
+		n, err := parseIPNet(p)
+		if err != nil {
+			t.Fatalf("parseIPNet(%q): %v", p, err)
+		}
+		config.trustedProxies = append(config.trustedProxies, n)
+	}
+}
+
+func TestForwardedClient(t *testing.T) {
+	defer preserveConfig()()
+	setTestTrustedProxies(t, "10.0.0.0/8", "2001:db8::1")
+
+	table := []struct {
+		remote  string
+		tls     bool
+		headers map[string]string
+		addr    string
+		proto   string
+		host    string
+	}{
+		// direct clients
+		{"192.0.2.1:1234", false, nil, "192.0.2.1", "http", "example.org"},
+		{"192.0.2.1:1234", true, nil, "192.0.2.1", "https", "example.org"},
+		{"192.0.2.1:1234", false, map[string]string{
+			"x-forwarded-for":   "203.0.113.1",
+			"x-forwarded-proto": "https",
+			"x-forwarded-host":  "evil.example.com",
+		}, "192.0.2.1", "http", "example.org"},
+		{"[::1]:80", false, map[string]string{"forwarded": "for=203.0.113.1;proto=https"}, "::1", "http", "example.org"},
+		// trusted proxies
+		{"10.0.0.1:1234", false, map[string]string{
+			"x-forwarded-for":   "203.0.113.1",
+			"x-forwarded-proto": "https",
+			"x-forwarded-host":  "www.example.org",
+		}, "203.0.113.1", "https", "www.example.org"},
+		{"10.0.0.1:1234", false, map[string]string{
+			"x-forwarded-for":   "1.1.1.1, 203.0.113.1, 10.0.0.2",
+			"x-forwarded-proto": "HTTPS",
+		}, "203.0.113.1", "https", "example.org"},
+		{"10.0.0.1:1234", false, map[string]string{
+			"x-forwarded-for":   "203.0.113.1, 10.0.0.2",
+			"x-forwarded-proto": "https, http",
+		}, "203.0.113.1", "https", "example.org"},
+		{"10.0.0.1:1234", true, map[string]string{"x-forwarded-host": "www.example.org"},
+			"10.0.0.1", "https", "www.example.org"},
+		{"[2001:db8::1]:443", false, map[string]string{
+			"forwarded":       `for=1.1.1.1;proto=http, for="[2001:db8:cafe::17]:4711";proto=https;host=www.example.org, for=10.0.0.2`,
+			"x-forwarded-for": "198.51.100.1",
+		}, "2001:db8:cafe::17", "https", "www.example.org"},
+		{"10.0.0.1:1234", false, map[string]string{"forwarded": "for=10.0.0.3, for=10.0.0.2;proto=https"},
+			"10.0.0.3", "http", "example.org"},
+	}
+	for i, test := range table {
+		r := newTestRequest(t, "GET", "http://example.org/", nil)
+		r.RemoteAddr = test.remote
+		if test.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		for k, v := range test.headers {
+			r.Header.Set(k, v)
+		}
+		h := forwardedClient(r)
+		if h.addr != test.addr || h.proto != test.proto || h.host != test.host {
+			t.Errorf("%d: forwardedClient() = %+v; want {addr:%s proto:%s host:%s}",
+				i, *h, test.addr, test.proto, test.host)
+		}
+		if v := requestScheme(r); v != test.proto {
+			t.Errorf("%d: requestScheme() = %q; want %q", i, v, test.proto)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	defer preserveConfig()()
+	setTestTrustedProxies(t)
+	table := []struct{ addr, ip string }{
+		{"10.0.0.1:1234", "10.0.0.1"},
+		{"[::1]:80", "::1"},
+		{"10.0.0.2", "10.0.0.2"},
+	}
+	for i, test := range table {
+		r := newTestRequest(t, "GET", "/", nil)
+		r.RemoteAddr = test.addr
+		r.Header.Set("x-forwarded-for", "203.0.113.1")
+		if v := clientIP(r); v != test.ip {
+			t.Errorf("%d: clientIP(%q) = %q; want %q", i, test.addr, v, test.ip)
+		}
+	}
+}
+
+func TestParseIPNet(t *testing.T) {
+	table := []struct {
+		in  string
+		ip  string
+		ok  bool
+		out bool
+	}{
+		{"10.0.0.0/8", "10.1.2.3", true, true},
+		{"10.0.0.1", "10.0.0.1", true, true},
+		{"10.0.0.1", "10.0.0.2", true, false},
+		{"2001:db8::/32", "2001:db8::17", true, true},
+		{"::1", "::1", true, true},
+		{"proxy.example.org", "", false, false},
+		{"10.0.0.0/33", "", false, false},
+	}
+	for i, test := range table {
+		n, err := parseIPNet(test.in)
+		if (err == nil) != test.ok {
+			t.Errorf("%d: parseIPNet(%q): err = %v; want ok = %v", i, test.in, err, test.ok)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if v := n.Contains(net.ParseIP(test.ip)); v != test.out {
+			t.Errorf("%d: %s.Contains(%s) = %v; want %v", i, n, test.ip, v, test.out)
+		}
+	}
+}
+
+func TestCanonicalURLBase(t *testing.T) {
+	defer preserveConfig()()
+	setTestTrustedProxies(t, "10.0.0.1")
+	config.Prefix = "/io2015"
+
+	r := newTestRequest(t, "GET", "http://internal:8080/io2015/schedule", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("x-forwarded-proto", "https")
+	r.Header.Set("x-forwarded-host", "events.example.org")
+	q := url.Values{"sid": {"123"}}
+	if v, want := canonicalURL(r, q), "https://events.example.org/io2015/schedule?sid=123"; v != want {
+		t.Errorf("canonicalURL() = %q; want %q", v, want)
+	}
+
+	config.baseURL = &url.URL{Scheme: "https", Host: "www.example.org"}
+	if v, want := canonicalURL(r, q), "https://www.example.org/io2015/schedule?sid=123"; v != want {
+		t.Errorf("canonicalURL() = %q; want %q", v, want)
+	}
+	if config.baseURL.Path != "" {
+		t.Errorf("config.baseURL.Path = %q; want empty", config.baseURL.Path)
+	}
+}
@@ -17,6 +17,7 @@ package main
 import (
 	"bytes"
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
 	"errors"
@@ -39,6 +40,17 @@ const (
 	updateStart   = "start"
 	updateSoon    = "soon"
 	updateSurvey  = "survey"
+
+	// quietTimeFormat is the format of quietHours Start and End.
+	quietTimeFormat = "15:04"
+	// throttling cache keys prefixes, followed by a user ID
+	pingPendingKeyPrefix = "ping:pending:"
+	pingLastKeyPrefix    = "ping:last:"
+	pingCountKeyPrefix   = "ping:count:"
+
+	// notifyBatchSize is the number of users pinged by a single
+	// notify-subscribers task. It can't be more than the task queue batch limit.
+	notifyBatchSize = 100
 )
 
 //  userPush is user notification configuration.
@@ -56,6 +68,12 @@ type userPush struct {
 
 	Ext  ioExtPush  `json:"-" datastore:"ext"`
 	Pext *ioExtPush `json:"ioext,omitempty" datastore:"-"`
+
+	Quiet  quietHours  `json:"-" datastore:"quiet"`
+	Pquiet *quietHours `json:"quiet,omitempty" datastore:"-"`
+
+	// SW tokens issued before this time are rejected.
+	SWRevoked time.Time `json:"-" datastore:"swrev,noindex"`
 }
 
 // ioExtPush is always embedded in the userPush.
@@ -66,6 +84,74 @@ type ioExtPush struct {
 	Lng     float64 `json:"lng" datastore:"lng,noindex"`
 }
 
+// quietHours is a daily period of time when no pings are sent to a user.
+// It is always embedded in the userPush.
+type quietHours struct {
+	Enabled bool `json:"-" datastore:"on"`
+	// Off is true if the user turned quiet hours off,
+	// in which case config.Push defaults don't apply either.
+	Off bool `json:"-" datastore:"off,noindex"`
+	// Start and End are in "15:04" format.
+	// End may be before Start, in which case the period spans midnight.
+	Start string `json:"start" datastore:"s,noindex"`
+	End   string `json:"end" datastore:"e,noindex"`
+	// Timezone defaults to config.Schedule.Location if empty.
+	Timezone string `json:"timezone,omitempty" datastore:"tz,noindex"`
+}
+
+// valid returns true if q has valid Start, End and Timezone values.
+func (q *quietHours) valid() bool {
+	if _, err := time.Parse(quietTimeFormat, q.Start); err != nil {
+		return false
+	}
+	if _, err := time.Parse(quietTimeFormat, q.End); err != nil {
+		return false
+	}
+	if q.Timezone == "" {
+		return true
+	}
+	_, err := time.LoadLocation(q.Timezone)
+	return err == nil
+}
+
+// until returns the end of quiet period if now is within q,
+// or zero time otherwise.
+func (q *quietHours) until(now time.Time) time.Time {
+	var zero time.Time
+	loc := config.Schedule.Location
+	if q.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(q.Timezone); err != nil {
+			return zero
+		}
+	}
+	start, err1 := time.Parse(quietTimeFormat, q.Start)
+	end, err2 := time.Parse(quietTimeFormat, q.End)
+	if err1 != nil || err2 != nil || start.Equal(end) {
+		return zero
+	}
+
+	now = now.In(loc)
+	y, m, d := now.Date()
+	day := func(t time.Time, offset int) time.Time {
+		return time.Date(y, m, d+offset, t.Hour(), t.Minute(), 0, 0, loc)
+	}
+	if start.Before(end) {
+		if s, e := day(start, 0), day(end, 0); !now.Before(s) && now.Before(e) {
+			return e
+		}
+		return zero
+	}
+	// the period spans midnight
+	if s := day(start, 0); !now.Before(s) {
+		return day(end, 1)
+	}
+	if e := day(end, 0); now.Before(e) {
+		return e
+	}
+	return zero
+}
+
 // dataChanges represents a diff between two versions of data.
 // See diff funcs for more details, e.g. diffEventData().
 // TODO: add GobEncoder/Decoder to use gob instead of json when storing in DB.
@@ -73,13 +159,17 @@ type dataChanges struct {
 	Token   string    `json:"token"`
 	Updated time.Time `json:"ts"`
 	eventData
-	// TODO: add ioext data...  anything else?
+	// new or modified I/O Extended events, see diffIOExtEntries()
+	IoExt []*extEntry `json:"ioext,omitempty"`
+	// admin announcements, see sendAnnouncement()
+	Announcements []*announcement `json:"announcements,omitempty"`
 }
 
 // isEmptyChange returns true if d is nil or its exported fields contain no items.
 // d.Token and d.Changed are not considered.
 func isEmptyChanges(d *dataChanges) bool {
-	return d == nil || (len(d.Sessions) == 0 && len(d.Speakers) == 0 && len(d.Videos) == 0 && len(d.Tags) == 0)
+	return d == nil || (len(d.Sessions) == 0 && len(d.Speakers) == 0 && len(d.Videos) == 0 && len(d.Tags) == 0 &&
+		len(d.IoExt) == 0 && len(d.Announcements) == 0)
 }
 
 // mergeChanges copies changes from src to dst.
@@ -113,13 +203,39 @@ func mergeChanges(dst *dataChanges, src *dataChanges) {
 	}
 	dst.Videos = videos
 
+	// more recent ioext entries replace older ones with the same link
+	for _, e := range src.IoExt {
+		replaced := false
+		for i, de := range dst.IoExt {
+			if de.Link == e.Link {
+				dst.IoExt[i] = e
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			dst.IoExt = append(dst.IoExt, e)
+		}
+	}
+	// announcements are never modified once sent
+	seen := make(map[string]bool, len(dst.Announcements))
+	for _, a := range dst.Announcements {
+		seen[a.ID] = true
+	}
+	for _, a := range src.Announcements {
+		if !seen[a.ID] {
+			dst.Announcements = append(dst.Announcements, a)
+		}
+	}
+
 	dst.Updated = src.Updated
 }
 
-// filterUserChanges reduces dc to a subset matching session IDs to bks.
+// filterUserChanges reduces dc to a subset matching session IDs to bks
+// and I/O Extended events near ext location.
 // It sorts bks with sort.Strings as a side effect.
-// TODO: add ioext to dc and filter on radius for ioExtPush.Lat+Lng.
 func filterUserChanges(dc *dataChanges, bks []string, ext *ioExtPush) {
+	dc.IoExt = nearbyIOExtEntries(dc.IoExt, ext)
 	sort.Strings(bks)
 	for id, s := range dc.Sessions {
 		if s.Update == updateSurvey {
@@ -133,6 +249,194 @@ func filterUserChanges(dc *dataChanges, bks []string, ext *ioExtPush) {
 	}
 }
 
+// userQuietHours returns quiet hours of user push config pi,
+// or the default ones from config.Push if pi has none.
+func userQuietHours(pi *userPush) *quietHours {
+	if pi.Quiet.Off {
+		return &quietHours{}
+	}
+	if pi.Pquiet != nil {
+		return pi.Pquiet
+	}
+	return &quietHours{
+		Enabled: config.Push.QuietStart != "",
+		Start:   config.Push.QuietStart,
+		End:     config.Push.QuietEnd,
+	}
+}
+
+// pingSlot is a ping time reserved with reservePing.
+type pingSlot struct {
+	// delay is the duration to wait before pinging user devices.
+	delay time.Duration
+
+	uid      string
+	countKey string    // window counter charged for the ping, if any
+	countEnd time.Time // end of the countKey window
+	pending  bool      // whether the pending marker is set
+	last     bool      // whether the last ping time is set
+	prevLast []byte    // previous last ping time, if any
+}
+
+// reservePing returns a slot with the duration to wait before user devices of pi
+// can be pinged, honouring quiet hours, config.Push.MaxPings budget
+// and config.Push.coalesce interval.
+// The slot should be released if the ping could not be scheduled.
+//
+// The returned slot is nil if a delayed ping is already scheduled for the user,
+// in which case the caller should not ping user devices at all:
+// the scheduled ping will make the client fetch all pending changes at once.
+func reservePing(c context.Context, pi *userPush, now time.Time) (*pingSlot, error) {
+	s := &pingSlot{uid: pi.userID}
+	pendingKey := pingPendingKeyPrefix + pi.userID
+	lastKey := pingLastKeyPrefix + pi.userID
+	if _, err := cache.get(c, pendingKey); err == nil {
+		return nil, nil
+	}
+
+	at := now
+	if q := userQuietHours(pi); q.Enabled {
+		if t := q.until(now); t.After(at) {
+			at = t
+		}
+	}
+	if coalesce := config.Push.coalesce; coalesce > 0 {
+		if b, err := cache.get(c, lastKey); err == nil {
+			s.prevLast = b
+			sec, _ := strconv.ParseInt(string(b), 10, 64)
+			if t := time.Unix(sec, 0).Add(coalesce); t.After(at) {
+				at = t
+			}
+		}
+	}
+	if window := config.Push.window; config.Push.MaxPings > 0 && window > 0 {
+		// count pings in the window at falls into
+		// and move on to the next window if the budget is exhausted
+		for {
+			start := at.Truncate(window)
+			key := fmt.Sprintf("%s%s:%d", pingCountKeyPrefix, pi.userID, start.Unix())
+			// the counter is not needed after the window ends
+			exp := start.Add(window).Sub(now)
+			n, err := cache.inc(c, key, 1, 0, exp)
+			if err != nil {
+				return nil, err
+			}
+			if n <= uint64(config.Push.MaxPings) {
+				s.countKey, s.countEnd = key, start.Add(window)
+				break
+			}
+			// keep the count exact so that released slots can be reused
+			if _, err := cache.inc(c, key, -1, 0, exp); err != nil {
+				return nil, err
+			}
+			at = start.Add(window)
+		}
+	}
+
+	s.delay = at.Sub(now)
+	if s.delay < 0 {
+		s.delay = 0
+	}
+	last := []byte(strconv.FormatInt(at.Unix(), 10))
+	if s.delay > 0 {
+		// only one delayed ping at a time, even with concurrent callers
+		err := cache.add(c, pendingKey, last, s.delay)
+		if err == errNotStored {
+			s.release(c)
+			return nil, nil
+		}
+		if err != nil {
+			s.release(c)
+			return nil, err
+		}
+		s.pending = true
+	}
+	// remember the ping time so that next pings are coalesced
+	if config.Push.coalesce > 0 {
+		if err := cache.set(c, lastKey, last, s.delay+config.Push.coalesce); err != nil {
+			errorf(c, "reservePing: %v", err)
+		} else {
+			s.last = true
+		}
+	}
+	return s, nil
+}
+
+// release gives the reserved slot back: it refunds the pings budget,
+// removes the pending marker and restores the last ping time.
+// Errors are logged but otherwise ignored.
+func (s *pingSlot) release(c context.Context) {
+	if exp := s.countEnd.Sub(time.Now()); s.countKey != "" && exp > 0 {
+		if _, err := cache.inc(c, s.countKey, -1, 0, exp); err != nil {
+			errorf(c, "pingSlot.release: %v", err)
+		}
+	}
+	var keys []string
+	if s.pending {
+		keys = append(keys, pingPendingKeyPrefix+s.uid)
+	}
+	lastKey := pingLastKeyPrefix + s.uid
+	switch {
+	case s.last && s.prevLast != nil:
+		if err := cache.set(c, lastKey, s.prevLast, config.Push.coalesce); err != nil {
+			errorf(c, "pingSlot.release: %v", err)
+		}
+	case s.last:
+		keys = append(keys, lastKey)
+	}
+	if len(keys) > 0 {
+		if err := cache.deleleMulti(c, keys); err != nil {
+			errorf(c, "pingSlot.release: %v", err)
+		}
+	}
+}
+
+// broadcast is a progress record of a single notify-subscribers fan-out.
+type broadcast struct {
+	ID      string    `json:"id" datastore:"-"`
+	Started time.Time `json:"started" datastore:"start,noindex"`
+	Updated time.Time `json:"updated" datastore:"upd,noindex"`
+	// Batches is the number of completed batches.
+	Batches int  `json:"batches" datastore:"batches,noindex"`
+	Users   int  `json:"users" datastore:"users,noindex"`
+	Done    bool `json:"done" datastore:"done,noindex"`
+}
+
+// newBroadcastID returns a new unique broadcast ID,
+// suitable for use in task names.
+func newBroadcastID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%d-%x", time.Now().Unix(), b)
+}
+
+// recordBroadcastBatch marks batch of broadcast id as completed
+// with n users pinged, creating the progress record if needed.
+// Batches are processed in order, so a batch recorded earlier is not counted twice,
+// which makes it safe to call on a task retry.
+func recordBroadcastBatch(c context.Context, id string, batch, n int, done bool) (*broadcast, error) {
+	var b *broadcast
+	err := runInTransaction(c, func(c context.Context) error {
+		var err error
+		b, err = getBroadcast(c, id)
+		switch {
+		case err == errNotFound:
+			b = &broadcast{ID: id, Started: time.Now()}
+		case err != nil:
+			return err
+		}
+		if batch < b.Batches {
+			return nil
+		}
+		b.Batches = batch + 1
+		b.Users += n
+		b.Done = done
+		b.Updated = time.Now()
+		return storeBroadcast(c, b)
+	})
+	return b, err
+}
+
 // pingDevice sends a "ping" message to the subscribed device.
 // It follows HTTP Push spec https://tools.ietf.org/html/draft-thomson-webpush-http2.
 //
@@ -140,8 +444,11 @@ func filterUserChanges(dc *dataChanges, bks []string, ext *ioExtPush) {
 // will be of type *pushError with RetryAfter >= 0.
 // If returned string value is non-zero, it contains a new endpoint
 // to be used instead of the old one from now on.
-func pingDevice(c context.Context, endpoint string) (string, error) {
+func pingDevice(c context.Context, endpoint string) (s string, err error) {
+	service := "webpush"
+	defer func() { pushPings.inc(service, pushResult(err)) }()
 	if u := config.Google.GCM.Endpoint; u != "" && strings.HasPrefix(endpoint, u) {
+		service = "gcm"
 		return pingGCM(c, endpoint)
 	}
 
@@ -172,6 +479,20 @@ func pingDevice(c context.Context, endpoint string) (string, error) {
 	return "", perr
 }
 
+// pushResult returns pushPings result label of pingDevice error err.
+func pushResult(err error) string {
+	pe, ok := err.(*pushError)
+	switch {
+	case err == nil:
+		return "ok"
+	case ok && pe.remove:
+		return "remove"
+	case ok && pe.retry:
+		return "retry"
+	}
+	return "error"
+}
+
 // pingGCM is a special case of pingDevice for GCM endpoints.
 func pingGCM(c context.Context, endpoint string) (string, error) {
 	reg, endpoint := extractGCMRegistration(endpoint)
@@ -269,47 +590,135 @@ func upgradeSubscribers(regs []string, endpoints []string) []string {
 // swTokenSep is SW token separator used in encode/decodeSWToken.
 var swTokenSep = []byte(" ")
 
-// encodeSWToken returns user ID and timestamp encoded base64 with an HMAC
-// The token format, when base64-decoded is: "uid unix hmac".
+// swTokenVersion is the first part of SW tokens produced by swToken.encode.
+// Tokens with no version are in the legacy "uid unix hmac" format.
+const swTokenVersion = "2"
+
+// swToken is a decoded SW token.
+type swToken struct {
+	// kid is the ID of a key from config.SWToken.Secrets
+	// the token is signed with.
+	kid  string
+	user string
+	// since is the timestamp of the last changes the client has seen.
+	since time.Time
+	// issued is when the token was first issued to the client,
+	// which is preserved across the token updates.
+	issued time.Time
+}
+
+// encodeSWToken returns a new token for user uid with changes timestamp t,
+// issued now and signed with the current key.
 func encodeSWToken(uid string, t time.Time) (string, error) {
-	if config.Secret == "" {
+	tok := &swToken{user: uid, since: t, issued: time.Now()}
+	return tok.encode()
+}
+
+// encode returns t encoded base64 and signed with the current key,
+// setting t.kid accordingly.
+// The token format, when base64-decoded is: "version kid uid since issued hmac".
+func (t *swToken) encode() (string, error) {
+	kid, secret := swTokenSecret("")
+	if secret == "" {
 		return "", errors.New("encodeSWToken: secret is not set")
 	}
+	t.kid = kid
 	// TODO: maybe do AES encryption, unless GCM will allow payloads soon
 	// and the whole SWtoken thing becomes redundant.
-	msg := []byte(fmt.Sprintf("%s%s%d", uid, swTokenSep, t.Unix()))
-	mac := hmac.New(sha256.New, []byte(config.Secret))
+	msg := []byte(fmt.Sprintf("%s%s%s%s%s%s%d%s%d", swTokenVersion, swTokenSep,
+		kid, swTokenSep, t.user, swTokenSep, t.since.Unix(), swTokenSep, t.issued.Unix()))
+	mac := hmac.New(sha256.New, []byte(secret))
 	mac.Write(msg)
 	tok := append(msg, swTokenSep...)
 	tok = append(tok, mac.Sum(nil)...)
 	return base64.StdEncoding.EncodeToString(tok), nil
 }
 
-// decodeSWToken decodes t and returns its parts, user ID and timestamp.
-func decodeSWToken(t string) (string, time.Time, error) {
-	var zero time.Time // TODO: find a more elegant way
-	if config.Secret == "" {
-		return "", zero, errors.New("decodeSWToken: secret is not set")
-	}
-	tok, err := base64.StdEncoding.DecodeString(t)
+// decodeSWToken decodes and verifies t.
+// It accepts tokens signed with any of the configured keys,
+// so that a key rotation does not invalidate existing tokens,
+// and rejects those older than config.SWToken.MaxAge.
+// Legacy tokens, with no key ID and issue time, are verified with config.Secret
+// and their changes timestamp is taken as the issue time.
+func decodeSWToken(t string) (*swToken, error) {
+	b, err := base64.StdEncoding.DecodeString(t)
 	if err != nil {
-		return "", zero, fmt.Errorf("decodeSWToken: %v", err)
-	}
-	// "uid unix hmac"
-	parts := bytes.SplitN(tok, swTokenSep, 3)
-	if len(parts) != 3 {
-		return "", zero, errors.New("decodeSWToken: invalid token format")
+		return nil, fmt.Errorf("decodeSWToken: %v", err)
+	}
+	var (
+		tok   *swToken
+		parts [][]byte
+	)
+	if bytes.HasPrefix(b, []byte(swTokenVersion+string(swTokenSep))) {
+		// "version kid uid since issued hmac"
+		parts = bytes.SplitN(b, swTokenSep, 6)
+		if len(parts) != 6 {
+			return nil, errors.New("decodeSWToken: invalid token format")
+		}
+		tok = &swToken{kid: string(parts[1]), user: string(parts[2])}
+		if tok.since, err = parseUnixTime(parts[3]); err != nil {
+			return nil, err
+		}
+		if tok.issued, err = parseUnixTime(parts[4]); err != nil {
+			return nil, err
+		}
+	} else {
+		// legacy "uid unix hmac"
+		parts = bytes.SplitN(b, swTokenSep, 3)
+		if len(parts) != 3 {
+			return nil, errors.New("decodeSWToken: invalid token format")
+		}
+		tok = &swToken{user: string(parts[0])}
+		if tok.since, err = parseUnixTime(parts[1]); err != nil {
+			return nil, err
+		}
+		tok.issued = tok.since
 	}
-	msg := append(parts[0], swTokenSep...)
-	msg = append(msg, parts[1]...)
-	mac := hmac.New(sha256.New, []byte(config.Secret))
+
+	var secret string
+	if tok.kid == "" {
+		secret = config.Secret
+	} else if _, secret = swTokenSecret(tok.kid); secret == "" {
+		return nil, fmt.Errorf("decodeSWToken: unknown key %q", tok.kid)
+	}
+	if secret == "" {
+		return nil, errors.New("decodeSWToken: secret is not set")
+	}
+	n := len(parts) - 1
+	msg := bytes.Join(parts[:n], swTokenSep)
+	mac := hmac.New(sha256.New, []byte(secret))
 	mac.Write(msg)
-	if !hmac.Equal(parts[2], mac.Sum(nil)) {
-		return "", zero, errors.New("decodeSWToken: hmac doesn't match")
+	if !hmac.Equal(parts[n], mac.Sum(nil)) {
+		return nil, errors.New("decodeSWToken: hmac doesn't match")
 	}
-	usec, err := strconv.ParseInt((string(parts[1])), 10, 0)
+	if age := config.SWToken.maxAge; age > 0 && time.Since(tok.issued) > age {
+		return nil, errors.New("decodeSWToken: token expired")
+	}
+	return tok, nil
+}
+
+// swTokenSecret returns the key ID and secret of SW tokens key kid.
+// An empty kid means the current signing key.
+// If no keys are configured, config.Secret is returned with an empty key ID.
+// The returned secret is empty if no such key exists.
+func swTokenSecret(kid string) (string, string) {
+	if len(config.SWToken.Secrets) == 0 {
+		if kid != "" {
+			return "", ""
+		}
+		return "", config.Secret
+	}
+	if kid == "" {
+		kid = config.SWToken.Kid
+	}
+	return kid, config.SWToken.Secrets[kid]
+}
+
+// parseUnixTime parses b as a decimal number of seconds since the Unix epoch.
+func parseUnixTime(b []byte) (time.Time, error) {
+	sec, err := strconv.ParseInt(string(b), 10, 64)
 	if err != nil {
-		return "", zero, errors.New("decodeSWToken: invalid unix timestamp")
+		return time.Time{}, errors.New("decodeSWToken: invalid unix timestamp")
 	}
-	return string(parts[0]), time.Unix(usec, 0), nil
+	return time.Unix(sec, 0), nil
 }
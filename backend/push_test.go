@@ -15,8 +15,14 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
 	"testing"
 	"time"
+
+	"golang.org/x/net/context"
 )
 
 func TestSWToken(t *testing.T) {
@@ -26,10 +32,11 @@ func TestSWToken(t *testing.T) {
 		t.Fatalf("encodeSWToken(%q, %s): %v", u1, t1, err)
 	}
 
-	u2, t2, err := decodeSWToken(token)
+	tok, err := decodeSWToken(token)
 	if err != nil {
 		t.Fatalf("decodeSWToken(%q): %v", token, err)
 	}
+	u2, t2 := tok.user, tok.since
 	if u2 != u1 {
 		t.Errorf("u2 = %q; want %q", u2, u1)
 	}
@@ -37,3 +44,223 @@ func TestSWToken(t *testing.T) {
 		t.Errorf("t2 = %s; want %s", t2, t1)
 	}
 }
+
+func TestSWTokenRotation(t *testing.T) {
+	defer preserveConfig()()
+	// legacy "uid unix hmac" token signed with config.Secret
+	legacy := func(uid string, ts time.Time) string {
+		msg := []byte(fmt.Sprintf("%s %d", uid, ts.Unix()))
+		mac := hmac.New(sha256.New, []byte(config.Secret))
+		mac.Write(msg)
+		return base64.StdEncoding.EncodeToString(append(append(msg, ' '), mac.Sum(nil)...))
+	}
+	sign := func(kid string, issued time.Time) string {
+		config.SWToken.Kid = kid
+		tok := &swToken{user: "user-123", since: issued, issued: issued}
+		s, err := tok.encode()
+		if err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+		return s
+	}
+
+	now := time.Now()
+	noKeys := sign("", now)
+	config.SWToken.Secrets = map[string]string{"k1": "secret-1", "k2": "secret-2"}
+	k1 := sign("k1", now)
+	k1old := sign("k1", now.Add(-2*time.Hour))
+	k2 := sign("k2", now)
+	config.SWToken.maxAge = time.Hour
+
+	table := []struct {
+		token string
+		ok    bool
+	}{
+		{noKeys, true},
+		{legacy("user-123", now), true},
+		{legacy("user-123", now.Add(-2*time.Hour)), false},
+		{k1, true},
+		{k1old, false},
+		{k2, true},
+		{k2[:len(k2)-4] + "AAA=", false},
+	}
+	for i, test := range table {
+		tok, err := decodeSWToken(test.token)
+		if test.ok && err != nil {
+			t.Errorf("%d: decodeSWToken(%q): %v", i, test.token, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%d: decodeSWToken(%q) = %+v; want error", i, test.token, tok)
+		}
+		if err == nil && tok.user != "user-123" {
+			t.Errorf("%d: tok.user = %q; want user-123", i, tok.user)
+		}
+	}
+
+	// retired key
+	delete(config.SWToken.Secrets, "k1")
+	if tok, err := decodeSWToken(k1); err == nil {
+		t.Errorf("decodeSWToken(k1) = %+v; want error", tok)
+	}
+}
+
+func TestQuietHoursUntil(t *testing.T) {
+	loc := config.Schedule.Location
+	at := func(h, m int) time.Time {
+		return time.Date(2015, 5, 28, h, m, 0, 0, loc)
+	}
+	table := []struct {
+		start, end string
+		now, until time.Time
+	}{
+		{"22:00", "07:00", at(23, 0), time.Date(2015, 5, 29, 7, 0, 0, 0, loc)},
+		{"22:00", "07:00", at(6, 59), at(7, 0)},
+		{"22:00", "07:00", at(7, 0), time.Time{}},
+		{"22:00", "07:00", at(12, 0), time.Time{}},
+		{"13:00", "14:30", at(13, 15), at(14, 30)},
+		{"13:00", "14:30", at(14, 30), time.Time{}},
+		{"13:00", "13:00", at(13, 0), time.Time{}},
+		{"invalid", "14:30", at(13, 15), time.Time{}},
+	}
+	for i, test := range table {
+		q := &quietHours{Enabled: true, Start: test.start, End: test.end}
+		if v := q.until(test.now); !v.Equal(test.until) {
+			t.Errorf("%d: until(%s) = %s; want %s", i, test.now, v, test.until)
+		}
+	}
+}
+
+func TestReservePing(t *testing.T) {
+	defer preserveConfig()()
+	config.Push.QuietStart = "22:00"
+	config.Push.QuietEnd = "07:00"
+	config.Push.MaxPings = 2
+	config.Push.window = time.Hour
+	config.Push.coalesce = 0
+
+	c := context.Background()
+	loc := config.Schedule.Location
+	now := time.Date(2015, 5, 28, 12, 0, 0, 0, loc)
+
+	// budget
+	pi := &userPush{userID: "budget-user"}
+	for i, want := range []time.Duration{0, 0, time.Hour} {
+		s, err := reservePing(c, pi, now)
+		if err != nil || s == nil {
+			t.Fatalf("%d: reservePing: %v, %v", i, s, err)
+		}
+		if s.delay != want {
+			t.Errorf("%d: s.delay = %s; want %s", i, s.delay, want)
+		}
+	}
+	// coalesced with the pending one
+	if s, _ := reservePing(c, pi, now); s != nil {
+		t.Errorf("s = %+v; want nil", s)
+	}
+	// budget counters expire along with the window
+	if mc, ok := cache.(*memoryCache); ok {
+		key := fmt.Sprintf("%s%s:%d", pingCountKeyPrefix, pi.userID, now.Truncate(time.Hour).Unix())
+		mc.Lock()
+		item := mc.items[key]
+		mc.Unlock()
+		if item == nil || item.exp.IsZero() || item.exp.After(time.Now().Add(time.Hour)) {
+			t.Errorf("mc.items[%q] = %+v; want expiration within an hour", key, item)
+		}
+	}
+
+	// default quiet hours
+	pi = &userPush{userID: "quiet-user"}
+	s, err := reservePing(c, pi, now.Add(11*time.Hour))
+	if err != nil || s == nil {
+		t.Fatalf("reservePing: %v, %v", s, err)
+	}
+	if s.delay != 8*time.Hour {
+		t.Errorf("s.delay = %s; want 8h", s.delay)
+	}
+
+	// user quiet hours
+	pi = &userPush{userID: "own-quiet-user"}
+	pi.Pquiet = &quietHours{Enabled: true, Start: "11:00", End: "12:30"}
+	s, err = reservePing(c, pi, now)
+	if err != nil || s == nil {
+		t.Fatalf("reservePing: %v, %v", s, err)
+	}
+	if s.delay != 30*time.Minute {
+		t.Errorf("s.delay = %s; want 30m", s.delay)
+	}
+
+	// quiet hours turned off, including the defaults
+	pi = &userPush{userID: "no-quiet-user"}
+	pi.Quiet.Off = true
+	s, err = reservePing(c, pi, now.Add(11*time.Hour))
+	if err != nil || s == nil {
+		t.Fatalf("reservePing: %v, %v", s, err)
+	}
+	if s.delay != 0 {
+		t.Errorf("s.delay = %s; want 0", s.delay)
+	}
+}
+
+func TestReservePingRelease(t *testing.T) {
+	defer preserveConfig()()
+	config.Push.QuietStart = ""
+	config.Push.MaxPings = 1
+	config.Push.window = time.Hour
+	config.Push.coalesce = 0
+
+	c := context.Background()
+	now := time.Now()
+	pi := &userPush{userID: "release-user"}
+	s1, err := reservePing(c, pi, now)
+	if err != nil || s1 == nil || s1.delay != 0 {
+		t.Fatalf("reservePing(1): %+v, %v", s1, err)
+	}
+	// budget is exhausted; the next ping is delayed
+	s2, err := reservePing(c, pi, now)
+	if err != nil || s2 == nil || s2.delay == 0 {
+		t.Fatalf("reservePing(2): %+v, %v", s2, err)
+	}
+	// concurrent pings don't schedule another one
+	if s, err := reservePing(c, pi, now); s != nil || err != nil {
+		t.Errorf("reservePing(3) = %+v, %v; want nil, nil", s, err)
+	}
+
+	// released slots are given back
+	s2.release(c)
+	s1.release(c)
+	s, err := reservePing(c, pi, now)
+	if err != nil || s == nil || s.delay != 0 {
+		t.Errorf("reservePing(4) = %+v, %v; want no delay", s, err)
+	}
+}
+
+func TestRecordBroadcastBatch(t *testing.T) {
+	if !isGAEtest {
+		t.Skipf("not implemented yet; isGAEtest = %v", isGAEtest)
+	}
+	defer resetTestState(t)
+
+	c := newContext(newTestRequest(t, "GET", "/dummy", nil))
+	table := []struct {
+		batch, n int
+		done     bool
+		batches  int
+		users    int
+	}{
+		{0, 100, false, 1, 100},
+		{0, 100, false, 1, 100}, // retry
+		{1, 100, false, 2, 200},
+		{2, 42, true, 3, 242},
+		{2, 42, true, 3, 242}, // retry
+	}
+	for i, test := range table {
+		b, err := recordBroadcastBatch(c, "bid", test.batch, test.n, test.done)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if b.Batches != test.batches || b.Users != test.users || b.Done != test.done {
+			t.Errorf("%d: b = %+v; want Batches = %d, Users = %d, Done = %v",
+				i, b, test.batches, test.users, test.done)
+		}
+	}
+}
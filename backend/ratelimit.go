@@ -0,0 +1,119 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var (
+	// authRateLimit limits /api/v1/auth requests per client IP.
+	authRateLimit = &rateLimit{name: "auth", Rate: 10, Per: time.Minute, Burst: 10}
+	// bookmarksRateLimit limits /api/v1/user/schedule requests per user.
+	bookmarksRateLimit = &rateLimit{name: "bookmarks", Rate: 60, Per: time.Minute, Burst: 20}
+	// refreshRateLimit limits ?refresh requests per client IP,
+	// since they force a call to upstream services.
+	refreshRateLimit = &rateLimit{name: "refresh", Rate: 5, Per: time.Minute, Burst: 5}
+)
+
+// rateLimitRetries is the number of times rateLimit.take retries
+// when the bucket of a client is updated concurrently.
+const rateLimitRetries = 5
+
+// rateLimit is a token bucket of Burst tokens, refilled at Rate tokens per Per.
+// Each request takes a token; requests are denied when the bucket is empty.
+//
+// The bucket is kept in the cache as the time it would be full again,
+// also known as the theoretical arrival time of GCRA:
+// each request moves it Per/Rate further into the future,
+// and the bucket is empty when it is more than Burst-1 tokens ahead of now.
+type rateLimit struct {
+	name  string
+	Rate  int
+	Per   time.Duration
+	Burst int
+}
+
+// take takes a token from the bucket of client, which is a user ID or an IP address.
+// It returns zero if the request is allowed, or the time the client should wait
+// until a token is available.
+// The bucket expires from the cache when it is full.
+func (rl *rateLimit) take(c context.Context, client string) (time.Duration, error) {
+	key := fmt.Sprintf("rate:%s:%s", rl.name, client)
+	interval := rl.Per / time.Duration(rl.Rate)
+	tolerance := time.Duration(rl.Burst-1) * interval
+	for i := 0; i < rateLimitRetries; i++ {
+		now := time.Now()
+		full := now
+		old, err := cache.get(c, key)
+		switch {
+		case err == errCacheMiss:
+			old = nil
+		case err != nil:
+			return 0, err
+		default:
+			ns, err := strconv.ParseInt(string(old), 10, 64)
+			if err != nil {
+				return 0, fmt.Errorf("rateLimit.take: %v", err)
+			}
+			if t := time.Unix(0, ns); t.After(now) {
+				full = t
+			}
+		}
+		// denied requests aren't counted
+		if wait := full.Sub(now) - tolerance; wait > 0 {
+			return wait, nil
+		}
+		full = full.Add(interval)
+		exp := full.Sub(now)
+		if exp < time.Second {
+			// subsecond expiration means "never" to memcache
+			exp = time.Second
+		}
+		err = cache.cas(c, key, old, []byte(strconv.FormatInt(full.UnixNano(), 10)), exp)
+		if err != errNotStored {
+			return 0, err
+		}
+	}
+	// too many concurrent requests of the same client
+	return interval, nil
+}
+
+// allowRate counts a request of client with rl. If it exceeds the limit,
+// it responds with 429 Too Many Requests and Retry-After header, and returns false.
+// Cache errors are logged and the request is allowed.
+func allowRate(c context.Context, w http.ResponseWriter, rl *rateLimit, client string) bool {
+	wait, err := rl.take(c, client)
+	if err != nil {
+		errorf(c, "allowRate(%s): %v", rl.name, err)
+		return true
+	}
+	if wait == 0 {
+		return true
+	}
+	secs := int((wait + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	writeJSONError(c, w, http.StatusTooManyRequests, &apiError{
+		code:    http.StatusTooManyRequests,
+		msg:     "rate limit exceeded",
+		details: map[string]interface{}{"retryAfter": secs},
+	})
+	return false
+}
@@ -0,0 +1,84 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAllowRate(t *testing.T) {
+	defer resetTestState(t)
+	c := newContext(newTestRequest(t, "GET", "/", nil))
+	rl := &rateLimit{name: "test", Rate: 1, Per: time.Hour, Burst: 3}
+
+	for i := 0; i < rl.Burst; i++ {
+		w := httptest.NewRecorder()
+		if !allowRate(c, w, rl, "client-1") {
+			t.Fatalf("%d: allowRate = false; want true", i)
+		}
+	}
+	w := httptest.NewRecorder()
+	if allowRate(c, w, rl, "client-1") {
+		t.Fatalf("allowRate = true; want false")
+	}
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("w.Code = %d; want %d", w.Code, http.StatusTooManyRequests)
+	}
+	secs, err := strconv.Atoi(w.Header().Get("retry-after"))
+	if err != nil || secs < 1 || secs > int(rl.Per/time.Second) {
+		t.Errorf("Retry-After = %q; want 1..%d", w.Header().Get("retry-after"), int(rl.Per/time.Second))
+	}
+
+	// denied requests keep being denied
+	for i := 0; i < 10; i++ {
+		if allowRate(c, httptest.NewRecorder(), rl, "client-1") {
+			t.Fatalf("%d: allowRate after 429 = true; want false", i)
+		}
+	}
+
+	// other clients have their own counters
+	if !allowRate(c, httptest.NewRecorder(), rl, "client-2") {
+		t.Errorf("allowRate(client-2) = false; want true")
+	}
+}
+
+func TestRateLimitRefill(t *testing.T) {
+	defer resetTestState(t)
+	c := newContext(newTestRequest(t, "GET", "/", nil))
+	// a token every 100ms, up to 2 at once
+	rl := &rateLimit{name: "refill", Rate: 10, Per: time.Second, Burst: 2}
+
+	for i := 0; i < rl.Burst; i++ {
+		if wait, err := rl.take(c, "client"); err != nil || wait != 0 {
+			t.Fatalf("%d: take = %s, %v; want 0", i, wait, err)
+		}
+	}
+	wait, err := rl.take(c, "client")
+	if err != nil || wait <= 0 || wait > 100*time.Millisecond {
+		t.Fatalf("take = %s, %v; want 0..100ms", wait, err)
+	}
+	// only one token is refilled after the wait
+	time.Sleep(wait)
+	if wait, err := rl.take(c, "client"); err != nil || wait != 0 {
+		t.Errorf("take after refill = %s, %v; want 0", wait, err)
+	}
+	if wait, err := rl.take(c, "client"); err != nil || wait == 0 {
+		t.Errorf("take after refill (2) = %s, %v; want > 0", wait, err)
+	}
+}
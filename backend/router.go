@@ -0,0 +1,134 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+const (
+	// routeOp.Auth values
+	authNone    = ""
+	authBearer  = "bearer"    // Google ID token or OAuth 2 access token
+	authSWToken = "swtoken"   // SW token, see encodeSWToken
+	authSync    = "synctoken" // config.SyncToken
+	authSession = "session"   // session cookie, see authRequest
+)
+
+// routes are all routes registered with handle(), keyed by their patterns.
+var routes = make(map[string]*routeInfo)
+
+// routeInfo describes a route registered with handle().
+// It is used to dispatch requests, see route,
+// and to generate OpenAPI description of the API, see serveOpenAPI.
+type routeInfo struct {
+	Summary string
+	// Param names a path parameter of a pattern ending with "/",
+	// e.g. "sid" in /api/v1/user/schedule/{sid}.
+	Param string
+	// Internal routes, such as pages, cron jobs and tasks,
+	// are not part of the OpenAPI description.
+	Internal bool
+	Ops      []*routeOp
+}
+
+// routeOp is an operation on a route with a single HTTP method.
+type routeOp struct {
+	Method  string
+	Summary string
+	// Auth is one of auth consts, or a space-separated list of them
+	// if any is accepted.
+	Auth string
+	// Req and Res are values of request and response body types,
+	// or nil if there's no body.
+	Req, Res interface{}
+	// ResType is the response content type, application/json by default.
+	ResType string
+}
+
+// allows reports whether ri has an operation with the given method.
+// HEAD is allowed wherever GET is.
+func (ri *routeInfo) allows(method string) bool {
+	if method == "HEAD" {
+		method = "GET"
+	}
+	for _, op := range ri.Ops {
+		if op.Method == method {
+			return true
+		}
+	}
+	return false
+}
+
+// allowHeader returns the value of Allow response header for ri.
+func (ri *routeInfo) allowHeader() string {
+	var methods []string
+	for _, op := range ri.Ops {
+		methods = append(methods, op.Method)
+		if op.Method == "GET" {
+			methods = append(methods, "HEAD")
+		}
+	}
+	return strings.Join(append(methods, "OPTIONS"), ", ")
+}
+
+// route returns a handler func which dispatches requests to fn
+// only if their method is allowed by info.
+// It responds with 405 Method Not Allowed to other methods,
+// and answers OPTIONS requests, including CORS preflight, by itself.
+// Cross-origin access is controlled by config.CORS, see setCORSHeaders.
+//
+// A POST or PUT request with X-HTTP-Method-Override header is treated
+// as a request with the overridden method, for clients unable to send DELETE
+// with a body.
+//
+// Paths of a pattern ending with "/" must have no more than one segment after
+// the pattern, which is the route path parameter, see pathParam.
+func route(pattern string, info *routeInfo, fn http.HandlerFunc) http.HandlerFunc {
+	allow := info.allowHeader()
+	return func(w http.ResponseWriter, r *http.Request) {
+		if m := r.Header.Get("x-http-method-override"); m != "" && (r.Method == "POST" || r.Method == "PUT") {
+			r.Method = strings.ToUpper(m)
+		}
+		if info.Param != "" && strings.Contains(pathParam(r, pattern), "/") {
+			http.NotFound(w, r)
+			return
+		}
+		setCORSHeaders(w, r, pattern, allow)
+		if r.Method == "OPTIONS" {
+			w.Header().Set("Allow", allow)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if !info.allows(r.Method) {
+			w.Header().Set("Allow", allow)
+			w.Header().Set("Content-Type", "application/json;charset=utf-8")
+			writeJSONError(newContext(r), w, http.StatusMethodNotAllowed, "method not allowed: "+r.Method)
+			return
+		}
+		fn(w, r)
+	}
+}
+
+// pathParam returns the path parameter of r routed with pattern,
+// e.g. "some-id" for /api/v1/user/schedule/some-id and /api/v1/user/schedule/ pattern.
+// The result is empty if r.URL.Path is not under pattern.
+func pathParam(r *http.Request, pattern string) string {
+	if !strings.HasPrefix(r.URL.Path, pattern) {
+		return ""
+	}
+	return r.URL.Path[len(pattern):]
+}
@@ -0,0 +1,96 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRoute(t *testing.T) {
+	info := &routeInfo{
+		Param: "sid",
+		Ops:   []*routeOp{{Method: "GET"}, {Method: "PUT"}},
+	}
+	const allow = "GET, HEAD, PUT, OPTIONS"
+
+	table := []struct {
+		method, override, path string
+		code                   int
+		method2, param         string
+		allow                  string
+	}{
+		{"GET", "", "/api/v1/user/schedule/", http.StatusOK, "GET", "", ""},
+		{"HEAD", "", "/api/v1/user/schedule/", http.StatusOK, "HEAD", "", ""},
+		{"PUT", "", "/api/v1/user/schedule/s1", http.StatusOK, "PUT", "s1", ""},
+		{"POST", "put", "/api/v1/user/schedule/s2", http.StatusOK, "PUT", "s2", ""},
+		{"GET", "PUT", "/api/v1/user/schedule/s2", http.StatusOK, "GET", "s2", ""},
+		{"POST", "", "/api/v1/user/schedule/s1", http.StatusMethodNotAllowed, "", "", allow},
+		{"POST", "DELETE", "/api/v1/user/schedule/s1", http.StatusMethodNotAllowed, "", "", allow},
+		{"OPTIONS", "", "/api/v1/user/schedule/s1", http.StatusNoContent, "", "", allow},
+		{"GET", "", "/api/v1/user/schedule/s1/extra", http.StatusNotFound, "", "", ""},
+	}
+	for i, test := range table {
+		var method, param string
+		h := route("/api/v1/user/schedule/", info, func(w http.ResponseWriter, r *http.Request) {
+			method = r.Method
+			param = pathParam(r, "/api/v1/user/schedule/")
+		})
+		r := newTestRequest(t, test.method, test.path, nil)
+		if test.override != "" {
+			r.Header.Set("x-http-method-override", test.override)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+
+		if w.Code != test.code {
+			t.Errorf("%d: w.Code = %d; want %d", i, w.Code, test.code)
+		}
+		if method != test.method2 {
+			t.Errorf("%d: method = %q; want %q", i, method, test.method2)
+		}
+		if param != test.param {
+			t.Errorf("%d: param = %q; want %q", i, param, test.param)
+		}
+		if v := w.Header().Get("allow"); v != test.allow {
+			t.Errorf("%d: Allow = %q; want %q", i, v, test.allow)
+		}
+	}
+}
+
+func TestRoutePreflight(t *testing.T) {
+	defer preserveConfig()()
+	config.CORS = map[string]*corsPolicy{
+		"/api/v1/user/": {Origins: []string{"https://example.org"}},
+	}
+	info := &routeInfo{Ops: []*routeOp{{Method: "PUT"}}}
+	h := route("/api/v1/user/notify", info, func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("handler called with %s", r.Method)
+	})
+	r := newTestRequest(t, "OPTIONS", "/api/v1/user/notify", nil)
+	r.Header.Set("origin", "https://example.org")
+	r.Header.Set("access-control-request-method", "PUT")
+	w := httptest.NewRecorder()
+	h(w, r)
+
+	if w.Code != http.StatusNoContent {
+		t.Errorf("w.Code = %d; want 204", w.Code)
+	}
+	const allow = "PUT, OPTIONS"
+	if v := w.Header().Get("access-control-allow-methods"); v != allow {
+		t.Errorf("Access-Control-Allow-Methods = %q; want %q", v, allow)
+	}
+}
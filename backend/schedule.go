@@ -45,6 +45,10 @@ const (
 	imageURLSizeMarkerLen = len(imageURLSizeMarker)
 
 	gcsReadOnlyScope = "https://www.googleapis.com/auth/devstorage.read_only"
+
+	// eventDataHistory is the number of most recent EventData versions
+	// which can be used as a base of a schedule delta.
+	eventDataHistory = 20
 )
 
 var (
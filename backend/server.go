@@ -20,12 +20,19 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
+	"syscall"
+	"time"
 
 	"golang.org/x/net/context"
 )
@@ -42,16 +49,93 @@ func main() {
 		panic("initConfig: " + err.Error())
 	}
 
+	// prepend config.Prefix to bypass prefixes
+	for i, p := range passthruPrefixes {
+		passthruPrefixes[i] = path.Join(config.Prefix, p)
+	}
 	cache = newMemoryCache()
-	wrapHandler = logHandler
+	wrapHandler = func(h http.Handler) http.Handler {
+		// allow access only by whitelisted people/domains if not empty
+		if len(config.Whitelist) > 0 {
+			h = checkWhitelist(h)
+		}
+		return logHandler(secureHandler(h))
+	}
 	rootHandleFn = catchAllHandler
+	liveStream = true
+	isAdminRequest = isStandaloneAdmin
 	registerHandlers()
+	// sign-in of whitelisted users and admins
+	httpHandle(path.Join(config.Prefix, signInPath), handler(handleSignIn))
+
+	srv := newServer()
+	redirect := newRedirectServer()
+	if redirect != nil {
+		go func() {
+			if err := redirect.ListenAndServe(); err != http.ErrServerClosed {
+				errorf(nil, "redirect server: %v", err)
+				os.Exit(1)
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+		logf(nil, "received %v; shutting down", <-sig)
+		if redirect != nil {
+			redirect.Close()
+		}
+		if err := shutdown(srv); err != nil {
+			errorf(nil, "shutdown: %v", err)
+		}
+	}()
 
-	if err := http.ListenAndServe(config.Addr, nil); err != nil {
+	if err := listenAndServe(srv); err != http.ErrServerClosed {
 		// don't need context here
 		errorf(nil, "%v", err)
 		os.Exit(1)
 	}
+	<-done
+}
+
+// newServer returns a standalone server listening on config.Addr
+// with timeouts and TLS settings of config.Server.
+// Schedule streams are closed when the server is shutting down.
+func newServer() *http.Server {
+	srv := &http.Server{
+		Addr:         config.Addr,
+		ReadTimeout:  config.Server.readTimeout,
+		WriteTimeout: config.Server.writeTimeout,
+		IdleTimeout:  config.Server.idleTimeout,
+	}
+	if serveTLS() {
+		configureTLS(srv)
+	}
+	srv.RegisterOnShutdown(changesHub.closeAll)
+	return srv
+}
+
+// shutdown stops srv from accepting new requests and waits for in-flight ones,
+// such as event data syncs and push pings, to finish but no longer than
+// config.Server.shutdownTimeout. Connections still active after that are closed.
+//
+// Unlike GAE, the standalone server has no task queue to drain or persist:
+// async jobs are not implemented here (see async.go), and goroutines
+// started by handlers are joined before their responses are written.
+func shutdown(srv *http.Server) error {
+	c := context.Background()
+	if d := config.Server.shutdownTimeout; d > 0 {
+		var cancel context.CancelFunc
+		c, cancel = context.WithTimeout(c, d)
+		defer cancel()
+	}
+	if err := srv.Shutdown(c); err != nil {
+		srv.Close()
+		return err
+	}
+	return nil
 }
 
 // catchAllHandler serves either static content from rootDir
@@ -72,26 +156,101 @@ func catchAllHandler(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, p)
 }
 
-// logHandler logs each request before handing it over to the handler h.
+// logHandler logs each request after handing it over to the handler h,
+// along with response status and latency.
+// It also assigns a request ID, unless the client provided a valid one
+// with X-Request-Id header, see validRequestID.
 func logHandler(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// don't need context in standalone server
-		logf(nil, "%s %s", r.Method, r.URL.Path)
-		h.ServeHTTP(w, r)
+		if !validRequestID(r.Header.Get("x-request-id")) {
+			r.Header.Set("x-request-id", newRequestID())
+		}
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(sw, r)
+		c := withLogField(newContext(r), "method", r.Method)
+		c = withLogField(c, "status", sw.status)
+		c = withLogField(c, "latency", time.Since(start).Seconds())
+		logf(c, "%s %s", r.Method, r.URL.Path)
 	})
 }
 
+// maxRequestIDLen is the max length of a request ID provided by a client.
+const maxRequestIDLen = 64
+
+// validRequestID reports whether id is a non-empty string of at most maxRequestIDLen
+// letters, digits, '-', '_' and '.', so that it can't forge log entries.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random ID of a request.
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		errorf(nil, "newRequestID: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
 // newContext returns a context of the in-flight request r.
+// Messages logged with the context include its request ID and endpoint.
 func newContext(r *http.Request) context.Context {
-	return context.Background()
+	c := context.WithValue(context.Background(), ctxKeyRequestID, r.Header.Get("x-request-id"))
+	return withLogField(c, "endpoint", r.URL.Path)
+}
+
+// requestID returns ID of the request context c was created with.
+func requestID(c context.Context) string {
+	if c == nil {
+		return ""
+	}
+	id, _ := c.Value(ctxKeyRequestID).(string)
+	return id
 }
 
-// logf logs an info message using Go's standard log package.
-func logf(_ context.Context, format string, args ...interface{}) {
-	log.Printf(format, args...)
+// stdLogger writes log messages to stderr, one JSON object per line.
+var stdLogger = log.New(os.Stderr, "", 0)
+
+// debugf logs a debug message with fields of context c, see logFields.
+func debugf(c context.Context, format string, args ...interface{}) {
+	writeLog(c, logLevelDebug, format, args...)
+}
+
+// logf logs an info message with fields of context c, see logFields.
+func logf(c context.Context, format string, args ...interface{}) {
+	writeLog(c, logLevelInfo, format, args...)
+}
+
+// errorf logs an error message with fields of context c, see logFields.
+func errorf(c context.Context, format string, args ...interface{}) {
+	writeLog(c, logLevelError, format, args...)
 }
 
-// errorf logs an error message using Go's standard log package.
-func errorf(_ context.Context, format string, args ...interface{}) {
-	log.Printf("ERROR: "+format, args...)
+// writeLog writes a message of level l as a JSON object with "time", "level"
+// and "msg" fields, along with fields of context c.
+func writeLog(c context.Context, l logLevel, format string, args ...interface{}) {
+	if !logEnabled(l) {
+		return
+	}
+	entry := logFields(c)
+	entry["time"] = time.Now().Format(time.RFC3339Nano)
+	entry["level"] = l.String()
+	entry["msg"] = fmt.Sprintf(format, args...)
+	b, err := json.Marshal(entry)
+	if err != nil {
+		b = []byte(fmt.Sprintf(`{"level": "error", "msg": %q}`, "writeLog: "+err.Error()))
+	}
+	stdLogger.Print(string(b))
 }
@@ -61,16 +61,22 @@ func init() {
 		wrapHandler = checkWhitelist
 	}
 	rootHandleFn = serveTemplate
+	readyChecks = append(readyChecks, dataReadyChecks...)
+	isAdminRequest = isGAEAdmin
+	isCronOrTask = isGAECronOrTask
 	registerHandlers()
-	// site admin stuff, accessible only to config.Admins, only on GAE atm.
-	aroot := path.Join(config.Prefix, "admin") + "/"
-	http.Handle(aroot, checkAdmin(handler(handleAdmin)))
+}
+
+// isGAECronOrTask returns true if r is made by GAE Cron or Task Queue service.
+// GAE removes X-Appengine headers from external requests.
+func isGAECronOrTask(r *http.Request) bool {
+	return r.Header.Get("x-appengine-cron") == "true" || r.Header.Get("x-appengine-taskname") != ""
 }
 
 // allowPassthrough returns true if the request r can be handled w/o whitelist check.
 // Currently, only GAE Cron and Task Queue jobs are allowed.
 func allowPassthrough(r *http.Request) bool {
-	if r.Header.Get("x-appengine-cron") == "true" || r.Header.Get("x-appengine-taskname") != "" {
+	if isCronOrTask(r) {
 		return true
 	}
 	for _, p := range passthruPrefixes {
@@ -124,6 +130,13 @@ func checkAdmin(h http.Handler) http.Handler {
 	})
 }
 
+// isGAEAdmin returns true if r is made by a user signed in with GAE Users API
+// who is also in config.Admins.
+func isGAEAdmin(r *http.Request) bool {
+	u := user.Current(appengine.NewContext(r))
+	return u != nil && isAdmin(u.Email)
+}
+
 // handleGAEAuth sends a redirect to GAE authentication page.
 func handleGAEAuth(w http.ResponseWriter, r *http.Request) {
 	c := appengine.NewContext(r)
@@ -137,16 +150,58 @@ func handleGAEAuth(w http.ResponseWriter, r *http.Request) {
 }
 
 // newContext returns a context of the in-flight request r.
+// If r is a task scheduled by another request, or a cron job, with X-Request-Id header,
+// messages logged with the context include it. Clients can't set the ID.
 func newContext(r *http.Request) context.Context {
-	return appengine.NewContext(r)
+	c := appengine.NewContext(r)
+	if id := r.Header.Get("x-request-id"); id != "" && isCronOrTask(r) {
+		c = context.WithValue(c, ctxKeyRequestID, id)
+	}
+	return c
+}
+
+// requestID returns ID of the request context c was created with,
+// or the one propagated in X-Request-Id header.
+func requestID(c context.Context) string {
+	if c == nil {
+		return ""
+	}
+	if id, ok := c.Value(ctxKeyRequestID).(string); ok {
+		return id
+	}
+	return appengine.RequestID(c)
+}
+
+// debugf logs a debug message using appengine's context.
+func debugf(c context.Context, format string, args ...interface{}) {
+	if logEnabled(logLevelDebug) {
+		log.Debugf(c, gaeLogPrefix(c)+format, args...)
+	}
 }
 
 // logf logs an info message using appengine's context.
 func logf(c context.Context, format string, args ...interface{}) {
-	log.Infof(c, format, args...)
+	if logEnabled(logLevelInfo) {
+		log.Infof(c, gaeLogPrefix(c)+format, args...)
+	}
 }
 
 // errorf logs an error message using appengine's context.
 func errorf(c context.Context, format string, args ...interface{}) {
-	log.Errorf(c, format, args...)
+	if logEnabled(logLevelError) {
+		log.Errorf(c, gaeLogPrefix(c)+format, args...)
+	}
+}
+
+// gaeLogPrefix formats fields of context c, see logFields,
+// except for request ID of c itself, which GAE logs already group by.
+func gaeLogPrefix(c context.Context) string {
+	if c == nil {
+		return ""
+	}
+	fields := logFields(c)
+	if _, ok := c.Value(ctxKeyRequestID).(string); !ok {
+		delete(fields, "requestId")
+	}
+	return strings.Replace(formatLogFields(fields), "%", "%%", -1)
 }
@@ -188,3 +188,26 @@ func TestCheckWhitelist(t *testing.T) {
 		}
 	}
 }
+
+func TestNewContextRequestID(t *testing.T) {
+	defer resetTestState(t)
+	table := []struct {
+		header, value string
+		want          bool
+	}{
+		{"", "", false},
+		{"x-appengine-taskname", "task-1", true},
+		{"x-appengine-cron", "true", true},
+	}
+	for i, test := range table {
+		r := newTestRequest(t, "GET", "/", nil)
+		r.Header.Set("x-request-id", "parent-id")
+		if test.header != "" {
+			r.Header.Set(test.header, test.value)
+		}
+		id := requestID(newContext(r))
+		if (id == "parent-id") != test.want {
+			t.Errorf("%d: requestID = %q; want parent-id = %v", i, id, test.want)
+		}
+	}
+}
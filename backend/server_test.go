@@ -0,0 +1,153 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !appengine
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogHandler(t *testing.T) {
+	var buf bytes.Buffer
+	stdLogger = log.New(&buf, "", 0)
+	defer func() { stdLogger = log.New(os.Stderr, "", 0) }()
+
+	var rid string
+	h := logHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rid = r.Header.Get("x-request-id")
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	r := newTestRequest(t, "GET", "/api/v1/schedule", nil)
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	if rid == "" {
+		t.Fatalf("no request ID assigned")
+	}
+	var entry struct {
+		Level, Msg, Endpoint, RequestID, Method string
+		Status                                  int
+		Latency                                 *float64
+	}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("json.Unmarshal(%s): %v", buf.String(), err)
+	}
+	if entry.RequestID != rid {
+		t.Errorf("entry.RequestID = %q; want %q", entry.RequestID, rid)
+	}
+	if entry.Status != http.StatusTeapot {
+		t.Errorf("entry.Status = %d; want %d", entry.Status, http.StatusTeapot)
+	}
+	if entry.Endpoint != "/api/v1/schedule" || entry.Method != "GET" {
+		t.Errorf("entry = %+v; want GET /api/v1/schedule", entry)
+	}
+	if entry.Level != "info" || entry.Latency == nil {
+		t.Errorf("entry = %+v; want info level and latency", entry)
+	}
+}
+
+func TestLogHandlerRequestID(t *testing.T) {
+	stdLogger = log.New(ioutil.Discard, "", 0)
+	defer func() { stdLogger = log.New(os.Stderr, "", 0) }()
+
+	table := []struct {
+		id   string
+		keep bool
+	}{
+		{"", false},
+		{"abc-123_x.y", true},
+		{strings.Repeat("a", maxRequestIDLen), true},
+		{strings.Repeat("a", maxRequestIDLen+1), false},
+		{"forged\n{\"level\": \"error\"}", false},
+		{"with space", false},
+	}
+	for i, test := range table {
+		var rid string
+		h := logHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rid = r.Header.Get("x-request-id")
+		}))
+		r := newTestRequest(t, "GET", "/", nil)
+		r.Header.Set("x-request-id", test.id)
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		if test.keep && rid != test.id {
+			t.Errorf("%d: rid = %q; want %q", i, rid, test.id)
+		}
+		if !test.keep && (rid == test.id || !validRequestID(rid)) {
+			t.Errorf("%d: rid = %q; want a new valid ID", i, rid)
+		}
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	defer preserveConfig()()
+	config.Server.shutdownTimeout = 5 * time.Second
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	srv := newServer()
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusTeapot)
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	stream := changesHub.subscribe()
+	defer changesHub.unsubscribe(stream)
+
+	resc := make(chan int, 1)
+	go func() {
+		res, err := http.Get("http://" + ln.Addr().String())
+		if err != nil {
+			t.Errorf("http.Get: %v", err)
+			resc <- 0
+			return
+		}
+		res.Body.Close()
+		resc <- res.StatusCode
+	}()
+	<-started
+
+	errc := make(chan error, 1)
+	go func() { errc <- shutdown(srv) }()
+	select {
+	case err := <-errc:
+		t.Fatalf("shutdown returned %v before the request finished", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, ok := <-stream; ok {
+		t.Errorf("stream subscriber is not closed")
+	}
+	close(release)
+	if err := <-errc; err != nil {
+		t.Errorf("shutdown: %v", err)
+	}
+	if code := <-resc; code != http.StatusTeapot {
+		t.Errorf("code = %d; want %d", code, http.StatusTeapot)
+	}
+}
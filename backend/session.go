@@ -0,0 +1,295 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// sessionCookie is the name of HttpOnly cookie with an encoded session.
+	sessionCookie = "iowa_sess"
+	// csrfCookie is the name of a cookie with CSRF token of the session,
+	// readable by the client, which must send it back in csrfHeader
+	// along with state-changing requests.
+	csrfCookie = "iowa_csrf"
+	csrfHeader = "X-CSRF-Token"
+	// sessionVersion is the first part of encoded sessions.
+	sessionVersion = "2"
+)
+
+// sessionSep is session parts separator used in encode/decodeSession.
+var sessionSep = []byte(" ")
+
+// session is a browser sign-in state of a user.
+type session struct {
+	// kid is the ID of a key from config.Session.Secrets
+	// the session is signed with.
+	kid  string
+	user string
+	// email is the verified email of the user, if known.
+	email string
+	// csrf is a random token which is kept across renewals.
+	csrf string
+	// signedIn is when the user signed in. It is kept across renewals.
+	signedIn time.Time
+	// issued is when the session was created or last renewed.
+	issued time.Time
+}
+
+// newSession creates a new session of user uid with a random CSRF token.
+// The email is optional, and must be verified if not empty.
+func newSession(uid, email string) (*session, error) {
+	if uid == "" || strings.Contains(uid, string(sessionSep)) {
+		return nil, fmt.Errorf("newSession: invalid user ID %q", uid)
+	}
+	if strings.Contains(email, string(sessionSep)) {
+		return nil, fmt.Errorf("newSession: invalid email %q", email)
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return &session{user: uid, email: email, csrf: hex.EncodeToString(b), signedIn: now, issued: now}, nil
+}
+
+// encode returns s encoded base64 and signed with the current key,
+// setting s.kid accordingly.
+// The format, when base64-decoded, is: "version kid uid email csrf signedIn issued hmac".
+func (s *session) encode() (string, error) {
+	kid, secret := sessionSecret("")
+	if secret == "" {
+		return "", errors.New("encodeSession: secret is not set")
+	}
+	s.kid = kid
+	msg := []byte(fmt.Sprintf("%s%s%s%s%s%s%s%s%s%s%d%s%d", sessionVersion, sessionSep,
+		kid, sessionSep, s.user, sessionSep, s.email, sessionSep, s.csrf, sessionSep,
+		s.signedIn.Unix(), sessionSep, s.issued.Unix()))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(msg)
+	b := append(msg, sessionSep...)
+	b = append(b, mac.Sum(nil)...)
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// expires returns the time s expires at: config.Session.MaxAge after it was issued,
+// but no later than config.Session.Lifetime after the user signed in.
+func (s *session) expires() time.Time {
+	exp := s.issued.Add(config.Session.maxAge)
+	if end := s.signedIn.Add(config.Session.lifetime); end.Before(exp) {
+		exp = end
+	}
+	return exp
+}
+
+// decodeSession decodes and verifies v.
+// It accepts sessions signed with any of the configured keys,
+// so that a key rotation does not sign users out,
+// and rejects expired ones, see expires.
+func decodeSession(v string) (*session, error) {
+	b, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return nil, fmt.Errorf("decodeSession: %v", err)
+	}
+	parts := bytes.SplitN(b, sessionSep, 8)
+	if len(parts) != 8 || string(parts[0]) != sessionVersion {
+		return nil, errors.New("decodeSession: invalid session format")
+	}
+	s := &session{
+		kid:   string(parts[1]),
+		user:  string(parts[2]),
+		email: string(parts[3]),
+		csrf:  string(parts[4]),
+	}
+	if s.signedIn, err = parseUnixTime(parts[5]); err != nil {
+		return nil, err
+	}
+	if s.issued, err = parseUnixTime(parts[6]); err != nil {
+		return nil, err
+	}
+	_, secret := sessionSecret(s.kid)
+	if secret == "" {
+		return nil, fmt.Errorf("decodeSession: unknown key %q", s.kid)
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(bytes.Join(parts[:7], sessionSep))
+	if !hmac.Equal(parts[7], mac.Sum(nil)) {
+		return nil, errors.New("decodeSession: hmac doesn't match")
+	}
+	if !time.Now().Before(s.expires()) {
+		return nil, errors.New("decodeSession: session expired")
+	}
+	return s, nil
+}
+
+// sessionSecret returns the key ID and secret of sessions key kid.
+// An empty kid means the current signing key.
+// The returned secret is empty if no such key exists.
+func sessionSecret(kid string) (string, string) {
+	if kid == "" {
+		kid = config.Session.Kid
+	}
+	return kid, config.Session.Secrets[kid]
+}
+
+// sessionsEnabled reports whether session cookies can be issued.
+func sessionsEnabled() bool {
+	_, secret := sessionSecret("")
+	return secret != "" && config.Session.maxAge > 0 && config.Session.lifetime > 0
+}
+
+// setSessionCookies encodes s into sessionCookie and sets csrfCookie.
+// Both expire along with s.
+func setSessionCookies(w http.ResponseWriter, r *http.Request, s *session) error {
+	v, err := s.encode()
+	if err != nil {
+		return err
+	}
+	exp := s.expires()
+	secure := requestScheme(r) == "https"
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    v,
+		Path:     config.Prefix,
+		Expires:  exp,
+		MaxAge:   int(time.Until(exp) / time.Second),
+		Secure:   secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    s.csrf,
+		Path:     config.Prefix,
+		Expires:  exp,
+		MaxAge:   int(time.Until(exp) / time.Second),
+		Secure:   secure,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return nil
+}
+
+// clearSessionCookies tells the client to remove sessionCookie and csrfCookie.
+func clearSessionCookies(w http.ResponseWriter) {
+	for _, name := range []string{sessionCookie, csrfCookie} {
+		http.SetCookie(w, &http.Cookie{
+			Name:    name,
+			Path:    config.Prefix,
+			Expires: time.Unix(0, 0),
+			MaxAge:  -1,
+		})
+	}
+}
+
+// sessionsRevokedKeyPrefix is a cache key prefix of the time
+// all sessions of a user were revoked at, see revokeSessions.
+const sessionsRevokedKeyPrefix = "sessrev:"
+
+// revokeSessions revokes all sessions of user uid signed in at or before t.
+// The time is rounded down to a second, same as session times.
+func revokeSessions(c context.Context, uid string, t time.Time) error {
+	t = t.Truncate(time.Second)
+	if err := storeSessionsRevoked(c, uid, t); err != nil {
+		return err
+	}
+	v := []byte(strconv.FormatInt(t.Unix(), 10))
+	if err := cache.set(c, sessionsRevokedKeyPrefix+uid, v, time.Hour); err != nil {
+		errorf(c, "revokeSessions: %v", err)
+	}
+	return nil
+}
+
+// sessionRevoked reports whether s has been revoked with revokeSessions.
+// The revocation time is cached so that a session check
+// doesn't hit the DB on every request.
+func sessionRevoked(c context.Context, s *session) (bool, error) {
+	key := sessionsRevokedKeyPrefix + s.user
+	b, err := cache.get(c, key)
+	if err != nil {
+		at, err := getSessionsRevoked(c, s.user)
+		if err != nil {
+			return false, err
+		}
+		var sec int64
+		if !at.IsZero() {
+			sec = at.Unix()
+		}
+		b = []byte(strconv.FormatInt(sec, 10))
+		if err := cache.set(c, key, b, time.Hour); err != nil {
+			errorf(c, "sessionRevoked: %v", err)
+		}
+	}
+	// zero means the sessions have never been revoked
+	sec, _ := strconv.ParseInt(string(b), 10, 64)
+	return sec > 0 && s.signedIn.Unix() <= sec, nil
+}
+
+// authRequest authenticates the user who made r, either with Authorization
+// header, see authUser, or sessionCookie if the former is absent.
+// Requests authenticated with a session, except safe methods,
+// must have csrfHeader matching the session CSRF token.
+// Sessions older than half of config.Session.MaxAge are renewed,
+// up to config.Session.Lifetime since the user signed in.
+// The func returns context c in case of an error, otherwise a new one minted with the user ID.
+func authRequest(c context.Context, w http.ResponseWriter, r *http.Request) (context.Context, error) {
+	ah := r.Header.Get("authorization")
+	ck, err := r.Cookie(sessionCookie)
+	if ah != "" || err != nil || !sessionsEnabled() {
+		return authUser(c, ah)
+	}
+	s, err := decodeSession(ck.Value)
+	if err != nil {
+		errorf(c, "authRequest: %v", err)
+		clearSessionCookies(w)
+		return c, errAuthInvalid
+	}
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		// safe methods
+	default:
+		t := r.Header.Get(csrfHeader)
+		if t == "" || subtle.ConstantTimeCompare([]byte(t), []byte(s.csrf)) != 1 {
+			return c, errCSRF
+		}
+	}
+	if revoked, err := sessionRevoked(c, s); err != nil {
+		return c, err
+	} else if revoked {
+		clearSessionCookies(w)
+		return c, errAuthInvalid
+	}
+	if time.Since(s.issued) > config.Session.maxAge/2 {
+		s.issued = time.Now()
+		if err := setSessionCookies(w, r, s); err != nil {
+			errorf(c, "authRequest: renew session: %v", err)
+		}
+	}
+	return context.WithValue(c, ctxKeyUser, s.user), nil
+}
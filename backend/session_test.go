@@ -0,0 +1,326 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setTestSessionConfig() {
+	config.Session.Secrets = map[string]string{"k1": "old-secret", "k2": "new-secret"}
+	config.Session.Kid = "k2"
+	config.Session.maxAge = time.Hour
+	config.Session.lifetime = 3 * time.Hour
+}
+
+// responseCookies returns cookies set by a response recorded in w, keyed by name.
+func responseCookies(w *httptest.ResponseRecorder) map[string]*http.Cookie {
+	res := &http.Response{Header: w.Header()}
+	m := make(map[string]*http.Cookie)
+	for _, ck := range res.Cookies() {
+		m[ck.Name] = ck
+	}
+	return m
+}
+
+func TestSessionEncodeDecode(t *testing.T) {
+	defer preserveConfig()()
+	setTestSessionConfig()
+
+	s, err := newSession(testUserID, "dude@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := s.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.kid != "k2" {
+		t.Errorf("s.kid = %q; want k2", s.kid)
+	}
+	s2, err := decodeSession(v)
+	if err != nil {
+		t.Fatalf("decodeSession(%q): %v", v, err)
+	}
+	if s2.user != testUserID || s2.email != s.email || s2.csrf != s.csrf || s2.issued.Unix() != s.issued.Unix() ||
+		s2.signedIn.Unix() != s.signedIn.Unix() {
+		t.Errorf("decodeSession() = %+v; want %+v", s2, s)
+	}
+
+	// sessions signed with a previous key are still valid
+	config.Session.Kid = "k1"
+	old := &session{user: testUserID, csrf: "abc", signedIn: time.Now(), issued: time.Now()}
+	ov, err := old.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Session.Kid = "k2"
+	if _, err := decodeSession(ov); err != nil {
+		t.Errorf("decodeSession(k1): %v", err)
+	}
+
+	expired := &session{user: testUserID, csrf: "abc", signedIn: time.Now().Add(-2 * time.Hour), issued: time.Now().Add(-2 * time.Hour)}
+	ev, err := expired.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// recently renewed but signed in too long ago
+	ended := &session{user: testUserID, csrf: "abc", signedIn: time.Now().Add(-4 * time.Hour), issued: time.Now()}
+	endv, err := ended.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := []byte(v)
+	tampered[len(tampered)/2] ^= 1
+	for i, bad := range []string{ev, endv, string(tampered), "", "invalid"} {
+		if s, err := decodeSession(bad); err == nil {
+			t.Errorf("%d: decodeSession(%q) = %+v; want error", i, bad, s)
+		}
+	}
+	// key removed
+	delete(config.Session.Secrets, "k1")
+	if _, err := decodeSession(ov); err == nil {
+		t.Errorf("decodeSession(k1) succeeded after the key removal")
+	}
+
+	if _, err := newSession("user with spaces", ""); err == nil {
+		t.Errorf("newSession(user with spaces) succeeded")
+	}
+	if _, err := newSession(testUserID, "email with spaces"); err == nil {
+		t.Errorf("newSession(email with spaces) succeeded")
+	}
+}
+
+func TestAuthRequestSession(t *testing.T) {
+	defer preserveConfig()()
+	setTestSessionConfig()
+
+	fresh, _ := newSession(testUserID, "")
+	freshVal, _ := fresh.encode()
+	aged, _ := newSession(testUserID, "")
+	aged.issued = time.Now().Add(-45 * time.Minute)
+	agedVal, _ := aged.encode()
+
+	table := []struct {
+		method  string
+		cookie  string
+		csrf    string
+		err     error
+		renewed bool
+	}{
+		{"GET", freshVal, "", nil, false},
+		{"PUT", freshVal, fresh.csrf, nil, false},
+		{"PUT", freshVal, "", errCSRF, false},
+		{"DELETE", freshVal, aged.csrf, errCSRF, false},
+		{"GET", agedVal, "", nil, true},
+		{"GET", "invalid", "", errAuthInvalid, false},
+		{"GET", "", "", errAuthInvalid, false},
+	}
+	for i, test := range table {
+		r := newTestRequest(t, test.method, "/api/v1/user/schedule", nil)
+		if test.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: sessionCookie, Value: test.cookie})
+		}
+		if test.csrf != "" {
+			r.Header.Set(csrfHeader, test.csrf)
+		}
+		w := httptest.NewRecorder()
+		c, err := authRequest(newContext(r), w, r)
+		if err != test.err {
+			t.Errorf("%d: err = %v; want %v", i, err, test.err)
+		}
+		if err == nil && contextUser(c) != testUserID {
+			t.Errorf("%d: contextUser = %q; want %q", i, contextUser(c), testUserID)
+		}
+		ck := responseCookies(w)[sessionCookie]
+		if renewed := ck != nil && ck.Value != ""; renewed != test.renewed {
+			t.Errorf("%d: renewed = %v; want %v", i, renewed, test.renewed)
+		}
+		if test.cookie == "invalid" && (ck == nil || ck.MaxAge >= 0) {
+			t.Errorf("%d: invalid session cookie is not cleared: %+v", i, ck)
+		}
+	}
+
+	// Authorization header takes precedence
+	r := newTestRequest(t, "PUT", "/api/v1/user/schedule", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: freshVal})
+	r.Header.Set("authorization", "Bearer "+testIDToken)
+	if _, err := authRequest(newContext(r), httptest.NewRecorder(), r); err != nil {
+		t.Errorf("authRequest(bearer): %v", err)
+	}
+}
+
+func TestAuthRequestSessionLifetime(t *testing.T) {
+	defer preserveConfig()()
+	setTestSessionConfig()
+
+	s, _ := newSession(testUserID, "")
+	s.signedIn = time.Now().Add(-config.Session.lifetime + 10*time.Minute)
+	s.issued = time.Now().Add(-45 * time.Minute)
+	v, _ := s.encode()
+
+	r := newTestRequest(t, "GET", "/api/v1/user/schedule", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: v})
+	w := httptest.NewRecorder()
+	if _, err := authRequest(newContext(r), w, r); err != nil {
+		t.Fatalf("authRequest: %v", err)
+	}
+	ck := responseCookies(w)[sessionCookie]
+	if ck == nil {
+		t.Fatalf("session is not renewed")
+	}
+	renewed, err := decodeSession(ck.Value)
+	if err != nil {
+		t.Fatalf("decodeSession(renewed): %v", err)
+	}
+	if renewed.signedIn.Unix() != s.signedIn.Unix() {
+		t.Errorf("renewed.signedIn = %v; want %v", renewed.signedIn, s.signedIn)
+	}
+	// the renewed session doesn't outlive the lifetime
+	if max := int((10*time.Minute + time.Second) / time.Second); ck.MaxAge > max {
+		t.Errorf("ck.MaxAge = %d; want <= %d", ck.MaxAge, max)
+	}
+}
+
+func TestHandleAuthSession(t *testing.T) {
+	defer resetTestState(t)
+	defer preserveConfig()()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{
+			"access_token": "new-access-token",
+			"refresh_token": "new-refresh-token",
+			"id_token": %q,
+			"expires_in": 3600
+		}`, testIDToken)
+	}))
+	defer ts.Close()
+	config.Google.TokenURL = ts.URL
+
+	newAuthRequest := func() *http.Request {
+		body := strings.NewReader(`{"code": "one-off", "session": true}`)
+		r := newTestRequest(t, "POST", "/api/v1/auth", body)
+		r.Header.Set("Authorization", "Bearer "+testIDToken)
+		return r
+	}
+
+	// sessions are not configured
+	w := httptest.NewRecorder()
+	handleAuth(w, newAuthRequest())
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("w.Code = %d; want 400", w.Code)
+	}
+
+	setTestSessionConfig()
+	w = httptest.NewRecorder()
+	handleAuth(w, newAuthRequest())
+	if w.Code != http.StatusOK {
+		t.Fatalf("w.Code = %d; want 200\nResponse: %s", w.Code, w.Body.String())
+	}
+	var body struct {
+		CSRFToken string
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("json.Unmarshal(%s): %v", w.Body.String(), err)
+	}
+	cookies := responseCookies(w)
+	sck, cck := cookies[sessionCookie], cookies[csrfCookie]
+	if sck == nil || !sck.HttpOnly || sck.SameSite != http.SameSiteStrictMode {
+		t.Fatalf("session cookie = %+v; want HttpOnly and SameSite=Strict", sck)
+	}
+	if cck == nil || cck.HttpOnly || cck.Value != body.CSRFToken {
+		t.Errorf("csrf cookie = %+v; want readable with value %q", cck, body.CSRFToken)
+	}
+	s, err := decodeSession(sck.Value)
+	if err != nil {
+		t.Fatalf("decodeSession: %v", err)
+	}
+	if s.user != testUserID || s.csrf != body.CSRFToken {
+		t.Errorf("s = %+v; want user %q and csrf %q", s, testUserID, body.CSRFToken)
+	}
+}
+
+func TestHandleLogout(t *testing.T) {
+	defer resetTestState(t)
+	defer preserveConfig()()
+	setTestSessionConfig()
+
+	// a user of its own, since all sessions of the user are revoked
+	const uid = "logout-user"
+	s, _ := newSession(uid, "")
+	// signed in a while ago, so that a new sign-in isn't in the same second
+	s.signedIn = time.Now().Add(-time.Minute)
+	v, _ := s.encode()
+	newLogoutRequest := func(cookie, csrf string) *http.Request {
+		r := newTestRequest(t, "POST", "/api/v1/auth/logout", nil)
+		if cookie != "" {
+			r.AddCookie(&http.Cookie{Name: sessionCookie, Value: cookie})
+		}
+		if csrf != "" {
+			r.Header.Set(csrfHeader, csrf)
+		}
+		return r
+	}
+
+	table := []struct {
+		cookie, csrf string
+		code         int
+	}{
+		{"", "", http.StatusForbidden},
+		{v, "", http.StatusForbidden},
+		{v, "invalid", http.StatusForbidden},
+		{v, s.csrf, http.StatusNoContent},
+		// copies of the cookie are no longer valid
+		{v, s.csrf, http.StatusForbidden},
+	}
+	for i, test := range table {
+		w := httptest.NewRecorder()
+		handleLogout(w, newLogoutRequest(test.cookie, test.csrf))
+		if w.Code != test.code {
+			t.Errorf("%d: w.Code = %d; want %d\nResponse: %s", i, w.Code, test.code, w.Body.String())
+		}
+		if w.Code != http.StatusNoContent {
+			continue
+		}
+		cookies := responseCookies(w)
+		for _, name := range []string{sessionCookie, csrfCookie} {
+			if ck := cookies[name]; ck == nil || ck.MaxAge >= 0 {
+				t.Errorf("%d: %s cookie = %+v; want removed", i, name, ck)
+			}
+		}
+	}
+
+	r := newTestRequest(t, "GET", "/api/v1/user/schedule", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: v})
+	if _, err := authRequest(newContext(r), httptest.NewRecorder(), r); err != errAuthInvalid {
+		t.Errorf("authRequest(revoked): %v; want errAuthInvalid", err)
+	}
+	// signing in again works
+	s2, _ := newSession(uid, "")
+	s2.signedIn = time.Now().Add(time.Second)
+	v2, _ := s2.encode()
+	r = newTestRequest(t, "GET", "/api/v1/user/schedule", nil)
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: v2})
+	if _, err := authRequest(newContext(r), httptest.NewRecorder(), r); err != nil {
+		t.Errorf("authRequest(new session): %v", err)
+	}
+}
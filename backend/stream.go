@@ -0,0 +1,216 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	// streamBufferSize is the number of changes a stream subscriber
+	// may lag behind before it is disconnected.
+	streamBufferSize = 16
+	// streamHeartbeat is how often a comment line is sent to idle streams
+	// to keep the connection open through proxies.
+	streamHeartbeat = 30 * time.Second
+	// streamRetry is the client reconnection delay in milliseconds,
+	// sent in every stream response.
+	streamRetry = 10000
+)
+
+var (
+	// liveStream tells whether stream responses can be kept open and flushed
+	// as the changes come. GAE buffers the whole response, so there clients
+	// receive only the changes since Last-Event-ID and then reconnect.
+	liveStream bool
+
+	// changesHub delivers published changes to all stream subscribers
+	// of the current process.
+	changesHub = &streamHub{subs: make(map[chan *dataChanges]struct{})}
+)
+
+// streamHub is a fan-out of dataChanges to many subscribers.
+type streamHub struct {
+	sync.Mutex
+	subs map[chan *dataChanges]struct{}
+}
+
+// subscribe returns a new channel which receives all published changes.
+// The channel is closed if the subscriber is too slow to keep up,
+// or on unsubscribe.
+func (h *streamHub) subscribe() chan *dataChanges {
+	ch := make(chan *dataChanges, streamBufferSize)
+	h.Lock()
+	h.subs[ch] = struct{}{}
+	h.Unlock()
+	return ch
+}
+
+// unsubscribe removes ch from the list of subscribers and closes it,
+// unless that is already done.
+func (h *streamHub) unsubscribe(ch chan *dataChanges) {
+	h.Lock()
+	defer h.Unlock()
+	if _, ok := h.subs[ch]; ok {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// publish sends dc to all subscribers without blocking.
+// Subscribers with a full buffer are dropped; they can resume
+// from the last received event after reconnecting.
+func (h *streamHub) publish(dc *dataChanges) {
+	h.Lock()
+	defer h.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- dc:
+		default:
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// closeAll closes all subscriber channels, which ends their streams.
+// Clients reconnect after streamRetry and resume from the last event.
+func (h *streamHub) closeAll() {
+	h.Lock()
+	defer h.Unlock()
+	for ch := range h.subs {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// publishChanges sends dc to the schedule stream subscribers.
+// It must be called only after dc has been stored, outside of a transaction.
+func publishChanges(c context.Context, dc *dataChanges) {
+	if isEmptyChanges(dc) {
+		return
+	}
+	// user-targeted parts are delivered only with push notifications
+	pub := *dc
+	pub.Token = ""
+	pub.Announcements = nil
+	changesHub.publish(&pub)
+}
+
+// serveScheduleStream responds with a Server-Sent Events stream of dataChanges.
+// A client may resume from the last received event with Last-Event-ID header,
+// or "lastEventId" query param, since the event IDs are changes timestamps.
+// New clients are sent an ID of the current time to resume from.
+func serveScheduleStream(w http.ResponseWriter, r *http.Request) {
+	c := newContext(r)
+	flusher, canFlush := w.(http.Flusher)
+	live := liveStream && canFlush
+	// subscribe before fetching the backlog so that nothing is missed in between
+	var ch chan *dataChanges
+	if live {
+		ch = changesHub.subscribe()
+		defer changesHub.unsubscribe(ch)
+	}
+
+	var backlog *dataChanges
+	id := r.Header.Get("last-event-id")
+	if id == "" {
+		id = r.FormValue("lastEventId")
+	}
+	if id != "" {
+		ns, err := strconv.ParseInt(id, 10, 64)
+		if err != nil {
+			writeJSONError(c, w, http.StatusBadRequest, "invalid last event ID")
+			return
+		}
+		if backlog, err = getChangesSince(c, time.Unix(0, ns)); err != nil {
+			// can't resume; still stream what comes next
+			errorf(c, "serveScheduleStream: %v", err)
+			backlog = nil
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprintf(w, "retry: %d\n\n", streamRetry)
+	var last time.Time
+	if !isEmptyChanges(backlog) {
+		backlog.Announcements = nil
+		if err := writeStreamEvent(w, backlog); err != nil {
+			errorf(c, "serveScheduleStream: %v", err)
+			return
+		}
+		last = backlog.Updated
+	} else if id == "" {
+		// nothing to send yet: give the client an ID to resume from,
+		// otherwise it reconnects without one and misses all changes
+		// when the stream is not live
+		if _, err := fmt.Fprintf(w, "id: %d\n\n", time.Now().UnixNano()); err != nil {
+			errorf(c, "serveScheduleStream: %v", err)
+			return
+		}
+	}
+	if !live {
+		return
+	}
+	flusher.Flush()
+
+	var gone <-chan bool
+	if cn, ok := w.(http.CloseNotifier); ok {
+		gone = cn.CloseNotify()
+	}
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case dc, ok := <-ch:
+			if !ok {
+				return
+			}
+			if !dc.Updated.After(last) {
+				// already sent with the backlog
+				continue
+			}
+			if err := writeStreamEvent(w, dc); err != nil {
+				return
+			}
+			last = dc.Updated
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case <-gone:
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeStreamEvent writes dc as a single SSE event with dc.Updated as its ID.
+func writeStreamEvent(w http.ResponseWriter, dc *dataChanges) error {
+	b, err := json.Marshal(dc)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: changes\ndata: %s\n\n", dc.Updated.UnixNano(), b)
+	return err
+}
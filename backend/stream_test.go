@@ -0,0 +1,241 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamHubDropsSlowSubscriber(t *testing.T) {
+	h := &streamHub{subs: make(map[chan *dataChanges]struct{})}
+	slow := h.subscribe()
+	fast := h.subscribe()
+	defer h.unsubscribe(fast)
+
+	for i := 0; i < streamBufferSize+1; i++ {
+		h.publish(&dataChanges{Updated: time.Unix(int64(i), 0)})
+		<-fast
+	}
+	n := 0
+	for range slow {
+		n++
+	}
+	if n != streamBufferSize {
+		t.Errorf("n = %d; want %d", n, streamBufferSize)
+	}
+	if len(h.subs) != 1 {
+		t.Errorf("len(h.subs) = %d; want 1", len(h.subs))
+	}
+	// must not panic
+	h.unsubscribe(slow)
+}
+
+func TestServeScheduleStream(t *testing.T) {
+	if isGAEtest {
+		t.Skipf("live streaming is standalone only; isGAEtest = %v", isGAEtest)
+	}
+	defer func(v bool) { liveStream = v }(liveStream)
+	liveStream = true
+
+	ts := httptest.NewServer(http.HandlerFunc(serveScheduleStream))
+	defer ts.Close()
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if v := res.Header.Get("content-type"); v != "text/event-stream" {
+		t.Errorf("content-type = %q; want text/event-stream", v)
+	}
+
+	now := time.Now()
+	go func() {
+		// wait for the handler to subscribe
+		for {
+			changesHub.Lock()
+			n := len(changesHub.subs)
+			changesHub.Unlock()
+			if n > 0 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		publishChanges(nil, &dataChanges{
+			Updated:       now,
+			eventData:     eventData{Sessions: map[string]*eventSession{"one": &eventSession{Id: "one"}}},
+			Announcements: []*announcement{{ID: "secret"}},
+		})
+	}()
+
+	var (
+		id   string
+		data string
+	)
+	sc := bufio.NewScanner(res.Body)
+	for sc.Scan() && data == "" {
+		line := sc.Text()
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			id = line[4:]
+		case strings.HasPrefix(line, "data: "):
+			data = line[6:]
+		}
+	}
+	if want := strconv.FormatInt(now.UnixNano(), 10); id != want {
+		t.Errorf("id = %q; want %q", id, want)
+	}
+	dc := &dataChanges{}
+	if err := json.Unmarshal([]byte(data), dc); err != nil {
+		t.Fatalf("json.Unmarshal(%q): %v", data, err)
+	}
+	if _, ok := dc.Sessions["one"]; !ok {
+		t.Errorf("want session 'one' in %+v", dc.Sessions)
+	}
+	if len(dc.Announcements) != 0 {
+		t.Errorf("dc.Announcements = %+v; want none", dc.Announcements)
+	}
+}
+
+func TestSyncEventDataStream(t *testing.T) {
+	if isGAEtest {
+		t.Skipf("live streaming is standalone only; isGAEtest = %v", isGAEtest)
+	}
+	defer preserveConfig()()
+	defer func(v bool) { liveStream = v }(liveStream)
+	liveStream = true
+	c := newContext(newTestRequest(t, "GET", "/dummy", nil))
+	defer clearEventData(c)
+
+	if err := storeEventData(c, &eventData{
+		modified: time.Now().Add(-time.Hour),
+		Sessions: map[string]*eventSession{"one": &eventSession{Id: "one", Title: "One"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/manifest.json" {
+			w.Header().Set("last-modified", time.Now().UTC().Format(http.TimeFormat))
+			w.Write([]byte(`{"data_files": ["schedule.json"]}`))
+			return
+		}
+		w.Write([]byte(`{"sessions": [{
+			"id": "one",
+			"title": "One updated",
+			"startTimestamp": "2015-05-28T22:00:00Z",
+			"endTimestamp": "2015-05-28T23:00:00Z"
+		}]}`))
+	}))
+	defer upstream.Close()
+	config.Schedule.ManifestURL = upstream.URL + "/manifest.json"
+	config.SyncToken = "sync-token"
+
+	ts := httptest.NewServer(http.HandlerFunc(serveScheduleStream))
+	defer ts.Close()
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	// don't wait for heartbeats forever if no event comes
+	defer time.AfterFunc(10*time.Second, func() { res.Body.Close() }).Stop()
+
+	synced := make(chan int, 1)
+	go func() {
+		// wait for the handler to subscribe
+		for {
+			changesHub.Lock()
+			n := len(changesHub.subs)
+			changesHub.Unlock()
+			if n > 0 {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		r := newTestRequest(t, "POST", "/sync/gcs", nil)
+		r.Header.Set("x-goog-channel-token", config.SyncToken)
+		w := httptest.NewRecorder()
+		syncEventData(w, r)
+		synced <- w.Code
+	}()
+
+	var event, data string
+	sc := bufio.NewScanner(res.Body)
+	for data == "" && sc.Scan() {
+		line := sc.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = line[7:]
+		case strings.HasPrefix(line, "data: "):
+			data = line[6:]
+		}
+	}
+	if code := <-synced; code != http.StatusOK {
+		t.Errorf("syncEventData: code = %d; want 200", code)
+	}
+	if event != "changes" {
+		t.Errorf("event = %q; want changes", event)
+	}
+	dc := &dataChanges{}
+	if err := json.Unmarshal([]byte(data), dc); err != nil {
+		t.Fatalf("json.Unmarshal(%q): %v", data, err)
+	}
+	if s := dc.Sessions["one"]; s == nil || s.Title != "One updated" {
+		t.Errorf("dc.Sessions[one] = %+v; want updated title", s)
+	}
+}
+
+func TestServeScheduleStreamInitialID(t *testing.T) {
+	defer func(v bool) { liveStream = v }(liveStream)
+	liveStream = false
+
+	before := time.Now().UnixNano()
+	w := httptest.NewRecorder()
+	serveScheduleStream(w, newTestRequest(t, "GET", "/api/v1/schedule/stream", nil))
+	after := time.Now().UnixNano()
+
+	var id int64
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		if strings.HasPrefix(line, "id: ") {
+			id, _ = strconv.ParseInt(line[4:], 10, 64)
+		}
+	}
+	if id < before || id > after {
+		t.Errorf("id = %d; want %d..%d in %q", id, before, after, w.Body.String())
+	}
+}
+
+func TestStreamHubCloseAll(t *testing.T) {
+	h := &streamHub{subs: make(map[chan *dataChanges]struct{})}
+	ch1 := h.subscribe()
+	ch2 := h.subscribe()
+	h.closeAll()
+	for i, ch := range []chan *dataChanges{ch1, ch2} {
+		if _, ok := <-ch; ok {
+			t.Errorf("%d: channel is open", i)
+		}
+	}
+	if len(h.subs) != 0 {
+		t.Errorf("len(h.subs) = %d; want 0", len(h.subs))
+	}
+	// must not panic
+	h.unsubscribe(ch1)
+}
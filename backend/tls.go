@@ -0,0 +1,115 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !appengine
+
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// serveTLS reports whether the standalone server listens for HTTPS.
+func serveTLS() bool {
+	return config.Server.TLSCert != "" && config.Server.TLSKey != ""
+}
+
+// configureTLS sets up srv to serve HTTPS, with HTTP/2 only if config.Server.HTTP2 is true.
+func configureTLS(srv *http.Server) {
+	srv.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	if !config.Server.HTTP2 {
+		// a non-nil empty map disables HTTP/2
+		srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+}
+
+// listenAndServe starts srv on its address, over TLS if serveTLS is true.
+func listenAndServe(srv *http.Server) error {
+	if serveTLS() {
+		return srv.ListenAndServeTLS(config.Server.TLSCert, config.Server.TLSKey)
+	}
+	return srv.ListenAndServe()
+}
+
+// newRedirectServer returns a server listening on config.Server.RedirectAddr
+// which redirects all requests to HTTPS,
+// or nil if no redirect listener is configured.
+func newRedirectServer() *http.Server {
+	if !serveTLS() || config.Server.RedirectAddr == "" {
+		return nil
+	}
+	return &http.Server{
+		Addr:         config.Server.RedirectAddr,
+		Handler:      http.HandlerFunc(redirectHTTPS),
+		ReadTimeout:  config.Server.readTimeout,
+		WriteTimeout: config.Server.writeTimeout,
+		IdleTimeout:  config.Server.idleTimeout,
+	}
+}
+
+// secureHandler redirects plain HTTP requests to HTTPS if config.Server.ForceHTTPS is true,
+// and adds Strict-Transport-Security header to HTTPS responses if config.Server.hsts is non-zero.
+func secureHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requestScheme(r) != "https" {
+			if config.Server.ForceHTTPS {
+				redirectHTTPS(w, r)
+				return
+			}
+		} else if config.Server.hsts > 0 {
+			secs := int64(config.Server.hsts.Seconds())
+			w.Header().Set("Strict-Transport-Security", "max-age="+strconv.FormatInt(secs, 10))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// redirectHTTPS redirects r to the same URL with https scheme.
+// GET and HEAD requests are redirected permanently with 301,
+// others with 308 so that clients preserve the method and body.
+func redirectHTTPS(w http.ResponseWriter, r *http.Request) {
+	u := *r.URL
+	u.Scheme = "https"
+	u.Host = httpsHost(requestHost(r))
+	code := http.StatusPermanentRedirect
+	if r.Method == "GET" || r.Method == "HEAD" {
+		code = http.StatusMovedPermanently
+	}
+	http.Redirect(w, r, u.String(), code)
+}
+
+// httpsHost returns host of the HTTPS counterpart of a plain HTTP request to host.
+// With native TLS, it is host with the port of config.Addr, unless that is 443.
+// Otherwise, a proxy terminates TLS on the standard port.
+func httpsHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	} else {
+		host = strings.Trim(host, "[]")
+	}
+	if serveTLS() {
+		if _, port, err := net.SplitHostPort(config.Addr); err == nil && port != "" && port != "443" {
+			return net.JoinHostPort(host, port)
+		}
+	}
+	if strings.Contains(host, ":") {
+		// IPv6 literal
+		return "[" + host + "]"
+	}
+	return host
+}
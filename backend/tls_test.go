@@ -0,0 +1,94 @@
+// Copyright 2015 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !appengine
+
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSecureHandler(t *testing.T) {
+	defer preserveConfig()()
+	config.Server.hsts = 24 * time.Hour
+	config.trustedProxies = []*net.IPNet{{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(8, 32)}}
+	h := secureHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	table := []struct {
+		force    bool
+		method   string
+		proto    string
+		code     int
+		location string
+		hsts     string
+	}{
+		{false, "GET", "", http.StatusTeapot, "", ""},
+		{false, "GET", "https", http.StatusTeapot, "", "max-age=86400"},
+		{true, "GET", "http", http.StatusMovedPermanently, "https://example.org/io2015/schedule?sid=1", ""},
+		{true, "POST", "", http.StatusPermanentRedirect, "https://example.org/io2015/schedule?sid=1", ""},
+		{true, "GET", "https, http", http.StatusTeapot, "", "max-age=86400"},
+	}
+	for i, test := range table {
+		config.Server.ForceHTTPS = test.force
+		r := newTestRequest(t, test.method, "http://example.org/io2015/schedule?sid=1", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		if test.proto != "" {
+			r.Header.Set("x-forwarded-proto", test.proto)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("%d: w.Code = %d; want %d", i, w.Code, test.code)
+		}
+		if v := w.Header().Get("location"); v != test.location {
+			t.Errorf("%d: location = %q; want %q", i, v, test.location)
+		}
+		if v := w.Header().Get("strict-transport-security"); v != test.hsts {
+			t.Errorf("%d: strict-transport-security = %q; want %q", i, v, test.hsts)
+		}
+	}
+}
+
+func TestHTTPSHost(t *testing.T) {
+	defer preserveConfig()()
+	table := []struct {
+		tls  bool
+		addr string
+		host string
+		out  string
+	}{
+		{false, ":8080", "example.org:8080", "example.org"},
+		{true, ":443", "example.org", "example.org"},
+		{true, ":8443", "example.org:8080", "example.org:8443"},
+		{true, "127.0.0.1:8443", "[::1]", "[::1]:8443"},
+		{false, "", "[::1]:80", "[::1]"},
+	}
+	for i, test := range table {
+		config.Server.TLSCert, config.Server.TLSKey = "", ""
+		if test.tls {
+			config.Server.TLSCert, config.Server.TLSKey = "cert.pem", "key.pem"
+		}
+		config.Addr = test.addr
+		if out := httpsHost(test.host); out != test.out {
+			t.Errorf("%d: httpsHost(%q) = %q; want %q", i, test.host, out, test.out)
+		}
+	}
+}